@@ -0,0 +1,152 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+// benchcmp reads the output of go test -bench from stdin and compares it
+// against a stored baseline, exiting with status 1 when a benchmark got
+// slower, or allocates more, than the threshold allows:
+//
+//	go test -run '^$' -bench . -benchmem minimal | benchcmp -baseline bench-baseline.json
+//
+// With -update it writes the results as the new baseline instead.
+// Baselines are only comparable on the machine that recorded them, so
+// they are recorded locally and never committed.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// result are the metrics of a benchmark, by unit: ns/op, B/op, allocs/op
+type result map[string]float64
+
+// compared are the units checked against the baseline. B/op follows
+// allocs/op closely, and MB/s follows ns/op.
+var compared = []string{"ns/op", "allocs/op"}
+
+// procsSuffix is the -GOMAXPROCS suffix go test adds to benchmark names
+var procsSuffix = regexp.MustCompile(`-\d+$`)
+
+// parse reads the benchmark lines of go test output, keeping the fastest
+// run of each benchmark when -count repeats them
+func parse(r io.Reader) (map[string]result, error) {
+	results := map[string]result{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		name := procsSuffix.ReplaceAllString(fields[0], "")
+		current := result{}
+		// fields[1] is the number of iterations, followed by value unit pairs
+		for i := 2; i+1 < len(fields); i += 2 {
+			value, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid value %q", name, fields[i])
+			}
+			current[fields[i+1]] = value
+		}
+		if previous, ok := results[name]; !ok || current["ns/op"] < previous["ns/op"] {
+			results[name] = current
+		}
+	}
+	return results, scanner.Err()
+}
+
+func main() {
+	baseline := flag.String("baseline", "bench-baseline.json", "baseline file")
+	threshold := flag.Float64("threshold", 10, "percentage a metric can grow before it is a regression")
+	update := flag.Bool("update", false, "write the results as the new baseline")
+	flag.Parse()
+
+	results, err := parse(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if len(results) == 0 {
+		fmt.Fprintln(os.Stderr, "no benchmark results in the input")
+		os.Exit(2)
+	}
+
+	if *update {
+		b, err := json.MarshalIndent(results, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(*baseline, append(b, '\n'), 0644)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		fmt.Printf("wrote %d benchmarks to %s\n", len(results), *baseline)
+		return
+	}
+
+	contents, err := ioutil.ReadFile(*baseline)
+	if os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "no baseline %s: record one on this machine with -update first\n", *baseline)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	old := map[string]result{}
+	if err := json.Unmarshal(contents, &old); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *baseline, err)
+		os.Exit(2)
+	}
+
+	names := []string{}
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	regressions := 0
+	w := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(w, "%-40s %-10s %14s %14s %9s\n", "benchmark", "unit", "baseline", "current", "delta")
+	for _, name := range names {
+		base, ok := old[name]
+		if !ok {
+			fmt.Fprintf(w, "%-40s %-10s %14s\n", name, "", "(new)")
+			continue
+		}
+		for _, unit := range compared {
+			before, ok1 := base[unit]
+			after, ok2 := results[name][unit]
+			if !ok1 || !ok2 {
+				continue
+			}
+			delta := 0.0
+			if before != 0 {
+				delta = (after - before) / before * 100
+			} else if after != 0 {
+				delta = 100
+			}
+			mark := ""
+			if delta > *threshold {
+				mark = "  REGRESSION"
+				regressions++
+			}
+			fmt.Fprintf(w, "%-40s %-10s %14.0f %14.0f %+8.1f%%%s\n", name, unit, before, after, delta, mark)
+		}
+	}
+	w.Flush()
+
+	if regressions > 0 {
+		fmt.Fprintf(os.Stderr, "%d regressions above %.0f%%\n", regressions, *threshold)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,198 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+// Package conformance runs the tests/*.json files inside go test, like
+// runtest.py does with a step binary but calling its read-eval-print
+// function directly.
+//
+// A test file is a sequence of forms, one per line, each followed by the
+// lines it is expected to print, written "; line", and the printed value,
+// written ";=>value". A form without a ;=> line can print anything. Lines
+// starting with ;;; are skipped, ;; lines are comments and ;>>> lines
+// change the settings of the tests after them: soft=True tests only log
+// their failures, and deferrable=True and optional=True mark the rest of
+// the file as tests an implementation may leave for later.
+package conformance
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+var (
+	hard       = flag.Bool("conformance.hard", false, "turn soft test failures into failures")
+	deferrable = flag.Bool("conformance.deferrable", true, "run the deferrable tests")
+	optional   = flag.Bool("conformance.optional", true, "run the optional tests")
+)
+
+// Case is a form of a test file with its expected results
+type Case struct {
+	Line int
+	Form string
+	// Out are the lines the form prints before its value
+	Out []string
+	// Ret is the printed value, or "*" when any result is accepted
+	Ret        string
+	Soft       bool
+	Deferrable bool
+	Optional   bool
+}
+
+// Parse reads the cases of a test file
+func Parse(r io.Reader) ([]Case, error) {
+	cases := []Case{}
+	settings := Case{}
+	var current *Case
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		switch {
+		case current != nil && strings.HasPrefix(text, ";=>"):
+			current.Ret = text[3:]
+			current = nil
+			continue
+		case current != nil && strings.HasPrefix(text, "; "):
+			current.Out = append(current.Out, text[2:])
+			continue
+		}
+		current = nil
+		switch {
+		case strings.TrimSpace(text) == "":
+		case strings.HasPrefix(text, ";;"):
+			// ;;; skips a test and ;; is a comment
+		case strings.HasPrefix(text, ";>>> "):
+			if err := settings.set(text[5:]); err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+		case strings.HasPrefix(text, ";"):
+			return nil, fmt.Errorf("line %d: unexpected comment %q", line, text)
+		default:
+			c := settings
+			c.Line = line
+			c.Form = text
+			c.Ret = "*"
+			cases = append(cases, c)
+			current = &cases[len(cases)-1]
+		}
+	}
+	return cases, scanner.Err()
+}
+
+// set applies a ;>>> line, a list of Python style name=True|False pairs
+func (c *Case) set(settings string) error {
+	for _, setting := range strings.Split(settings, ";") {
+		parts := strings.SplitN(strings.TrimSpace(setting), "=", 2)
+		if len(parts) != 2 || (parts[1] != "True" && parts[1] != "False") {
+			return fmt.Errorf("invalid setting %q", setting)
+		}
+		value := parts[1] == "True"
+		switch parts[0] {
+		case "soft":
+			c.Soft = value
+		case "deferrable":
+			c.Deferrable = value
+		case "optional":
+			c.Optional = value
+		default:
+			return fmt.Errorf("unknown setting %q", parts[0])
+		}
+	}
+	return nil
+}
+
+// REP reads, evaluates and prints a form, returning the line a REPL would
+// print for its value or its error
+type REP func(form string) string
+
+// Run runs the cases of file, one subtest each, with rep. The forms run
+// in dir, as the test files refer to other files relative to the
+// directory of the implementation.
+func Run(t *testing.T, file string, dir string, rep REP) {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases, err := Parse(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("%s: %s", file, err)
+	}
+
+	if dir != "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chdir(dir); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chdir(wd)
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(fmt.Sprintf("line%d", c.Line), func(t *testing.T) {
+			if (c.Deferrable && !*deferrable) || (c.Optional && !*optional) {
+				t.Skip("deferrable or optional test")
+			}
+			out, ret := capture(rep, c.Form)
+			// like runtest.py, a form without ;=> passes whatever it prints
+			if c.Ret == "*" || (ret == c.Ret && outputMatches(out, c.Out)) {
+				return
+			}
+			report := t.Errorf
+			if c.Soft && !*hard {
+				report = t.Skipf
+			}
+			report("%s:%d: %s\n  expected output %q and value %s\n  got output      %q and value %s",
+				file, c.Line, c.Form, c.Out, c.Ret, out, ret)
+		})
+	}
+}
+
+// capture calls rep with form collecting what it writes to stdout
+func capture(rep REP, form string) (out string, ret string) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		panic(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		r.Close()
+		done <- string(b)
+	}()
+	defer func() {
+		os.Stdout = stdout
+		w.Close()
+		out = <-done
+	}()
+	return "", rep(form)
+}
+
+func outputMatches(out string, expected []string) bool {
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if out == "" {
+		lines = nil
+	}
+	if len(lines) != len(expected) {
+		return false
+	}
+	for i := range lines {
+		if lines[i] != expected[i] {
+			return false
+		}
+	}
+	return true
+}
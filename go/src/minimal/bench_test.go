@@ -0,0 +1,132 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// The benchmarks of the interpreter. Compare a run against the stored
+// baseline with make bench, see src/benchcmp.
+
+// benchBackends are the evaluators every workload runs on
+var benchBackends = []struct {
+	name string
+	eval func(ast interface{}, env *Environment) interface{}
+}{
+	{"tree", EVAL},
+	{"resolved", EvalResolved},
+	{"compiled", EvalCompiled},
+	{"bytecode", EvalBytecode},
+}
+
+// benchWorkloads are the programs of BenchmarkEval. There is no macro
+// expansion workload: this interpreter has no macros.
+var benchWorkloads = []struct {
+	name string
+	src  string
+}{
+	{"fib", `["do",
+	  ["def", "fib", ["fn", ["n"],
+	    ["if", ["<", "n", 2], "n", ["+", ["fib", ["-", "n", 1]], ["fib", ["-", "n", 2]]]]]],
+	  ["fib", 18]]`},
+	{"tco", `["do",
+	  ["def", "loop", ["fn", ["n", "acc"],
+	    ["if", ["=", "n", 0], "acc",
+	      ["let", ["m", ["-", "n", 1], "a", ["+", "acc", 1]], ["loop", "m", "a"]]]]],
+	  ["loop", 20000, 0]]`},
+	{"arith", `["do",
+	  ["def", "sum", ["fn", ["n", "acc"],
+	    ["if", ["<=", "n", 0], "acc", ["sum", ["-", "n", 1], ["+", "acc", ["*", "n", "n"]]]]]],
+	  ["sum", 20000, 0]]`},
+	{"deep-let", deepLet(200)},
+	{"map", `["do",
+	  ["def", "range", ["fn", ["n", "acc"],
+	    ["if", ["=", "n", 0], "acc", ["range", ["-", "n", 1], ["set", "acc", ["str", "n"], "n"]]]]],
+	  ["def", "m", ["range", 300, {}]],
+	  ["def", "sum", ["fn", ["n", "acc"],
+	    ["if", ["=", "n", 0], "acc", ["sum", ["-", "n", 1], ["+", "acc", ["get", "m", ["str", "n"]]]]]]],
+	  ["sum", 300, 0]]`},
+}
+
+// deepLet returns a program nesting n lets, each one using the symbol
+// bound by the one around it
+func deepLet(n int) string {
+	var b strings.Builder
+	b.WriteString(`["let", ["x0", 0], `)
+	for i := 1; i < n; i++ {
+		fmt.Fprintf(&b, `["let", ["x%d", ["+", "x%d", 1]], `, i, i-1)
+	}
+	fmt.Fprintf(&b, `"x%d"`, n-1)
+	b.WriteString(strings.Repeat("]", n))
+	return b.String()
+}
+
+func BenchmarkEval(b *testing.B) {
+	for _, workload := range benchWorkloads {
+		ast := READ(workload.src)
+		for _, backend := range benchBackends {
+			b.Run(workload.name+"/"+backend.name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					backend.eval(ast, BaseSymbolTable())
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkREAD(b *testing.B) {
+	core, err := ioutil.ReadFile("../../core.json")
+	if err != nil {
+		b.Fatal(err)
+	}
+	inputs := []struct {
+		name string
+		src  string
+	}{
+		{"core", string(core)},
+		{"deep-let", deepLet(200)},
+		{"numbers", "[" + strings.Repeat("12345, 1.5, -7, ", 1000) + "0]"},
+	}
+	for _, input := range inputs {
+		b.Run(input.name, func(b *testing.B) {
+			b.SetBytes(int64(len(input.src)))
+			for i := 0; i < b.N; i++ {
+				READ(input.src)
+			}
+		})
+	}
+	b.Run("source", func(b *testing.B) {
+		b.SetBytes(int64(len(core)))
+		for i := 0; i < b.N; i++ {
+			readSource(string(core), "core.json", readCompat)
+		}
+	})
+}
+
+func BenchmarkJSON(b *testing.B) {
+	core, err := ioutil.ReadFile("../../core.json")
+	if err != nil {
+		b.Fatal(err)
+	}
+	inputs := []struct {
+		name string
+		ast  interface{}
+	}{
+		{"core", READ(string(core))},
+		{"numbers", READ("[" + strings.Repeat("12345, 1.5, -7, ", 1000) + "0]")},
+		{"map", READ(`{"a": [1, 2, 3], "b": {"c": "d", "e": [true, false, null]}}`)},
+	}
+	for _, input := range inputs {
+		b.Run(input.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				JSON(input.ast)
+			}
+		})
+	}
+}
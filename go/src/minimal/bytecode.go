@@ -0,0 +1,266 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// opcode is the low byte of an instruction. The other 24 bits hold its
+// operand.
+type opcode uint8
+
+const (
+	opConst       opcode = iota // push constants[a]
+	opLocal                     // push locals[a]
+	opUpvalue                   // push the value of upvalues[a]
+	opGlobal                    // push the Environment symbol named constants[a]
+	opSetLocal                  // locals[a] = top of the stack, which is kept
+	opDef                       // def the top of the stack as constants[a].(*rDef)
+	opPop                       // drop the top of the stack
+	opJump                      // continue at a
+	opJumpIfFalse               // pop and continue at a if the value is not truthy
+	opJumpIfBound               // continue at a if the top of the stack is bound, else pop it
+	opClosure                   // push a fn made from constants[a].(*proto)
+	opCall                      // call the fn below the top a values with them
+	opTailCall                  // like opCall, replacing the current call
+	opReturn                    // return the top of the stack
+)
+
+var opcodeNames = [...]string{
+	opConst:       "CONST",
+	opLocal:       "LOCAL",
+	opUpvalue:     "UPVALUE",
+	opGlobal:      "GLOBAL",
+	opSetLocal:    "SET_LOCAL",
+	opDef:         "DEF",
+	opPop:         "POP",
+	opJump:        "JUMP",
+	opJumpIfFalse: "JUMP_IF_FALSE",
+	opJumpIfBound: "JUMP_IF_BOUND",
+	opClosure:     "CLOSURE",
+	opCall:        "CALL",
+	opTailCall:    "TAIL_CALL",
+	opReturn:      "RETURN",
+}
+
+const maxOperand = 1<<24 - 1
+
+func instruction(op opcode, a int) uint32 {
+	if a < 0 || a > maxOperand {
+		panic(fmt.Errorf("bytecode operand out of range (%d)", a))
+	}
+	return uint32(op) | uint32(a)<<8
+}
+
+// upvalueDesc tells opClosure where to find an upvalue: a local of the
+// function creating the closure or one of its own upvalues
+type upvalueDesc struct {
+	local bool
+	index int
+}
+
+// proto is a compiled fn body, or a compiled top level form
+type proto struct {
+	code      []uint32
+	constants []interface{}
+	locals    int
+	params    int
+	variadic  bool
+	argSpec   interface{}
+	upvalues  []upvalueDesc
+}
+
+// funcState is the compiler state of the proto being compiled. The lets
+// of a fn do not get frames of their own: their symbols take local slots
+// after the parameters.
+type funcState struct {
+	proto    *proto
+	parent   *funcState
+	scopes   map[*resolveScope]int
+	upvalues map[upvalueDesc]int
+	names    map[*Symbol]int
+}
+
+func newFuncState(parent *funcState) *funcState {
+	return &funcState{
+		proto:    &proto{},
+		parent:   parent,
+		scopes:   map[*resolveScope]int{},
+		upvalues: map[upvalueDesc]int{},
+		names:    map[*Symbol]int{},
+	}
+}
+
+// addScope gives the symbols of scope local slots of this fn
+func (fs *funcState) addScope(scope *resolveScope) {
+	fs.scopes[scope] = fs.proto.locals
+	fs.proto.locals += len(scope.names)
+}
+
+func (fs *funcState) emit(op opcode, a int) int {
+	fs.proto.code = append(fs.proto.code, instruction(op, a))
+	return len(fs.proto.code) - 1
+}
+
+// patch sets the target of the jump at pc to the next instruction
+func (fs *funcState) patch(pc int) {
+	op := opcode(fs.proto.code[pc] & 0xff)
+	fs.proto.code[pc] = instruction(op, len(fs.proto.code))
+}
+
+func (fs *funcState) constant(value interface{}) int {
+	fs.proto.constants = append(fs.proto.constants, value)
+	return len(fs.proto.constants) - 1
+}
+
+// name returns the constant holding a global symbol, shared by every use
+// of the symbol
+func (fs *funcState) name(symbol *Symbol) int {
+	k, ok := fs.names[symbol]
+	if !ok {
+		k = fs.constant(symbol)
+		fs.names[symbol] = k
+	}
+	return k
+}
+
+// variable returns where slot of scope lives as seen from this fn
+func (fs *funcState) variable(scope *resolveScope, slot int) upvalueDesc {
+	if base, ok := fs.scopes[scope]; ok {
+		return upvalueDesc{local: true, index: base + slot}
+	}
+	outer := fs.parent.variable(scope, slot)
+	index, ok := fs.upvalues[outer]
+	if !ok {
+		index = len(fs.proto.upvalues)
+		fs.proto.upvalues = append(fs.proto.upvalues, outer)
+		fs.upvalues[outer] = index
+	}
+	return upvalueDesc{local: false, index: index}
+}
+
+// compileBytecode resolves ast and compiles it to a proto without
+// parameters
+func compileBytecode(ast interface{}) *proto {
+	fs := newFuncState(nil)
+	fs.compile(resolve(ast, nil), nil, true)
+	fs.emit(opReturn, 0)
+	return fs.proto
+}
+
+// compile emits the code of node, which leaves its value on the stack.
+// scope is the innermost scope around node.
+func (fs *funcState) compile(node interface{}, scope *resolveScope, tail bool) {
+	switch n := node.(type) {
+	case *rLocal:
+		s := scope
+		for depth := n.depth; depth > 0; depth-- {
+			s = s.parent
+		}
+		v := fs.variable(s, n.slot)
+		if v.local {
+			fs.emit(opLocal, v.index)
+		} else {
+			fs.emit(opUpvalue, v.index)
+		}
+		if n.fallback != nil {
+			bound := fs.emit(opJumpIfBound, 0)
+			fs.compile(n.fallback, scope, false)
+			fs.patch(bound)
+		}
+	case *rGlobal:
+		fs.emit(opGlobal, fs.name(n.symbol))
+	case *rQuote:
+		fs.emit(opConst, fs.constant(n.value))
+	case *rDef:
+		fs.compile(n.value, scope, false)
+		if n.slot >= 0 {
+			fs.emit(opSetLocal, fs.scopes[scope]+n.slot)
+		} else {
+			fs.emit(opDef, fs.constant(n))
+		}
+	case *rFn:
+		child := newFuncState(fs)
+		child.proto.params = n.params
+		child.proto.variadic = n.variadic
+		child.proto.argSpec = n.argSpec
+		child.addScope(n.scope)
+		child.compile(n.body, n.scope, true)
+		child.emit(opReturn, 0)
+		fs.emit(opClosure, fs.constant(child.proto))
+	case *rLet:
+		fs.addScope(n.scope)
+		base := fs.scopes[n.scope]
+		for _, binding := range n.bindings {
+			fs.compile(binding.value, n.scope, false)
+			fs.emit(opSetLocal, base+binding.slot)
+			fs.emit(opPop, 0)
+		}
+		fs.compile(n.body, n.scope, tail)
+	case *rIf:
+		fs.compile(n.condition, scope, false)
+		otherwise := fs.emit(opJumpIfFalse, 0)
+		fs.compile(n.then, scope, tail)
+		end := fs.emit(opJump, 0)
+		fs.patch(otherwise)
+		fs.compile(n.otherwise, scope, tail)
+		fs.patch(end)
+	case *rDo:
+		for i, form := range n.forms {
+			last := i == len(n.forms)-1
+			fs.compile(form, scope, tail && last)
+			if !last {
+				fs.emit(opPop, 0)
+			}
+		}
+	case *rCall:
+		for _, element := range n.elements {
+			fs.compile(element, scope, false)
+		}
+		if tail {
+			fs.emit(opTailCall, len(n.elements)-1)
+		} else {
+			fs.emit(opCall, len(n.elements)-1)
+		}
+	default:
+		fs.emit(opConst, fs.constant(node))
+	}
+}
+
+// disassemble writes the code of p and of the fns it creates
+func disassemble(w io.Writer, p *proto, name string) {
+	fmt.Fprintf(w, "== %s (%d params, %d locals, %d upvalues) ==\n", name, p.params, p.locals, len(p.upvalues))
+	for i, uv := range p.upvalues {
+		where := "upvalue"
+		if uv.local {
+			where = "local"
+		}
+		fmt.Fprintf(w, "  upvalue %d: %s %d\n", i, where, uv.index)
+	}
+	children := []*proto{}
+	for pc, ins := range p.code {
+		op, a := opcode(ins&0xff), int(ins>>8)
+		fmt.Fprintf(w, "%04d  %-14s", pc, opcodeNames[op])
+		switch op {
+		case opPop, opReturn:
+			fmt.Fprintln(w)
+		case opConst, opGlobal:
+			fmt.Fprintf(w, "%4d  ; %s\n", a, JSON(p.constants[a]))
+		case opDef:
+			fmt.Fprintf(w, "%4d  ; %s\n", a, p.constants[a].(*rDef).symbol)
+		case opClosure:
+			child := p.constants[a].(*proto)
+			children = append(children, child)
+			fmt.Fprintf(w, "%4d  ; fn %s\n", a, JSON(child.argSpec))
+		default:
+			fmt.Fprintf(w, "%4d\n", a)
+		}
+	}
+	for _, child := range children {
+		disassemble(w, child, "fn "+JSON(child.argSpec))
+	}
+}
@@ -0,0 +1,477 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Severities of the diagnostics
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// Diagnostic is a problem found by the static checker
+type Diagnostic struct {
+	Pos      Position
+	Severity string
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s: %s", d.Pos, d.Severity, d.Message)
+}
+
+// checkBinding is what the checker knows about a bound symbol
+type checkBinding struct {
+	// argSpec is the parameter list when the symbol is bound to a fn
+	// literal or a builtin
+	argSpec []interface{}
+}
+
+// checkScope mirrors an Environment during the static analysis
+type checkScope struct {
+	names  map[string]*checkBinding
+	parent *checkScope
+}
+
+func newCheckScope(parent *checkScope) *checkScope {
+	return &checkScope{names: map[string]*checkBinding{}, parent: parent}
+}
+
+func (s *checkScope) lookup(name string) (*checkBinding, bool) {
+	for ; s != nil; s = s.parent {
+		if binding, ok := s.names[name]; ok {
+			return binding, true
+		}
+	}
+	return nil, false
+}
+
+// checker walks an AST reporting the errors EVAL would find at runtime
+type checker struct {
+	mode        readMode
+	diagnostics []Diagnostic
+	loaded      map[string]bool
+	global      *checkScope
+	// deferred are the fn bodies, checked once every top level def is
+	// known because they can refer to symbols defined after them
+	deferred []func()
+	// root is the directory the files loaded with relative paths are read
+	// from, the current one when empty
+	root string
+	// sandbox confines the files checked as -root confines the ones run
+	// loads when not empty, see SetRoot
+	sandbox string
+}
+
+func newChecker(mode readMode) *checker {
+	c := &checker{
+		mode:   mode,
+		loaded: map[string]bool{},
+		global: newCheckScope(nil),
+	}
+	for symbol := range BaseSymbolTable().Scope {
+		binding := &checkBinding{}
+		if doc, ok := builtinDocs[symbol.name]; ok {
+			binding.argSpec, _ = doc.Args.([]interface{})
+		}
+		c.global.names[symbol.name] = binding
+	}
+	c.global.names["ARGS"] = &checkBinding{}
+	return c
+}
+
+func (c *checker) report(pos Position, severity string, format string, args ...interface{}) {
+	c.diagnostics = append(c.diagnostics, Diagnostic{
+		Pos:      pos,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// checkFile reads and checks a source file like load would evaluate it
+func (c *checker) checkFile(file string) {
+	if c.loaded[file] {
+		return
+	}
+	c.loaded[file] = true
+	path := file
+	if c.root != "" && !filepath.IsAbs(file) {
+		path = filepath.Join(c.root, file)
+	}
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = recoveredError(r)
+			}
+		}()
+		if c.sandbox != "" {
+			path = (&evalContext{root: c.sandbox}).path("load", file)
+		}
+		return nil
+	}()
+	if err != nil {
+		c.report(Position{File: file}, severityError, "%s", err)
+		return
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		c.report(Position{File: file}, severityError, "%s", err)
+		return
+	}
+	c.checkSource(string(contents), file)
+}
+
+// checkSource checks the contents of a source file
+func (c *checker) checkSource(src string, file string) {
+	var ast interface{}
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = recoveredError(r)
+			}
+		}()
+		ast = readSource(src, file, c.mode)
+		return nil
+	}()
+	if err != nil {
+		c.report(errorPosition(src, file, err), severityError, "%s", err)
+		return
+	}
+	c.form(ast, c.global, Position{File: file, Line: 1, Col: 1})
+}
+
+// errorPosition returns where the reader found the error err in src
+func errorPosition(src string, file string, err error) Position {
+	offset := 0
+	if syntaxError, ok := err.(*json.SyntaxError); ok {
+		offset = int(syntaxError.Offset) - 1
+	} else if err == io.ErrUnexpectedEOF {
+		offset = len(src)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	pos := Position{File: file, Line: 1, Col: 1}
+	for i := 0; i < offset; i++ {
+		if src[i] == '\n' {
+			pos.Line++
+			pos.Col = 1
+		} else {
+			pos.Col++
+		}
+	}
+	return pos
+}
+
+// finish checks the deferred fn bodies and returns the diagnostics sorted
+// by position
+func (c *checker) finish() []Diagnostic {
+	for len(c.deferred) > 0 {
+		deferred := c.deferred
+		c.deferred = nil
+		for _, f := range deferred {
+			f()
+		}
+	}
+	sort.SliceStable(c.diagnostics, func(i, j int) bool {
+		a, b := c.diagnostics[i].Pos, c.diagnostics[j].Pos
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+	return c.diagnostics
+}
+
+// truthiness returns the value an if condition takes when it is a literal,
+// as truthy computes it. Literal maps, which truthy rejects, are not
+// constant.
+func truthiness(ast interface{}) (value bool, constant bool) {
+	switch ast := ast.(type) {
+	case bool:
+		return ast, true
+	case nil:
+		return false, true
+	case int64, float64, json.Number, *big.Int:
+		return !isZero(ast), true
+	case *Keyword:
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+// arity returns the number of arguments a parameter list accepts, either
+// read from a fn or written as strings in builtinDocs
+func arity(argSpec []interface{}) (required int, variadic bool) {
+	for _, param := range argSpec {
+		if param == symAmp || param == "&" {
+			return required, true
+		}
+		required++
+	}
+	return required, false
+}
+
+// form checks ast evaluated in scope. pos is the position of the closest
+// enclosing list, as atoms have none.
+func (c *checker) form(ast interface{}, scope *checkScope, pos Position) {
+	switch ast := ast.(type) {
+	case *Symbol:
+		if _, ok := scope.lookup(ast.name); !ok {
+			c.report(pos, severityError, "undefined symbol %q", ast.name)
+		}
+	case []interface{}:
+		if p, ok := PositionOf(ast); ok {
+			pos = p
+		}
+		if len(ast) == 0 {
+			c.report(pos, severityError, "cannot call an empty list")
+			return
+		}
+		if head, ok := symbolName(ast[0]); ok && c.special(head, ast, scope, pos) {
+			return
+		}
+		c.call(ast, scope, pos)
+	}
+}
+
+// isGlobal reports whether name refers to a top level binding
+func (s *checkScope) isGlobal(name string) bool {
+	for ; s.parent != nil; s = s.parent {
+		if _, ok := s.names[name]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *checker) call(ast []interface{}, scope *checkScope, pos Position) {
+	for _, element := range ast {
+		c.form(element, scope, pos)
+	}
+	head, ok := symbolName(ast[0])
+	if !ok {
+		return
+	}
+	if head == "load" && scope.isGlobal(head) {
+		if file, ok := quotedString(ast); ok {
+			c.checkFile(file)
+		}
+	}
+	binding, ok := scope.lookup(head)
+	if !ok || binding.argSpec == nil {
+		return
+	}
+	required, variadic := arity(binding.argSpec)
+	given := len(ast) - 1
+	switch {
+	case variadic && given < required:
+		c.report(pos, severityError, "%s called with %d arguments, needs at least %d", head, given, required)
+	case !variadic && given != required:
+		c.report(pos, severityError, "%s called with %d arguments, needs %d", head, given, required)
+	}
+}
+
+// special checks the special forms of EVAL, returning false if head is not
+// one of them. As in EVAL, special forms cannot be shadowed.
+func (c *checker) special(head string, ast []interface{}, scope *checkScope, pos Position) bool {
+	switch head {
+	case "`":
+		if len(ast) != 2 {
+			c.report(pos, severityError, "quote needs 1 argument (found %d)", len(ast)-1)
+		}
+	case "def":
+		c.def(ast, scope, pos)
+	case "fn":
+		if len(ast) != 3 {
+			c.report(pos, severityError, "fn needs 2 arguments (found %d)", len(ast)-1)
+			return true
+		}
+		c.fn(ast, scope, pos)
+	case "let":
+		c.let(ast, scope, pos)
+	case "if":
+		if len(ast) != 4 {
+			c.report(pos, severityError, "if needs 3 arguments (found %d)", len(ast)-1)
+			return true
+		}
+		c.form(ast[1], scope, pos)
+		if _, ok := ast[1].(map[string]interface{}); ok {
+			c.report(pos, severityError, "if requires a quasi boolean condition but got %T", ast[1])
+		} else if value, constant := truthiness(ast[1]); constant {
+			if value {
+				c.report(pos, severityWarning, "unreachable else branch: the condition is always true")
+			} else {
+				c.report(pos, severityWarning, "unreachable then branch: the condition is always false")
+			}
+		}
+		for _, branch := range ast[2:] {
+			c.form(branch, scope, pos)
+		}
+	case "do":
+		if len(ast) < 2 {
+			c.report(pos, severityError, "do needs at least 1 argument")
+		}
+		for _, element := range ast[1:] {
+			c.form(element, scope, pos)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// quotedString returns the argument of a call like ["load", ["`", "file"]]
+func quotedString(ast []interface{}) (string, bool) {
+	if len(ast) != 2 {
+		return "", false
+	}
+	return stringLiteral(ast[1])
+}
+
+func (c *checker) def(ast []interface{}, scope *checkScope, pos Position) {
+	if len(ast) != 3 && len(ast) != 4 {
+		c.report(pos, severityError, "def needs 2 or 3 arguments (found %d)", len(ast)-1)
+		return
+	}
+	name, ok := symbolName(ast[1])
+	if !ok {
+		c.report(pos, severityError, "def name must be a symbol (found %s)", JSON(ast[1]))
+		return
+	}
+	value := ast[len(ast)-1]
+	if len(ast) == 4 {
+		if _, ok := stringLiteral(ast[2]); !ok {
+			c.report(pos, severityError, "def docstring must be a string")
+		}
+	}
+	binding := &checkBinding{}
+	if fn, ok := value.([]interface{}); ok && len(fn) == 3 && fn[0] == symFn {
+		binding.argSpec, _ = fn[1].([]interface{})
+		// the name is bound before the body runs, so it can recurse
+		scope.names[name] = binding
+		c.form(value, scope, pos)
+		return
+	}
+	c.form(value, scope, pos)
+	scope.names[name] = binding
+}
+
+func (c *checker) fn(ast []interface{}, scope *checkScope, pos Position) {
+	params, ok := ast[1].([]interface{})
+	if !ok {
+		c.report(pos, severityError, "fn parameters must be a list")
+		return
+	}
+	fnScope := newCheckScope(scope)
+	for i, param := range params {
+		name, ok := symbolName(param)
+		if !ok {
+			c.report(pos, severityError, "fn parameter must be a symbol (found %s)", JSON(param))
+			continue
+		}
+		if name == "&" {
+			if i != len(params)-2 {
+				c.report(pos, severityError, "& must be followed by exactly one parameter")
+			}
+			continue
+		}
+		if _, ok := fnScope.names[name]; ok {
+			c.report(pos, severityWarning, "duplicate fn parameter %q", name)
+		}
+		fnScope.names[name] = &checkBinding{}
+	}
+	body := ast[2]
+	c.deferred = append(c.deferred, func() {
+		c.form(body, fnScope, pos)
+	})
+}
+
+func (c *checker) let(ast []interface{}, scope *checkScope, pos Position) {
+	if len(ast) != 3 {
+		c.report(pos, severityError, "let needs 2 arguments (found %d)", len(ast)-1)
+		return
+	}
+	bindings, ok := ast[1].([]interface{})
+	if !ok {
+		c.report(pos, severityError, "let bindings must be a list")
+		return
+	}
+	if len(bindings)%2 != 0 {
+		c.report(pos, severityError, "let bindings must be pairs of name and value")
+		return
+	}
+	letScope := newCheckScope(scope)
+	for i := 0; i < len(bindings); i += 2 {
+		name, ok := symbolName(bindings[i])
+		if !ok {
+			c.report(pos, severityError, "let binding name must be a symbol (found %s)", JSON(bindings[i]))
+			continue
+		}
+		if _, ok := letScope.names[name]; ok {
+			c.report(pos, severityWarning, "duplicate let binding %q", name)
+		}
+		binding := &checkBinding{}
+		value := bindings[i+1]
+		if fn, ok := value.([]interface{}); ok && len(fn) == 3 && fn[0] == symFn {
+			binding.argSpec, _ = fn[1].([]interface{})
+		}
+		c.form(value, letScope, pos)
+		letScope.names[name] = binding
+	}
+	c.form(ast[2], letScope, pos)
+}
+
+// checkFiles runs the static checker over files, confined to the
+// directory root when it is not empty, and returns its diagnostics
+func checkFiles(files []string, mode readMode, root string) []Diagnostic {
+	c := newChecker(mode)
+	c.sandbox = root
+	for _, file := range files {
+		c.checkFile(file)
+	}
+	return c.finish()
+}
+
+// cmdCheck implements the check command
+func cmdCheck(opts *options, args []string) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	core := flags.String("core", "", "library whose definitions are visible to the files, such as core.json")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "check requires at least one file")
+		return exitUsage
+	}
+
+	files := flags.Args()
+	if *core != "" {
+		files = append([]string{*core}, files...)
+	}
+	status := exitOK
+	for _, diagnostic := range checkFiles(files, opts.mode, opts.root) {
+		fmt.Println(diagnostic)
+		if diagnostic.Severity == severityError {
+			status = exitError
+		}
+	}
+	return status
+}
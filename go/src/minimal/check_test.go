@@ -0,0 +1,116 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// checkString checks src as the file t.json and returns its diagnostics
+func checkString(src string) []string {
+	c := newChecker(readCompat)
+	c.checkSource(src, "t.json")
+	diagnostics := []string{}
+	for _, d := range c.finish() {
+		diagnostics = append(diagnostics, d.String())
+	}
+	return diagnostics
+}
+
+func TestCheck(t *testing.T) {
+	for _, test := range []struct {
+		src  string
+		want []string
+	}{
+		{`["+", 1, 2]`, nil},
+		{`["+", "y", 2]`, []string{`t.json:1:1: error: undefined symbol "y"`}},
+		{`["+", 1]`, []string{`t.json:1:1: error: + called with 1 arguments, needs 2`}},
+		{`["do", ["def", "f", ["fn", ["a", "&", "r"], "a"]], ["f"], ["f", 1, 2, 3]]`,
+			[]string{`t.json:1:52: error: f called with 0 arguments, needs at least 1`}},
+		// fn bodies can refer to the symbols defined after them
+		{`["do", ["def", "f", ["fn", [], ["g"]]], ["def", "g", ["fn", [], 1]]]`, nil},
+		{`["map", ["fn", ["x"], "x"], ["list", 1], 2]`, []string{`t.json:1:1: error: map called with 3 arguments, needs 2`}},
+		{`["let", ["a", 1], "a", "b"]`, []string{`t.json:1:1: error: let needs 2 arguments (found 3)`}},
+		{`["let", ["a", 1]]`, []string{`t.json:1:1: error: let needs 2 arguments (found 1)`}},
+		{`["let", ["a"], "a"]`, []string{`t.json:1:1: error: let bindings must be pairs of name and value`}},
+		{`["let", ["a", 1, "a", 2], "a"]`, []string{`t.json:1:1: warning: duplicate let binding "a"`}},
+		{`["if", true, 1, 2]`, []string{`t.json:1:1: warning: unreachable else branch: the condition is always true`}},
+		{`["if", 0, 1, 2]`, []string{`t.json:1:1: warning: unreachable then branch: the condition is always false`}},
+		{`["if", ":k", 1, 2]`, []string{`t.json:1:1: warning: unreachable else branch: the condition is always true`}},
+		{`["if", {}, 1, 2]`, []string{`t.json:1:1: error: if requires a quasi boolean condition but got map[string]interface {}`}},
+		{`["if", 1, 2]`, []string{`t.json:1:1: error: if needs 3 arguments (found 2)`}},
+		{`["do"]`, []string{`t.json:1:1: error: do needs at least 1 argument`}},
+		{`["+", 1,`, []string{`t.json:1:8: error: unexpected end of JSON input`}},
+	} {
+		got := checkString(test.src)
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("check %s\n%s\nwant\n%s", test.src, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
+
+// TestCheckAgreesWithEVAL evaluates the forms the checker reports as
+// errors, which must fail with the same message
+func TestCheckAgreesWithEVAL(t *testing.T) {
+	for _, src := range []string{
+		`["let", ["a", 1], "a", ["undefined"]]`,
+		`["let", ["a", 1]]`,
+		`["if", {}, 1, 2]`,
+		`["if", 1, 2]`,
+		`["do"]`,
+	} {
+		diagnostics := checkString(src)
+		if len(diagnostics) != 1 {
+			t.Errorf("check %s: %v", src, diagnostics)
+			continue
+		}
+		_, err := evalWithOptions(&options{}, newSymbolTable(&options{backend: "tree"}, []string{}), func() interface{} {
+			return EVAL(READ(src), BaseSymbolTable())
+		})
+		if err == nil || !strings.HasSuffix(diagnostics[0], "error: "+err.Error()) {
+			t.Errorf("%s: check reports %s, EVAL fails with %v", src, diagnostics[0], err)
+		}
+	}
+}
+
+func TestCheckRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minimal-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	for name, contents := range map[string]string{
+		"root/main.json": `["do", ["load", ["` + "`" + `", "lib.json"]], ["load", ["` + "`" + `", "../outside.json"]]]`,
+		"root/lib.json":  `["+", "y", 1]`,
+		"outside.json":   `["+", "z", 1]`,
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err = sandboxRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, d := range checkFiles([]string{"main.json"}, readCompat, root) {
+		got = append(got, d.String())
+	}
+	want := []string{
+		`../outside.json:0:0: error: load: ../outside.json is outside the root ` + root,
+		`lib.json:1:1: error: undefined symbol "y"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("check under a root:\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
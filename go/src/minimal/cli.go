@@ -0,0 +1,434 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Exit codes of the minimal command
+const (
+	exitOK      = 0
+	exitError   = 1
+	exitUsage   = 2
+	exitTimeout = 124
+)
+
+// errTimeout is the reason used to interrupt an evaluation that took longer
+// than the -timeout flag
+var errTimeout = errors.New("evaluation timed out")
+
+// options are the global flags of the minimal command
+type options struct {
+	timeout time.Duration
+	profile string
+	backend string
+	disasm  bool
+	read    string
+	mode    readMode
+	// coverprofile is where the coverage collected in cover is written
+	coverprofile string
+	coverformat  string
+	cover        *coverage
+	// fnprofile is where the profile collected in fnProfiler is written
+	fnprofile       string
+	fnprofileformat string
+	fnProfiler      *fnProfiler
+	traceEval       bool
+	debug           bool
+	// traceOut is where the trace output goes, stderr when empty
+	traceOut    string
+	traceWriter io.Writer
+	// root confines the filesystem builtins, any path when empty
+	root string
+}
+
+// backends are the evaluators selectable with the -backend flag
+var backends = map[string]func(ast interface{}, env *Environment) interface{}{
+	"tree":     EVAL,
+	"resolved": EvalResolved,
+	"compiled": EvalCompiled,
+	"bytecode": EvalBytecode,
+}
+
+// command is a subcommand of the minimal command
+type command struct {
+	args string
+	help string
+	run  func(opts *options, args []string) int
+}
+
+var commands = map[string]*command{
+	"run":     {args: "file [--] [args...]", help: "evaluate a file, binding args to ARGS", run: cmdRun},
+	"repl":    {args: "", help: "start an interactive read-eval-print loop", run: cmdREPL},
+	"eval":    {args: "-e form [-e form...]", help: "evaluate forms and print the last result", run: cmdEval},
+	"dap":     {args: "", help: "serve the Debug Adapter Protocol over stdin and stdout", run: cmdDAP},
+	"check":   {args: "[-core file] files...", help: "report undefined symbols, arity errors and unreachable code", run: cmdCheck},
+	"doc":     {args: "[-format f] [files...]", help: "write a reference of the documented symbols", run: cmdDoc},
+	"lsp":     {args: "[-core file]", help: "serve the Language Server Protocol over stdin and stdout", run: cmdLSP},
+	"fmt":     {args: "[-w] [-check] [files...]", help: "format source files", run: cmdFormat},
+	"render":  {args: "[-format f] file", help: "evaluate a file and write its value as JSON or YAML", run: cmdRender},
+	"test":    {args: "[-format tap|junit] [-o file] [paths...]", help: "run the deftests of the *_test.json files", run: cmdTest},
+	"serve":   {args: "[-listen addr] [files...]", help: "serve a REPL to minimal connect on localhost or a Unix socket", run: cmdServe},
+	"connect": {args: "addr", help: "start a read-eval-print loop in a REPL server", run: cmdConnect},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: minimal [flags] command [args...]\n")
+	fmt.Fprintf(os.Stderr, "       minimal [flags] file [args...]\n")
+	fmt.Fprintf(os.Stderr, "       minimal [flags] -f form [-raw] [-slurp] [files...]\n\nCommands:\n")
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-34s %s\n", name+" "+commands[name].args, commands[name].help)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	opts := &options{}
+	filter := &filterOptions{}
+	flag.DurationVar(&opts.timeout, "timeout", 0, "abort any evaluation running longer than this (0 means no limit)")
+	flag.StringVar(&opts.profile, "profile", "", "write a CPU profile of the interpreter to this file")
+	flag.StringVar(&opts.backend, "backend", "tree", "evaluator: tree (EVAL), resolved (lexical addressing), compiled (Go closures) or bytecode (stack VM)")
+	flag.BoolVar(&opts.disasm, "disasm", false, "write the bytecode of every evaluated form to stderr (implies -backend bytecode)")
+	flag.StringVar(&opts.coverprofile, "coverprofile", "", "write the coverage of the loaded files to this file (implies -backend tree)")
+	flag.StringVar(&opts.coverformat, "coverformat", "text", "format of -coverprofile: text, html or lcov")
+	flag.StringVar(&opts.fnprofile, "fnprofile", "", "write a profile of the time and allocations of the miniMAL functions to this file (implies -backend tree)")
+	flag.StringVar(&opts.fnprofileformat, "fnprofileformat", "table", "format of -fnprofile: table or pprof")
+	flag.BoolVar(&opts.traceEval, "trace-eval", false, "trace every form evaluated with its depth, source position and TCO iteration (implies -backend tree)")
+	flag.StringVar(&opts.traceOut, "trace-out", "", "write the output of trace and -trace-eval to this file (default stderr)")
+	flag.BoolVar(&opts.debug, "debug", false, "stop at the first form in the debugger, which also stops at break forms (implies -backend tree)")
+	flag.StringVar(&opts.root, "root", "", "confine load, slurp, spit and the other filesystem builtins to this directory, which relative paths are relative to")
+	flag.StringVar(&opts.read, "read", "compat", "how strings are read: compat (\"abc\" is a symbol unless quoted) or symbols (\"`abc\" is a string)")
+	flag.StringVar(&filter.form, "f", "", "filter JSON values read from stdin or files through form, bound to . and it")
+	flag.BoolVar(&filter.raw, "raw", false, "with -f, write string results without JSON quoting")
+	flag.BoolVar(&filter.slurp, "slurp", false, "with -f, collect all the inputs into a list evaluated once")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if backends[opts.backend] == nil {
+		fmt.Fprintf(os.Stderr, "unknown backend %q\n", opts.backend)
+		os.Exit(exitUsage)
+	}
+	mode, ok := readModes[opts.read]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown read mode %q\n", opts.read)
+		os.Exit(exitUsage)
+	}
+	opts.mode = mode
+	if opts.root != "" {
+		root, err := sandboxRoot(opts.root)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitUsage)
+		}
+		opts.root = root
+	}
+	if opts.coverprofile != "" {
+		if coverFormats[opts.coverformat] == nil {
+			fmt.Fprintf(os.Stderr, "unknown coverage format %q\n", opts.coverformat)
+			os.Exit(exitUsage)
+		}
+		opts.backend = "tree"
+		opts.cover = newCoverage()
+	}
+	if opts.fnprofile != "" {
+		if fnProfileFormats[opts.fnprofileformat] == nil {
+			fmt.Fprintf(os.Stderr, "unknown function profile format %q\n", opts.fnprofileformat)
+			os.Exit(exitUsage)
+		}
+		opts.backend = "tree"
+		opts.fnProfiler = newFnProfiler()
+	}
+	if opts.traceEval || opts.debug {
+		opts.backend = "tree"
+	}
+	if opts.traceOut != "" {
+		f, err := os.Create(opts.traceOut)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitUsage)
+		}
+		opts.traceWriter = f
+	}
+	if opts.profile != "" {
+		f, err := os.Create(opts.profile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitUsage)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	var status int
+	switch {
+	case filter.form != "":
+		status = cmdFilter(opts, filter, args)
+	case len(args) == 0:
+		status = cmdREPL(opts, args)
+	case commands[args[0]] != nil:
+		status = commands[args[0]].run(opts, args[1:])
+	default:
+		// minimal file args... behaves as the step binaries always did
+		status = cmdRun(opts, args)
+	}
+
+	if opts.profile != "" {
+		pprof.StopCPUProfile()
+	}
+	if f, ok := opts.traceWriter.(*os.File); ok {
+		f.Close()
+	}
+	if opts.fnProfiler != nil {
+		if err := writeFnProfile(opts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			if status == exitOK {
+				status = exitError
+			}
+		}
+	}
+	if opts.cover != nil {
+		if err := writeCoverage(opts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			if status == exitOK {
+				status = exitError
+			}
+		}
+	}
+	os.Exit(status)
+}
+
+// newSymbolTable returns the top level environment used by the commands
+func newSymbolTable(opts *options, args []string) *Environment {
+	symbolTable := BaseSymbolTable()
+	symbolTable.ctx.eval = backends[opts.backend]
+	symbolTable.ctx.mode = opts.mode
+	symbolTable.ctx.root = opts.root
+	symbolTable.ctx.cover = opts.cover
+	symbolTable.ctx.profile = opts.fnProfiler
+	symbolTable.SetTraceEval(opts.traceEval)
+	if opts.debug {
+		symbolTable.ctx.debugger = newDebugger(&terminalDebugger{in: stdin, out: os.Stdout})
+		symbolTable.ctx.debugger.resume(stepInto)
+	}
+	if opts.traceWriter != nil {
+		symbolTable.SetTraceWriter(opts.traceWriter)
+	}
+	if opts.disasm {
+		symbolTable.ctx.eval = func(ast interface{}, env *Environment) interface{} {
+			return evalBytecode(ast, env, os.Stderr)
+		}
+	}
+	// ARGS is a list like the ones the program builds
+	list := make([]interface{}, len(args))
+	for i, arg := range args {
+		list[i] = arg
+	}
+	symbolTable.Set("ARGS", list)
+	return symbolTable
+}
+
+// writeCoverage writes the coverage collected by the evaluations to the
+// -coverprofile file
+func writeCoverage(opts *options) error {
+	f, err := os.Create(opts.coverprofile)
+	if err != nil {
+		return err
+	}
+	coverFormats[opts.coverformat](opts.cover, f)
+	return f.Close()
+}
+
+// writeFnProfile stops the function profiler and writes its profile to the
+// -fnprofile file
+func writeFnProfile(opts *options) error {
+	opts.fnProfiler.stop()
+	f, err := os.Create(opts.fnprofile)
+	if err != nil {
+		return err
+	}
+	if err := fnProfileFormats[opts.fnprofileformat](opts.fnProfiler, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// stdin is shared by the REPL and the debugger prompt
+var stdin = bufio.NewReader(os.Stdin)
+
+// evalWithOptions runs eval on env honoring the global flags and recovers
+// the panics used by the interpreter to signal errors
+func evalWithOptions(opts *options, env *Environment, eval func() interface{}) (result interface{}, err error) {
+	if opts.timeout > 0 {
+		timer := time.AfterFunc(opts.timeout, func() { env.Interrupt(errTimeout) })
+		defer env.ctx.reset()
+		defer timer.Stop()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoveredError(r)
+		}
+	}()
+	return eval(), nil
+}
+
+// recoveredError converts a recovered panic to an error
+func recoveredError(r interface{}) error {
+	switch r := r.(type) {
+	case error:
+		return r
+	default:
+		return fmt.Errorf("%v", r)
+	}
+}
+
+// exitStatus reports err to stderr and returns the matching exit code
+func exitStatus(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	fmt.Fprintf(os.Stderr, "error: %s\n", err)
+	if err == errTimeout {
+		return exitTimeout
+	}
+	return exitError
+}
+
+func cmdRun(opts *options, args []string) int {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	args = flags.Args()
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "run requires a file")
+		return exitUsage
+	}
+	file, programArgs := args[0], args[1:]
+	if len(programArgs) > 0 && programArgs[0] == "--" {
+		programArgs = programArgs[1:]
+	}
+
+	symbolTable := newSymbolTable(opts, programArgs)
+	_, err := evalWithOptions(opts, symbolTable, func() interface{} {
+		return evaluate([]interface{}{Intern("load"), file}, symbolTable)
+	})
+	return exitStatus(err)
+}
+
+func cmdREPL(opts *options, args []string) int {
+	symbolTable := newSymbolTable(opts, args)
+	debug := symbolTable.ctx.debugger
+	if debug == nil && opts.backend == "tree" {
+		// the debugger is attached by the first debugger command or break
+		// form, EVAL runs without its bookkeeping until then
+		debug = newDebugger(&terminalDebugger{in: stdin, out: os.Stdout})
+		symbolTable.ctx.breakDebugger = debug
+	}
+
+	for {
+		fmt.Print("> ")
+		line, err := stdin.ReadString('\n')
+		if err == io.EOF {
+			return exitOK
+		}
+
+		line = strings.Trim(line, " \t\n")
+		if len(line) == 0 {
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			if debug == nil {
+				fmt.Fprintln(os.Stderr, "error: the debugger needs -backend tree")
+				continue
+			}
+			symbolTable.ctx.debugger = debug
+			if !strings.HasPrefix(line, ":step ") {
+				if !breakpointCommand(debug, line, os.Stdout) {
+					fmt.Fprintf(os.Stderr, "error: unknown command %s\n", strings.Fields(line)[0])
+				}
+				continue
+			}
+			// :step form evaluates form stopping at its first form
+			line = strings.TrimSpace(strings.TrimPrefix(line, ":step "))
+			debug.resume(stepInto)
+		} else if debug != nil {
+			debug.resume(stepNone)
+		}
+
+		printed, err := evalWithOptions(opts, symbolTable, func() interface{} {
+			return JSON(evaluate(symbolTable.Read(line), symbolTable))
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			continue
+		}
+		fmt.Println(printed)
+	}
+}
+
+// stringList is a flag that can be repeated
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func cmdEval(opts *options, args []string) int {
+	flags := flag.NewFlagSet("eval", flag.ContinueOnError)
+	var forms stringList
+	flags.Var(&forms, "e", "form to evaluate (can be repeated)")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if len(forms) == 0 {
+		fmt.Fprintln(os.Stderr, "eval requires at least one -e form")
+		return exitUsage
+	}
+
+	symbolTable := newSymbolTable(opts, flags.Args())
+	var result interface{}
+	for _, form := range forms {
+		var err error
+		result, err = evalWithOptions(opts, symbolTable, func() interface{} {
+			return evaluate(symbolTable.Read(form), symbolTable)
+		})
+		if err != nil {
+			return exitStatus(err)
+		}
+	}
+	printed, err := evalWithOptions(opts, symbolTable, func() interface{} {
+		return JSON(result)
+	})
+	if err != nil {
+		return exitStatus(err)
+	}
+	fmt.Println(printed)
+	return exitOK
+}
@@ -0,0 +1,92 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the minimal command instead of the tests when the tests
+// run their own binary as minimal, so they see its output and exit status
+func TestMain(m *testing.M) {
+	if os.Getenv("MINIMAL_TEST_MAIN") == "1" {
+		os.Args = append([]string{"minimal"}, os.Args[1:]...)
+		main()
+	}
+	os.Exit(m.Run())
+}
+
+// runMinimal runs the minimal command with args and stdin in dir, the
+// current directory when empty, and returns its stdout, stderr and exit
+// status
+func runMinimal(t *testing.T, dir, stdin string, args ...string) (string, string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "MINIMAL_TEST_MAIN=1")
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()
+}
+
+func TestCLI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minimal-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	program := `["do", ["prn", "ARGS"], ["first", "ARGS"]]`
+	if err := ioutil.WriteFile(filepath.Join(dir, "args.json"), []byte(program), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		args           []string
+		stdin          string
+		stdout, stderr string
+		status         int
+	}{
+		{[]string{"eval", "-e", `["+", 1, 2]`}, "", "3\n", "", exitOK},
+		{[]string{"eval", "-e", `["def", "x", 2]`, "-e", `["*", "x", 3]`}, "", "6\n", "", exitOK},
+		{[]string{"eval", "-e", `["first", 1]`}, "", "", "error: first argument must be a list\n", exitError},
+		{[]string{"eval"}, "", "", "eval requires at least one -e form\n", exitUsage},
+		{[]string{"run", "args.json", "--", "-a", "b"}, "", "[\"-a\",\"b\"]\n", "", exitOK},
+		{[]string{"args.json", "a"}, "", "[\"a\"]\n", "", exitOK},
+		{[]string{"run", "missing.json"}, "", "", "error: open missing.json: no such file or directory\n", exitError},
+		{[]string{"run"}, "", "", "run requires a file\n", exitUsage},
+		{[]string{"-backend", "nope", "eval", "-e", "1"}, "", "", "unknown backend \"nope\"\n", exitUsage},
+		{[]string{"-read", "nope", "eval", "-e", "1"}, "", "", "unknown read mode \"nope\"\n", exitUsage},
+		{[]string{"-timeout", "50ms", "eval", "-e", `["do", ["def", "f", ["fn", [], ["f"]]], ["f"]]`}, "", "", "error: evaluation timed out\n", exitTimeout},
+		{[]string{}, "[\"+\", 1, 2]\n[\"first\", 1]\n", "> 3\n> > ", "error: first argument must be a list\n", exitOK},
+		// values that cannot be printed are errors
+		{[]string{"eval", "-e", `"+"`}, "", "", "error: json: unsupported type: func([]interface {}) interface {}\n", exitError},
+		{[]string{}, "\"+\"\n1\n", "> > 1\n> ", "error: json: unsupported type: func([]interface {}) interface {}\n", exitOK},
+		// the REPL attaches its debugger at the first break form
+		{[]string{}, "[\"do\", [\"break\"], 1]\nc\n", "> stopped (break)\ndebug> 1\n> ", "", exitOK},
+	} {
+		stdout, stderr, status := runMinimal(t, dir, test.stdin, test.args...)
+		if stdout != test.stdout || stderr != test.stderr || status != test.status {
+			t.Errorf("minimal %s: status %d, stdout %q, stderr %q\nwant status %d, stdout %q, stderr %q",
+				strings.Join(test.args, " "), status, stdout, stderr, test.status, test.stdout, test.stderr)
+		}
+	}
+
+	for _, args := range [][]string{{"-nope"}, {"eval", "-nope"}} {
+		if _, stderr, status := runMinimal(t, dir, "", args...); status != exitUsage || !strings.Contains(stderr, "flag provided but not defined: -nope") {
+			t.Errorf("minimal %s: status %d, stderr %q", strings.Join(args, " "), status, stderr)
+		}
+	}
+}
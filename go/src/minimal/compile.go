@@ -0,0 +1,181 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+// Value is any miniMAL value
+type Value = interface{}
+
+// compiled is a form compiled to a Go closure. The special forms are
+// dispatched once, when the form is compiled, instead of every time it
+// runs.
+type compiled func(*Frame) Value
+
+// tailCall is returned by a call in tail position instead of running it,
+// so the caller can run it in a loop without growing the Go stack
+type tailCall struct {
+	fn    *compiledFn
+	frame *Frame
+}
+
+// compiledFn is a fn created by the compiling evaluator
+type compiledFn struct {
+	closure
+	body compiled
+}
+
+func (c *compiledFn) call(args []interface{}) interface{} {
+	return trampoline(c.body(c.bind(args)))
+}
+
+// trampoline runs the pending tail calls of result
+func trampoline(result Value) Value {
+	for {
+		tc, ok := result.(*tailCall)
+		if !ok {
+			return result
+		}
+		tc.fn.env.ctx.check()
+		result = tc.fn.body(tc.frame)
+	}
+}
+
+// compile converts a resolved node to a closure evaluated in env. Calls
+// in tail position return a *tailCall when tail is true.
+func compile(node interface{}, env *Environment, tail bool) compiled {
+	switch n := node.(type) {
+	case *rLocal:
+		depth, slot := n.depth, n.slot
+		if n.fallback != nil {
+			fallback := compile(n.fallback, env, false)
+			return func(frame *Frame) Value {
+				f := frame
+				for d := depth; d > 0; d-- {
+					f = f.parent
+				}
+				if value := f.slots[slot]; value != unbound {
+					return value
+				}
+				return fallback(frame)
+			}
+		}
+		switch depth {
+		case 0:
+			return func(frame *Frame) Value { return frame.slots[slot] }
+		case 1:
+			return func(frame *Frame) Value { return frame.parent.slots[slot] }
+		}
+		return func(frame *Frame) Value {
+			for d := depth; d > 0; d-- {
+				frame = frame.parent
+			}
+			return frame.slots[slot]
+		}
+	case *rGlobal:
+		symbol := n.symbol
+		return func(*Frame) Value { return env.Lookup(symbol) }
+	case *rQuote:
+		value := n.value
+		return func(*Frame) Value { return value }
+	case *rDef:
+		return compileDef(n, env)
+	case *rFn:
+		return compileFn(n, env)
+	case *rLet:
+		return compileLet(n, env, tail)
+	case *rIf:
+		condition := compile(n.condition, env, false)
+		then := compile(n.then, env, tail)
+		otherwise := compile(n.otherwise, env, tail)
+		return func(frame *Frame) Value {
+			if truthy(condition(frame)) {
+				return then(frame)
+			}
+			return otherwise(frame)
+		}
+	case *rDo:
+		forms := make([]compiled, len(n.forms))
+		for i, form := range n.forms {
+			forms[i] = compile(form, env, tail && i == len(n.forms)-1)
+		}
+		return func(frame *Frame) Value {
+			for _, form := range forms[:len(forms)-1] {
+				form(frame)
+			}
+			return forms[len(forms)-1](frame)
+		}
+	case *rCall:
+		return compileCall(n, env, tail)
+	default:
+		return func(*Frame) Value { return node }
+	}
+}
+
+func compileDef(n *rDef, env *Environment) compiled {
+	value := compile(n.value, env, false)
+	if n.slot >= 0 {
+		slot := n.slot
+		return func(frame *Frame) Value {
+			v := value(frame)
+			frame.slots[slot] = v
+			return v
+		}
+	}
+	return func(frame *Frame) Value {
+		v := value(frame)
+		env.Define(n.symbol, v)
+		env.setDoc(n.symbol.name, n.docstring, v, n.ast)
+		return v
+	}
+}
+
+func compileFn(n *rFn, env *Environment) compiled {
+	body := compile(n.body, env, true)
+	return func(frame *Frame) Value {
+		return &compiledFn{closure: closure{fn: n, frame: frame, env: env}, body: body}
+	}
+}
+
+func compileLet(n *rLet, env *Environment, tail bool) compiled {
+	scope := n.scope
+	slots := make([]int, len(n.bindings))
+	values := make([]compiled, len(n.bindings))
+	for i, binding := range n.bindings {
+		slots[i] = binding.slot
+		values[i] = compile(binding.value, env, false)
+	}
+	body := compile(n.body, env, tail)
+	return func(frame *Frame) Value {
+		frame = newFrame(scope, frame)
+		for i, value := range values {
+			frame.slots[slots[i]] = value(frame)
+		}
+		return body(frame)
+	}
+}
+
+func compileCall(n *rCall, env *Environment, tail bool) compiled {
+	head := compile(n.elements[0], env, false)
+	elements := make([]compiled, len(n.elements)-1)
+	for i, element := range n.elements[1:] {
+		elements[i] = compile(element, env, false)
+	}
+	return func(frame *Frame) Value {
+		env.ctx.check()
+		f := head(frame)
+		args := make([]interface{}, len(elements))
+		for i, element := range elements {
+			args[i] = element(frame)
+		}
+		if f, ok := f.(*compiledFn); ok && tail {
+			return &tailCall{fn: f, frame: f.bind(args)}
+		}
+		return apply(f, args)
+	}
+}
+
+// EvalCompiled resolves and compiles ast and runs it in env
+func EvalCompiled(ast interface{}, env *Environment) interface{} {
+	return trampoline(compile(resolve(ast, nil), env, true)(nil))
+}
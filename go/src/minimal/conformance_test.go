@@ -0,0 +1,120 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"conformance"
+)
+
+// conformanceFiles are the tests/*.json files minimal runs, every one with
+// a fresh Environment. step8_macros and step9_try need defmacro and
+// try*, which minimal does not have.
+var conformanceFiles = []string{
+	"step2_eval.json",
+	"step3_env.json",
+	"step4_if_fn_do.json",
+	"step5_tco.json",
+	"step6_file.json",
+	"step7_interop.json",
+}
+
+func TestConformance(t *testing.T) {
+	names := []string{}
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, backend := range names {
+		opts := &options{backend: backend}
+		t.Run(backend, func(t *testing.T) {
+			for _, file := range conformanceFiles {
+				symbolTable := newSymbolTable(opts, []string{})
+				t.Run(strings.TrimSuffix(file, ".json"), func(t *testing.T) {
+					conformance.Run(t, "../../../tests/"+file, "../..", func(form string) string {
+						result, err := evalWithOptions(opts, symbolTable, func() interface{} {
+							return evaluate(symbolTable.Read(strings.Trim(form, " \t\n")), symbolTable)
+						})
+						if err != nil {
+							return "error: " + err.Error()
+						}
+						return JSON(result)
+					})
+				})
+			}
+		})
+	}
+}
+
+// TestMap runs map, whose tests in step9_try.json are skipped, on every
+// backend
+func TestMap(t *testing.T) {
+	for backend := range backends {
+		opts := &options{backend: backend}
+		for _, test := range []struct{ src, want string }{
+			{`["map", ["fn", ["x"], ["+", "x", 1]], ["list", 1, 2, 3]]`, `[2,3,4]`},
+			{`["map", ["fn", ["x"], "x"], ["list"]]`, `[]`},
+			{`["do", ["def", "double", ["fn", ["a"], ["*", 2, "a"]]], ["map", "double", ["list", 1, 2]]]`, `[2,4]`},
+			{`["map", ["fn", ["x"], "x"], 1]`, `error: map requires a list (was int64)`},
+			{`["map", ["fn", ["x", "y"], "x"], 1, 2]`, `error: wrong number of arguments (3 instead of 2)`},
+		} {
+			symbolTable := newSymbolTable(opts, []string{})
+			result, err := evalWithOptions(opts, symbolTable, func() interface{} {
+				return evaluate(symbolTable.Read(test.src), symbolTable)
+			})
+			got := JSON(result)
+			if err != nil {
+				got = "error: " + err.Error()
+			}
+			if got != test.want {
+				t.Errorf("%s: %s = %s, want %s", backend, test.src, got, test.want)
+			}
+		}
+	}
+}
+
+// TestBackendsScoping runs forms whose fns use let bindings and defs
+// before they are bound, comparing every backend with the tree walker
+func TestBackendsScoping(t *testing.T) {
+	for _, src := range []string{
+		`["let", ["f", ["fn", ["n"], ["if", ["=", "n", 0], 0, ["f", ["-", "n", 1]]]]], ["f", 3]]`,
+		`["let", ["x", 1], ["do", ["def", "f", ["fn", [], "z"]], ["def", "z", 3], ["f"]]]`,
+		`["let", ["even?", ["fn", ["n"], ["if", ["=", "n", 0], true, ["odd?", ["-", "n", 1]]]],
+		          "odd?", ["fn", ["n"], ["if", ["=", "n", 0], false, ["even?", ["-", "n", 1]]]]],
+		  ["list", ["even?", 10], ["odd?", 7]]]`,
+		`["let", ["f", ["fn", [], "b"], "b", 2], ["f"]]`,
+		`["do", ["def", "b", 10], ["let", ["a", "b", "b", 1], ["list", "a", "b"]]]`,
+		`["do", ["def", "g", 5],
+		  ["def", "h", ["fn", [], ["do", ["def", "k", "g"], ["def", "g", 6], ["list", "k", "g"]]]],
+		  ["list", ["h"], "g"]]`,
+		`["do", ["def", "y", 1], ["let", ["q", 0], ["do", ["if", false, ["def", "y", 2], null], "y"]]]`,
+		`["let", ["a", ["do", ["def", "c", 4], 1]], ["list", "a", "c"]]`,
+		`[["fn", ["x"], ["do", ["def", "x", ["+", "x", 1]], "x"]], 1]`,
+		`[["fn", ["&", "r"], ["do", ["def", "n", ["count", "r"]], "n"]], 1, 2]`,
+		`["let", ["f", ["fn", [], "undefined-yet"]], ["f"]]`,
+		`["let", ["a", "undefined-yet"], "a"]`,
+	} {
+		want := ""
+		for _, backend := range []string{"tree", "resolved", "compiled", "bytecode"} {
+			opts := &options{backend: backend}
+			symbolTable := newSymbolTable(opts, []string{})
+			result, err := evalWithOptions(opts, symbolTable, func() interface{} {
+				return evaluate(symbolTable.Read(src), symbolTable)
+			})
+			got := JSON(result)
+			if err != nil {
+				got = "error: " + err.Error()
+			}
+			if backend == "tree" {
+				want = got
+			} else if got != want {
+				t.Errorf("%s: %s = %s, tree gives %s", backend, src, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,356 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// coverage counts how many times EVAL evaluated each form of the files
+// read by load, keyed by their source positions, and which branches of
+// every if it took. Lines are covered when a form starting on them was
+// evaluated.
+type coverage struct {
+	sync.Mutex
+	files map[string]*fileCoverage
+}
+
+type fileCoverage struct {
+	source string
+	forms  map[Position]int64
+	// branches are the times the then and the else branches of each if
+	// were taken
+	branches map[Position]*[2]int64
+}
+
+func newCoverage() *coverage {
+	return &coverage{files: map[string]*fileCoverage{}}
+}
+
+// coverFormats are the writers of the -coverformat flag
+var coverFormats = map[string]func(c *coverage, w io.Writer){
+	"text": (*coverage).writeText,
+	"html": (*coverage).writeHTML,
+	"lcov": (*coverage).writeLCOV,
+}
+
+// add records the forms of ast, read from file with the given contents,
+// as forms to cover. Loading a file again keeps its counts.
+func (c *coverage) add(file string, source string, ast interface{}) {
+	c.Lock()
+	defer c.Unlock()
+	f := c.files[file]
+	if f == nil {
+		f = &fileCoverage{source: source, forms: map[Position]int64{}, branches: map[Position]*[2]int64{}}
+		c.files[file] = f
+	}
+	f.add(ast)
+}
+
+// add walks the forms EVAL can evaluate: it skips quoted data, fn
+// parameters and the names in let bindings and defs
+func (f *fileCoverage) add(ast interface{}) {
+	list, ok := ast.([]interface{})
+	if !ok || len(list) == 0 {
+		return
+	}
+	pos, ok := PositionOf(list)
+	if ok {
+		if _, seen := f.forms[pos]; !seen {
+			f.forms[pos] = 0
+		}
+	}
+	switch list[0] {
+	case symQuote:
+		return
+	case symFn:
+		if len(list) == 3 {
+			f.add(list[2])
+		}
+		return
+	case symLet:
+		if len(list) == 3 {
+			if bindings, ok := list[1].([]interface{}); ok {
+				for i := 1; i < len(bindings); i += 2 {
+					f.add(bindings[i])
+				}
+			}
+			f.add(list[2])
+		}
+		return
+	case symDef:
+		f.add(list[len(list)-1])
+		return
+	case symIf:
+		if ok && f.branches[pos] == nil {
+			f.branches[pos] = &[2]int64{}
+		}
+	}
+	for _, element := range list {
+		f.add(element)
+	}
+}
+
+// hit counts an evaluation of the list ast
+func (c *coverage) hit(ast []interface{}) {
+	pos, ok := PositionOf(ast)
+	if !ok {
+		return
+	}
+	c.Lock()
+	if f := c.files[pos.File]; f != nil {
+		if _, ok := f.forms[pos]; ok {
+			f.forms[pos]++
+		}
+	}
+	c.Unlock()
+}
+
+// branch counts the then (0) or else (1) branch taken by the if form ast
+func (c *coverage) branch(ast []interface{}, taken int) {
+	pos, ok := PositionOf(ast)
+	if !ok {
+		return
+	}
+	c.Lock()
+	if f := c.files[pos.File]; f != nil && f.branches[pos] != nil {
+		f.branches[pos][taken]++
+	}
+	c.Unlock()
+}
+
+// lineCoverage is the coverage of a source line
+type lineCoverage struct {
+	// hits is the count of the most evaluated form starting on the line
+	hits int64
+	// partial is true when some form starting on the line was not
+	// evaluated or some branch of an if on it was not taken
+	partial bool
+}
+
+// branchCoverage is an if form and the times each branch was taken
+type branchCoverage struct {
+	pos   Position
+	hits  int64
+	taken [2]int64
+}
+
+func (f *fileCoverage) lines() map[int]*lineCoverage {
+	lines := map[int]*lineCoverage{}
+	for pos, hits := range f.forms {
+		line := lines[pos.Line]
+		if line == nil {
+			line = &lineCoverage{}
+			lines[pos.Line] = line
+		}
+		if hits == 0 {
+			line.partial = true
+		}
+		if hits > line.hits {
+			line.hits = hits
+		}
+	}
+	for pos, taken := range f.branches {
+		if taken[0] == 0 || taken[1] == 0 {
+			lines[pos.Line].partial = true
+		}
+	}
+	return lines
+}
+
+// sortedBranches returns the if forms of the file in source order
+func (f *fileCoverage) sortedBranches() []branchCoverage {
+	branches := []branchCoverage{}
+	for pos, taken := range f.branches {
+		branches = append(branches, branchCoverage{pos: pos, hits: f.forms[pos], taken: *taken})
+	}
+	sort.Slice(branches, func(i, j int) bool {
+		a, b := branches[i].pos, branches[j].pos
+		return a.Line < b.Line || (a.Line == b.Line && a.Col < b.Col)
+	})
+	return branches
+}
+
+// summary returns the covered and total lines and branches of the file
+func (f *fileCoverage) summary() (coveredLines, lines, takenBranches, branches int) {
+	for _, line := range f.lines() {
+		lines++
+		if line.hits > 0 {
+			coveredLines++
+		}
+	}
+	for _, taken := range f.branches {
+		branches += 2
+		for _, count := range taken {
+			if count > 0 {
+				takenBranches++
+			}
+		}
+	}
+	return
+}
+
+func (c *coverage) sortedFiles() []string {
+	names := []string{}
+	for name := range c.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func percent(covered, total int) string {
+	if total == 0 {
+		return "100.0%"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(covered)/float64(total))
+}
+
+// lineRanges writes sorted line numbers as a list of ranges like 3, 7-9
+func lineRanges(numbers []int) string {
+	ranges := []string{}
+	for i := 0; i < len(numbers); {
+		j := i
+		for j+1 < len(numbers) && numbers[j+1] == numbers[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, fmt.Sprint(numbers[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", numbers[i], numbers[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ", ")
+}
+
+// writeText writes the coverage of each file and the lines and branches
+// that were not covered
+func (c *coverage) writeText(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	var allCovered, allLines, allTaken, allBranches int
+	for _, name := range c.sortedFiles() {
+		f := c.files[name]
+		coveredLines, lines, takenBranches, branches := f.summary()
+		allCovered += coveredLines
+		allLines += lines
+		allTaken += takenBranches
+		allBranches += branches
+		fmt.Fprintf(w, "%s: %s of lines (%d/%d), %s of branches (%d/%d)\n", name,
+			percent(coveredLines, lines), coveredLines, lines,
+			percent(takenBranches, branches), takenBranches, branches)
+
+		uncovered := []int{}
+		for number, line := range f.lines() {
+			if line.hits == 0 {
+				uncovered = append(uncovered, number)
+			}
+		}
+		sort.Ints(uncovered)
+		if len(uncovered) > 0 {
+			fmt.Fprintf(w, "  lines not covered: %s\n", lineRanges(uncovered))
+		}
+		missed := []string{}
+		for _, b := range f.sortedBranches() {
+			for i, name := range []string{"then", "else"} {
+				if b.taken[i] == 0 {
+					missed = append(missed, fmt.Sprintf("%d:%d %s", b.pos.Line, b.pos.Col, name))
+				}
+			}
+		}
+		if len(missed) > 0 {
+			fmt.Fprintf(w, "  branches not taken: %s\n", strings.Join(missed, ", "))
+		}
+	}
+	fmt.Fprintf(w, "total: %s of lines (%d/%d), %s of branches (%d/%d)\n",
+		percent(allCovered, allLines), allCovered, allLines,
+		percent(allTaken, allBranches), allTaken, allBranches)
+}
+
+// writeLCOV writes the coverage as an LCOV tracefile, as read by genhtml
+// and most coverage services
+func (c *coverage) writeLCOV(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	for _, name := range c.sortedFiles() {
+		f := c.files[name]
+		fmt.Fprintf(w, "TN:\nSF:%s\n", name)
+		branches, takenBranches := 0, 0
+		for block, b := range f.sortedBranches() {
+			for i, taken := range b.taken {
+				branches++
+				if b.hits == 0 {
+					fmt.Fprintf(w, "BRDA:%d,%d,%d,-\n", b.pos.Line, block, i)
+					continue
+				}
+				if taken > 0 {
+					takenBranches++
+				}
+				fmt.Fprintf(w, "BRDA:%d,%d,%d,%d\n", b.pos.Line, block, i, taken)
+			}
+		}
+		fmt.Fprintf(w, "BRF:%d\nBRH:%d\n", branches, takenBranches)
+		lines := f.lines()
+		numbers := []int{}
+		for number := range lines {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		covered := 0
+		for _, number := range numbers {
+			if lines[number].hits > 0 {
+				covered++
+			}
+			fmt.Fprintf(w, "DA:%d,%d\n", number, lines[number].hits)
+		}
+		fmt.Fprintf(w, "LF:%d\nLH:%d\nend_of_record\n", len(numbers), covered)
+	}
+}
+
+// writeHTML writes the source of each file with its lines colored by
+// coverage and the times they were evaluated
+func (c *coverage) writeHTML(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>miniMAL coverage</title>\n")
+	fmt.Fprintf(w, "<style>\npre { margin: 0; }\n.covered { background: #cfc; }\n.partial { background: #ffc; }\n.uncovered { background: #fcc; }\n.hits { color: #888; text-align: right; padding-right: 1em; }\n</style>\n")
+	fmt.Fprintf(w, "</head>\n<body>\n<h1>miniMAL coverage</h1>\n<ul>\n")
+	names := c.sortedFiles()
+	for i, name := range names {
+		coveredLines, lines, takenBranches, branches := c.files[name].summary()
+		fmt.Fprintf(w, "<li><a href=\"#file-%d\">%s</a> %s of lines, %s of branches</li>\n", i,
+			html.EscapeString(name), percent(coveredLines, lines), percent(takenBranches, branches))
+	}
+	fmt.Fprintf(w, "</ul>\n")
+	for i, name := range names {
+		f := c.files[name]
+		lines := f.lines()
+		fmt.Fprintf(w, "<h2 id=\"file-%d\">%s</h2>\n<table>\n", i, html.EscapeString(name))
+		for number, text := range strings.Split(strings.TrimSuffix(f.source, "\n"), "\n") {
+			class, hits := "", ""
+			if line := lines[number+1]; line != nil {
+				hits = fmt.Sprint(line.hits)
+				switch {
+				case line.hits == 0:
+					class = "uncovered"
+				case line.partial:
+					class = "partial"
+				default:
+					class = "covered"
+				}
+			}
+			fmt.Fprintf(w, "<tr class=\"%s\"><td class=\"hits\">%s</td><td><pre>%s</pre></td></tr>\n",
+				class, hits, html.EscapeString(text))
+		}
+		fmt.Fprintf(w, "</table>\n")
+	}
+	fmt.Fprintf(w, "</body>\n</html>\n")
+}
@@ -0,0 +1,59 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const sampleCovered = `["do",
+  ["def", "sign", ["fn", ["x"],
+    ["if", ["<", "x", 0],
+      ["` + "`" + `", "negative"],
+      ["if", ["=", "x", 0], ["` + "`" + `", "zero"], ["` + "`" + `", "positive"]]]]],
+  ["def", "unused", ["fn", [],
+    ["list", 1, 2]]],
+  ["sign", 3],
+  ["sign", 0]]
+`
+
+func TestCoverage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minimal-cover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "sign.json")
+	if err := ioutil.WriteFile(file, []byte(sampleCovered), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &options{backend: "tree", cover: newCoverage()}
+	env := newSymbolTable(opts, []string{})
+	evaluate([]interface{}{Intern("load"), file}, env)
+
+	var lcov, text bytes.Buffer
+	opts.cover.writeLCOV(&lcov)
+	want := "TN:\nSF:" + file + "\n" +
+		"BRDA:3,0,0,0\nBRDA:3,0,1,2\nBRDA:5,1,0,1\nBRDA:5,1,1,1\nBRF:4\nBRH:3\n" +
+		"DA:1,1\nDA:2,1\nDA:3,2\nDA:4,0\nDA:5,2\nDA:6,1\nDA:7,0\nDA:8,1\nDA:9,1\nLF:9\nLH:7\n" +
+		"end_of_record\n"
+	if lcov.String() != want {
+		t.Errorf("LCOV output\n%s\nwant\n%s", lcov.String(), want)
+	}
+
+	opts.cover.writeText(&text)
+	want = file + ": 77.8% of lines (7/9), 75.0% of branches (3/4)\n" +
+		"  lines not covered: 4, 7\n" +
+		"  branches not taken: 3:5 then\n" +
+		"total: 77.8% of lines (7/9), 75.0% of branches (3/4)\n"
+	if text.String() != want {
+		t.Errorf("text output\n%s\nwant\n%s", text.String(), want)
+	}
+}
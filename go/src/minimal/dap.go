@@ -0,0 +1,600 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// dapServer speaks the Debug Adapter Protocol with an editor over a pair
+// of streams. The program it launches is evaluated in its own goroutine
+// with the server as the front end of its debugger: when it stops, the
+// requests inspecting it run in that goroutine, which owns the frames.
+type dapServer struct {
+	opts *options
+	in   *bufio.Reader
+	// mu serializes the messages written to out and guards waiting
+	mu  sync.Mutex
+	out io.Writer
+	seq int
+
+	debugger *debugger
+	env      *Environment
+	program  string
+	entry    bool
+	running  bool
+	// waiting is true while the program is stopped in the debugger,
+	// waiting for work
+	waiting bool
+	work    chan func() bool
+	// resumed lets the program go on once the response to the request
+	// resuming it was sent, so its events come after
+	resumed func()
+	// refs are the values expanded by variables requests since the last
+	// stop, their variablesReference being their index plus one
+	refs []interface{}
+}
+
+// errDisconnected interrupts the program when the editor disconnects
+var errDisconnected = errors.New("debugger disconnected")
+
+func newDAPServer(opts *options, in io.Reader, out io.Writer) *dapServer {
+	s := &dapServer{opts: opts, in: bufio.NewReader(in), out: out, work: make(chan func() bool)}
+	s.debugger = newDebugger(s)
+	return s
+}
+
+// dapRequest is a request of the editor, the only message it sends
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// readFramedMessage reads the body of a message framed by its
+// Content-Length header, as the Debug Adapter and the Language Server
+// Protocols send them
+func readFramedMessage(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && line != "" {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if value := strings.TrimPrefix(line, "Content-Length:"); value != line {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				return nil, fmt.Errorf("invalid Content-Length %q", value)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("message without Content-Length")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func writeFramedMessage(w io.Writer, body []byte) error {
+	_, err := fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+func (s *dapServer) send(message map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	message["seq"] = s.seq
+	body, err := json.Marshal(message)
+	if err != nil {
+		panic(err)
+	}
+	writeFramedMessage(s.out, body)
+}
+
+func (s *dapServer) event(event string, body interface{}) {
+	message := map[string]interface{}{"type": "event", "event": event}
+	if body != nil {
+		message["body"] = body
+	}
+	s.send(message)
+}
+
+func (s *dapServer) respond(request *dapRequest, body interface{}, err error) {
+	message := map[string]interface{}{
+		"type":        "response",
+		"request_seq": request.Seq,
+		"command":     request.Command,
+		"success":     err == nil,
+	}
+	if err != nil {
+		message["message"] = err.Error()
+	}
+	if body != nil {
+		message["body"] = body
+	}
+	s.send(message)
+}
+
+// output sends text written by the program to the category stdout or
+// stderr
+func (s *dapServer) output(category, text string) {
+	s.event("output", map[string]interface{}{"category": category, "output": text})
+}
+
+// dapOutput sends what the program prints to *out* or *err* as output
+// events of category
+type dapOutput struct {
+	s        *dapServer
+	category string
+}
+
+func (o dapOutput) Write(p []byte) (int, error) {
+	o.s.output(o.category, string(p))
+	return len(p), nil
+}
+
+// serve handles the requests until the editor disconnects or closes the
+// input
+func (s *dapServer) serve() error {
+	for {
+		body, err := readFramedMessage(s.in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		request := &dapRequest{}
+		if err := json.Unmarshal(body, request); err != nil {
+			return fmt.Errorf("invalid DAP message: %s", err)
+		}
+		if request.Type != "request" {
+			continue
+		}
+		result, err := s.handle(request)
+		s.respond(request, result, err)
+		if s.resumed != nil {
+			s.resumed()
+			s.resumed = nil
+		}
+		switch request.Command {
+		case "initialize":
+			// breakpoints can be set from now on
+			s.event("initialized", nil)
+		case "disconnect":
+			return nil
+		}
+	}
+}
+
+// arguments decodes the arguments of a request into v
+func arguments(request *dapRequest, v interface{}) error {
+	if len(request.Arguments) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(request.Arguments, v); err != nil {
+		return fmt.Errorf("invalid arguments of %s: %s", request.Command, err)
+	}
+	return nil
+}
+
+func (s *dapServer) handle(request *dapRequest) (interface{}, error) {
+	switch request.Command {
+	case "initialize":
+		return map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsEvaluateForHovers":        true,
+			"supportsTerminateRequest":         true,
+		}, nil
+	case "launch":
+		return nil, s.launch(request)
+	case "setBreakpoints":
+		return s.setBreakpoints(request)
+	case "configurationDone":
+		if s.env == nil {
+			return nil, errors.New("configurationDone before launch")
+		}
+		if !s.running {
+			s.running = true
+			go s.run()
+		}
+		return nil, nil
+	case "threads":
+		return map[string]interface{}{
+			"threads": []interface{}{map[string]interface{}{"id": 1, "name": "main"}},
+		}, nil
+	case "stackTrace":
+		return s.inStop(s.stackTrace)
+	case "scopes":
+		var args struct {
+			FrameID int `json:"frameId"`
+		}
+		if err := arguments(request, &args); err != nil {
+			return nil, err
+		}
+		return s.inStop(func() (interface{}, error) { return s.scopes(args.FrameID) })
+	case "variables":
+		var args struct {
+			VariablesReference int `json:"variablesReference"`
+		}
+		if err := arguments(request, &args); err != nil {
+			return nil, err
+		}
+		return s.inStop(func() (interface{}, error) { return s.variables(args.VariablesReference) })
+	case "evaluate":
+		var args struct {
+			Expression string `json:"expression"`
+			FrameID    int    `json:"frameId"`
+		}
+		if err := arguments(request, &args); err != nil {
+			return nil, err
+		}
+		return s.inStop(func() (interface{}, error) { return s.evaluate(args.Expression, args.FrameID) })
+	case "continue":
+		return map[string]interface{}{"allThreadsContinued": true}, s.resume(stepNone)
+	case "next":
+		return nil, s.resume(stepOver)
+	case "stepIn":
+		return nil, s.resume(stepInto)
+	case "stepOut":
+		return nil, s.resume(stepOut)
+	case "pause":
+		s.debugger.pause()
+		return nil, nil
+	case "terminate", "disconnect":
+		if s.env != nil {
+			s.env.Interrupt(errDisconnected)
+			s.resume(stepNone)
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported request %s", request.Command)
+}
+
+// launch prepares the program to run once the editor is done with the
+// breakpoints
+func (s *dapServer) launch(request *dapRequest) error {
+	var args struct {
+		Program     string   `json:"program"`
+		Args        []string `json:"args"`
+		StopOnEntry bool     `json:"stopOnEntry"`
+		NoDebug     bool     `json:"noDebug"`
+	}
+	if err := arguments(request, &args); err != nil {
+		return err
+	}
+	if args.Program == "" {
+		return errors.New("launch requires a program")
+	}
+	if s.env != nil {
+		return errors.New("the program was already launched")
+	}
+	opts := *s.opts
+	opts.backend = "tree"
+	opts.debug = false
+	s.program = args.Program
+	s.env = newSymbolTable(&opts, args.Args)
+	s.env.SetOutput(dapOutput{s, "stdout"})
+	s.env.SetError(dapOutput{s, "stderr"})
+	// the standard input carries the requests
+	s.env.SetInput(strings.NewReader(""))
+	if !args.NoDebug {
+		s.env.ctx.debugger = s.debugger
+		if args.StopOnEntry {
+			s.entry = true
+			s.debugger.resume(stepInto)
+		}
+	}
+	return nil
+}
+
+// run evaluates the program and reports how it ended
+func (s *dapServer) run() {
+	_, err := evalWithOptions(s.opts, s.env, func() interface{} {
+		return evaluate([]interface{}{Intern("load"), s.program}, s.env)
+	})
+	exitCode := exitOK
+	if err != nil && err != errDisconnected {
+		s.output("stderr", fmt.Sprintf("error: %s\n", err))
+		exitCode = exitError
+	}
+	s.event("exited", map[string]interface{}{"exitCode": exitCode})
+	s.event("terminated", nil)
+}
+
+func (s *dapServer) setBreakpoints(request *dapRequest) (interface{}, error) {
+	var args struct {
+		Source struct {
+			Path string `json:"path"`
+		} `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if err := arguments(request, &args); err != nil {
+		return nil, err
+	}
+	lines, err := formLines(args.Source.Path)
+	breakpoints := []interface{}{}
+	set := []int{}
+	for _, b := range args.Breakpoints {
+		breakpoint := map[string]interface{}{"line": b.Line, "verified": lines[b.Line]}
+		switch {
+		case err != nil:
+			breakpoint["message"] = err.Error()
+		case !lines[b.Line]:
+			breakpoint["message"] = "no form starts on this line"
+		default:
+			set = append(set, b.Line)
+		}
+		breakpoints = append(breakpoints, breakpoint)
+	}
+	s.debugger.setBreakpoints(args.Source.Path, set)
+	return map[string]interface{}{"breakpoints": breakpoints}, nil
+}
+
+// formLines returns the lines of a source file where the debugger can stop,
+// the ones where a list starts
+func formLines(file string) (map[int]bool, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	ast, err := readSourceAll(string(contents), file)
+	if err != nil {
+		return nil, err
+	}
+	lines := map[int]bool{}
+	var walk func(ast interface{})
+	walk = func(ast interface{}) {
+		list, ok := ast.([]interface{})
+		if !ok {
+			return
+		}
+		if pos, ok := PositionOf(list); ok {
+			lines[pos.Line] = true
+		}
+		for _, element := range list {
+			walk(element)
+		}
+	}
+	walk(ast)
+	return lines, nil
+}
+
+// readSourceAll reads source recovering the panics of the reader
+func readSourceAll(source, file string) (ast interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoveredError(r)
+		}
+	}()
+	return readSource(source, file, readCompat), nil
+}
+
+// stopped is called by the goroutine of the program when it stops, and
+// runs the work sent by the requests until one resumes it
+func (s *dapServer) stopped(d *debugger, reason string) {
+	top, _ := d.frame(0)
+	if _, ok := PositionOf(top.ast); s.entry && !ok {
+		// the entry is the first form of the program, not the load of it
+		d.resume(stepInto)
+		return
+	}
+	s.refs = nil
+	body := map[string]interface{}{"reason": reason, "threadId": 1, "allThreadsStopped": true}
+	switch {
+	case s.entry:
+		s.entry = false
+		body["reason"] = "entry"
+	case reason == "break":
+		body["reason"] = "breakpoint"
+		body["description"] = "break form"
+	}
+	s.mu.Lock()
+	s.waiting = true
+	s.mu.Unlock()
+	s.event("stopped", body)
+	for f := range s.work {
+		if f() {
+			return
+		}
+	}
+}
+
+func (s *dapServer) isStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.waiting
+}
+
+// inStop runs f in the goroutine of the stopped program and returns its
+// results
+func (s *dapServer) inStop(f func() (interface{}, error)) (interface{}, error) {
+	if !s.isStopped() {
+		return nil, errors.New("the program is not stopped")
+	}
+	var body interface{}
+	var err error
+	done := make(chan bool)
+	s.work <- func() bool {
+		body, err = f()
+		close(done)
+		return false
+	}
+	<-done
+	return body, err
+}
+
+// resume lets the stopped program go on as step says
+func (s *dapServer) resume(step stepMode) error {
+	s.mu.Lock()
+	waiting := s.waiting
+	s.waiting = false
+	s.mu.Unlock()
+	if !waiting {
+		return errors.New("the program is not stopped")
+	}
+	s.resumed = func() {
+		s.work <- func() bool {
+			s.debugger.resume(step)
+			return true
+		}
+	}
+	return nil
+}
+
+// frameName is the name shown for a frame, the function called by its
+// form
+func frameName(ast interface{}) string {
+	if list, ok := ast.([]interface{}); ok && len(list) > 0 {
+		if symbol, ok := list[0].(*Symbol); ok {
+			return symbol.name
+		}
+	}
+	name := safeJSON(ast)
+	if len(name) > 40 {
+		name = name[:37] + "..."
+	}
+	return name
+}
+
+func (s *dapServer) stackTrace() (interface{}, error) {
+	frames := []interface{}{}
+	for i := range s.debugger.frames {
+		frame, _ := s.debugger.frame(i)
+		f := map[string]interface{}{"id": i, "name": frameName(frame.ast), "line": 0, "column": 0}
+		if pos, ok := PositionOf(frame.ast); ok {
+			path, err := filepath.Abs(pos.File)
+			if err != nil {
+				path = pos.File
+			}
+			f["source"] = map[string]interface{}{"name": filepath.Base(pos.File), "path": path}
+			f["line"], f["column"] = pos.Line, pos.Col
+		}
+		frames = append(frames, f)
+	}
+	return map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}, nil
+}
+
+// reference returns the variablesReference that expands value, 0 when it
+// has nothing to expand
+func (s *dapServer) reference(value interface{}) int {
+	switch value := value.(type) {
+	case []interface{}:
+		if len(value) == 0 {
+			return 0
+		}
+	case map[string]interface{}:
+		if len(value) == 0 {
+			return 0
+		}
+	case []debugVar:
+	default:
+		return 0
+	}
+	s.refs = append(s.refs, value)
+	return len(s.refs)
+}
+
+func (s *dapServer) scopes(frame int) (interface{}, error) {
+	locals, err := s.debugger.locals(frame)
+	if err != nil {
+		return nil, err
+	}
+	scopes := []interface{}{}
+	for i, vars := range locals {
+		name := "Locals"
+		if i > 0 {
+			name = fmt.Sprintf("Enclosing %d", i)
+		}
+		scopes = append(scopes, map[string]interface{}{
+			"name":               name,
+			"variablesReference": s.reference(vars),
+			"expensive":          false,
+		})
+	}
+	return map[string]interface{}{"scopes": scopes}, nil
+}
+
+func (s *dapServer) variable(name string, value interface{}) map[string]interface{} {
+	return map[string]interface{}{"name": name, "value": safeJSON(value), "variablesReference": s.reference(value)}
+}
+
+func (s *dapServer) variables(reference int) (interface{}, error) {
+	if reference <= 0 || reference > len(s.refs) {
+		return nil, fmt.Errorf("unknown variablesReference %d", reference)
+	}
+	variables := []interface{}{}
+	switch value := s.refs[reference-1].(type) {
+	case []debugVar:
+		for _, v := range value {
+			variables = append(variables, s.variable(v.name, v.value))
+		}
+	case []interface{}:
+		for i, element := range value {
+			variables = append(variables, s.variable(strconv.Itoa(i), element))
+		}
+	case map[string]interface{}:
+		keys := []string{}
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			variables = append(variables, s.variable(key, value[key]))
+		}
+	}
+	return map[string]interface{}{"variables": variables}, nil
+}
+
+// evaluate evaluates expression in a frame. An expression that is not JSON,
+// like the word under the mouse for hovers, is the symbol it names.
+func (s *dapServer) evaluate(expression string, frame int) (interface{}, error) {
+	if !json.Valid([]byte(expression)) {
+		expression = strconv.Quote(expression)
+	}
+	result, err := s.debugger.evalIn(frame, expression)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"result": safeJSON(result), "variablesReference": s.reference(result)}, nil
+}
+
+// cmdDAP serves the Debug Adapter Protocol over stdin and stdout
+func cmdDAP(opts *options, args []string) int {
+	flags := flag.NewFlagSet("dap", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if err := newDAPServer(opts, stdin, os.Stdout).serve(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	return exitOK
+}
@@ -0,0 +1,234 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// dapClient is a scripted editor talking to a dapServer
+type dapClient struct {
+	t        *testing.T
+	w        io.Writer
+	seq      int
+	messages chan map[string]interface{}
+}
+
+func newDAPClient(t *testing.T) *dapClient {
+	requests, requestsW := io.Pipe()
+	responses, responsesW := io.Pipe()
+	s := newDAPServer(&options{backend: "tree", mode: readCompat}, requests, responsesW)
+	go func() {
+		if err := s.serve(); err != nil {
+			t.Error(err)
+		}
+		responsesW.Close()
+	}()
+	c := &dapClient{t: t, w: requestsW, messages: make(chan map[string]interface{}, 100)}
+	go func() {
+		r := bufio.NewReader(responses)
+		for {
+			body, err := readFramedMessage(r)
+			if err != nil {
+				close(c.messages)
+				return
+			}
+			message := map[string]interface{}{}
+			json.Unmarshal(body, &message)
+			c.messages <- message
+		}
+	}()
+	return c
+}
+
+func (c *dapClient) send(command string, args interface{}) {
+	c.seq++
+	body, _ := json.Marshal(map[string]interface{}{"seq": c.seq, "type": "request", "command": command, "arguments": args})
+	writeFramedMessage(c.w, body)
+}
+
+// waitFor returns the next event or response named name, skipping other
+// messages
+func (c *dapClient) waitFor(kind, name string) map[string]interface{} {
+	c.t.Helper()
+	for {
+		select {
+		case message, ok := <-c.messages:
+			if !ok {
+				c.t.Fatalf("server closed waiting for %s %s", kind, name)
+			}
+			if message["type"] == kind && (message["event"] == name || message["command"] == name) {
+				return message
+			}
+		case <-time.After(5 * time.Second):
+			c.t.Fatalf("timeout waiting for %s %s", kind, name)
+		}
+	}
+}
+
+// request sends a request and returns the body of its successful response
+func (c *dapClient) request(command string, args interface{}) map[string]interface{} {
+	c.t.Helper()
+	c.send(command, args)
+	response := c.waitFor("response", command)
+	if response["success"] != true {
+		c.t.Fatalf("%s failed: %v", command, response["message"])
+	}
+	body, _ := response["body"].(map[string]interface{})
+	return body
+}
+
+func toJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+const dapProgram = `["do",
+  ["def", "square", ["fn", ["x"],
+    ["let", ["l", ["list", "x", ["list", 2, 3]]],
+      ["*", "x", "x"]]]],
+  ["square", 1],
+  ["square", 4]]
+`
+
+func TestDAP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minimal-dap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	program := filepath.Join(dir, "square.json")
+	if err := ioutil.WriteFile(program, []byte(dapProgram), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newDAPClient(t)
+	c.request("initialize", map[string]interface{}{"adapterID": "minimal"})
+	c.waitFor("event", "initialized")
+	c.request("launch", map[string]interface{}{"program": program})
+	body := c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": program},
+		"breakpoints": []interface{}{map[string]interface{}{"line": 4}, map[string]interface{}{"line": 7}},
+	})
+	if got, want := toJSON(body["breakpoints"]), `[{"line":4,"verified":true},{"line":7,"message":"no form starts on this line","verified":false}]`; got != want {
+		t.Errorf("breakpoints %s, want %s", got, want)
+	}
+	c.request("configurationDone", nil)
+
+	stopped := c.waitFor("event", "stopped")
+	if reason := stopped["body"].(map[string]interface{})["reason"]; reason != "breakpoint" {
+		t.Errorf("stopped for %v, want breakpoint", reason)
+	}
+	body = c.request("stackTrace", map[string]interface{}{"threadId": 1})
+	frames := body["stackFrames"].([]interface{})
+	top := frames[0].(map[string]interface{})
+	if top["name"] != "*" || top["line"] != 4.0 || top["column"] != 7.0 || top["source"].(map[string]interface{})["path"] != program {
+		t.Errorf("top frame %s", toJSON(top))
+	}
+	// square and its let run in the frame of ["square", 1] by tail calls
+	if caller := frames[1].(map[string]interface{}); caller["name"] != "do" || caller["line"] != 1.0 || len(frames) != 3 {
+		t.Errorf("frames %s", toJSON(frames))
+	}
+
+	scopes := c.request("scopes", map[string]interface{}{"frameId": 0})["scopes"].([]interface{})
+	locals := scopes[0].(map[string]interface{})
+	if len(scopes) != 2 || locals["name"] != "Locals" || scopes[1].(map[string]interface{})["name"] != "Enclosing 1" {
+		t.Errorf("scopes %s", toJSON(scopes))
+	}
+	variables := c.request("variables", map[string]interface{}{"variablesReference": scopes[1].(map[string]interface{})["variablesReference"]})
+	if got, want := toJSON(variables["variables"]), `[{"name":"x","value":"1","variablesReference":0}]`; got != want {
+		t.Errorf("parameters %s, want %s", got, want)
+	}
+
+	variables = c.request("variables", map[string]interface{}{"variablesReference": locals["variablesReference"]})
+	l := variables["variables"].([]interface{})[0].(map[string]interface{})
+	if l["name"] != "l" || l["value"] != "[1,[2,3]]" {
+		t.Errorf("let locals %s", toJSON(variables))
+	}
+	variables = c.request("variables", map[string]interface{}{"variablesReference": l["variablesReference"]})
+	if got, want := toJSON(variables["variables"]), `[{"name":"0","value":"1","variablesReference":0},{"name":"1","value":"[2,3]","variablesReference":4}]`; got != want {
+		t.Errorf("elements of l %s, want %s", got, want)
+	}
+
+	for expression, want := range map[string]string{`["+", "x", 10]`: "11", "x": "1", `"l"`: "[1,[2,3]]"} {
+		result := c.request("evaluate", map[string]interface{}{"expression": expression, "frameId": 0})
+		if result["result"] != want {
+			t.Errorf("evaluate %s = %v, want %s", expression, result["result"], want)
+		}
+	}
+	c.send("evaluate", map[string]interface{}{"expression": "y", "frameId": 0})
+	if response := c.waitFor("response", "evaluate"); response["success"] != false || response["message"] != `Symbol "y" undefined` {
+		t.Errorf("evaluate y %s", toJSON(response))
+	}
+
+	c.request("stepOut", map[string]interface{}{"threadId": 1})
+	stopped = c.waitFor("event", "stopped")
+	if reason := stopped["body"].(map[string]interface{})["reason"]; reason != "step" {
+		t.Errorf("stopped for %v, want step", reason)
+	}
+	frames = c.request("stackTrace", map[string]interface{}{"threadId": 1})["stackFrames"].([]interface{})
+	if top := frames[0].(map[string]interface{}); top["name"] != "square" || top["line"] != 6.0 {
+		t.Errorf("frame after stepOut %s", toJSON(top))
+	}
+	c.request("continue", map[string]interface{}{"threadId": 1})
+	stopped = c.waitFor("event", "stopped")
+	if reason := stopped["body"].(map[string]interface{})["reason"]; reason != "breakpoint" {
+		t.Errorf("stopped for %v, want breakpoint", reason)
+	}
+	c.request("continue", map[string]interface{}{"threadId": 1})
+	exited := c.waitFor("event", "exited")
+	if code := exited["body"].(map[string]interface{})["exitCode"]; code != 0.0 {
+		t.Errorf("exit code %v", code)
+	}
+	c.waitFor("event", "terminated")
+	c.request("disconnect", nil)
+}
+
+func TestDAPEntryAndError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minimal-dap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	program := filepath.Join(dir, "fail.json")
+	if err := ioutil.WriteFile(program, []byte(`["do", ["+", 1, 2], ["first", 1]]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newDAPClient(t)
+	c.request("initialize", nil)
+	c.request("launch", map[string]interface{}{"program": program, "stopOnEntry": true})
+	c.request("configurationDone", nil)
+	stopped := c.waitFor("event", "stopped")
+	if reason := stopped["body"].(map[string]interface{})["reason"]; reason != "entry" {
+		t.Errorf("stopped for %v, want entry", reason)
+	}
+	frames := c.request("stackTrace", nil)["stackFrames"].([]interface{})
+	if top := frames[0].(map[string]interface{}); top["name"] != "do" || top["line"] != 1.0 {
+		t.Errorf("entry frame %s", toJSON(top))
+	}
+	c.request("next", nil)
+	c.waitFor("event", "stopped")
+	frames = c.request("stackTrace", nil)["stackFrames"].([]interface{})
+	if top := frames[0].(map[string]interface{}); top["name"] != "first" || top["column"] != 21.0 {
+		t.Errorf("frame after next %s", toJSON(top))
+	}
+	c.request("continue", nil)
+	output := c.waitFor("event", "output")
+	if got, want := toJSON(output["body"]), `{"category":"stderr","output":"error: first argument must be a list\n"}`; got != want {
+		t.Errorf("output %s, want %s", got, want)
+	}
+	if code := c.waitFor("event", "exited")["body"].(map[string]interface{})["exitCode"]; code != 1.0 {
+		t.Errorf("exit code %v", code)
+	}
+	c.request("disconnect", nil)
+}
@@ -0,0 +1,426 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// debugger stops EVAL at breakpoints, break forms and steps, and lets a
+// front end inspect the frames of the stopped evaluation. While it is
+// attached EVAL keeps a frame for each of its calls running, so only the
+// REPL and -debug attach one.
+type debugger struct {
+	sync.Mutex
+	breakpoints []breakpoint
+	// frames are the EVAL calls running, the innermost last
+	frames []debugFrame
+	step   stepMode
+	// depth is the number of frames when the step started
+	depth int
+	// last is the position of the last form evaluated, as a breakpoint
+	// only stops when the evaluation arrives at its line
+	last Position
+	// stopped is true while the front end handles a stop, so evaluating
+	// forms in a frame does not stop again
+	stopped  bool
+	frontend debugFrontend
+	// pausing is set by pause from another goroutine to stop at the next
+	// form
+	pausing int32
+}
+
+// debugFrame is a running EVAL call and the form it evaluates
+type debugFrame struct {
+	ast interface{}
+	env *Environment
+}
+
+type breakpoint struct {
+	file string
+	line int
+}
+
+func (b breakpoint) String() string {
+	return fmt.Sprintf("%s:%d", b.file, b.line)
+}
+
+// stepMode is how the evaluation goes on after a stop
+type stepMode int
+
+const (
+	// stepNone runs until a breakpoint or a break form
+	stepNone stepMode = iota
+	// stepInto stops at the next form
+	stepInto
+	// stepOver stops at the next form not nested in the current one
+	stepOver
+	// stepOut stops at the next form of a caller of the current one
+	stepOut
+)
+
+// debugFrontend handles the stops of a debugger
+type debugFrontend interface {
+	// stopped is called by the goroutine evaluating when it stops for
+	// reason, and returns when the evaluation must go on as set by
+	// resume
+	stopped(d *debugger, reason string)
+}
+
+func newDebugger(frontend debugFrontend) *debugger {
+	return &debugger{frontend: frontend}
+}
+
+func (d *debugger) push() {
+	d.frames = append(d.frames, debugFrame{})
+}
+
+func (d *debugger) pop() {
+	d.frames = d.frames[:len(d.frames)-1]
+}
+
+// eval is called by EVAL before evaluating each form, and stops when it
+// has to
+func (d *debugger) eval(ast interface{}, env *Environment) {
+	if len(d.frames) == 0 {
+		// attached while EVAL was running
+		return
+	}
+	d.frames[len(d.frames)-1] = debugFrame{ast: ast, env: env}
+	list, ok := ast.([]interface{})
+	if !ok || d.stopped {
+		return
+	}
+	switch {
+	case atomic.CompareAndSwapInt32(&d.pausing, 1, 0):
+		d.stop("pause")
+	case d.step == stepInto,
+		d.step == stepOver && len(d.frames) <= d.depth,
+		d.step == stepOut && len(d.frames) < d.depth:
+		d.stop("step")
+	case d.atBreakpoint(list):
+		d.stop("breakpoint")
+	}
+}
+
+// atBreakpoint reports whether the evaluation arrives at the line of a
+// breakpoint with the form list
+func (d *debugger) atBreakpoint(list []interface{}) bool {
+	pos, ok := PositionOf(list)
+	if !ok {
+		return false
+	}
+	last := d.last
+	d.last = pos
+	if last.File == pos.File && last.Line == pos.Line {
+		return false
+	}
+	d.Lock()
+	defer d.Unlock()
+	for _, b := range d.breakpoints {
+		if b.line == pos.Line && sameFile(pos.File, b.file) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameFile reports whether the file read as name is the file of a
+// breakpoint, given as its path or its last elements
+func sameFile(name, file string) bool {
+	if name == file || strings.HasSuffix(name, "/"+file) {
+		return true
+	}
+	a, err := filepath.Abs(name)
+	if err != nil {
+		return false
+	}
+	b, err := filepath.Abs(file)
+	return err == nil && a == b
+}
+
+// stop hands the evaluation to the front end
+func (d *debugger) stop(reason string) {
+	d.step = stepNone
+	d.stopped = true
+	defer func() { d.stopped = false }()
+	d.frontend.stopped(d, reason)
+}
+
+// resume sets how the evaluation goes on after the stop
+func (d *debugger) resume(step stepMode) {
+	d.step = step
+	d.depth = len(d.frames)
+	if len(d.frames) > 0 {
+		d.last, _ = PositionOf(d.frames[len(d.frames)-1].ast)
+	}
+}
+
+// pause stops the running evaluation at its next form
+func (d *debugger) pause() {
+	atomic.StoreInt32(&d.pausing, 1)
+}
+
+// setBreakpoint adds a breakpoint at a line of a file
+func (d *debugger) setBreakpoint(file string, line int) {
+	d.Lock()
+	defer d.Unlock()
+	for _, b := range d.breakpoints {
+		if b.file == file && b.line == line {
+			return
+		}
+	}
+	d.breakpoints = append(d.breakpoints, breakpoint{file: file, line: line})
+}
+
+// clearBreakpoints removes the breakpoints of a file, only the one at
+// line unless it is 0, or all of them when file is ""
+func (d *debugger) clearBreakpoints(file string, line int) {
+	d.Lock()
+	defer d.Unlock()
+	kept := []breakpoint{}
+	for _, b := range d.breakpoints {
+		if file != "" && (b.file != file || (line != 0 && b.line != line)) {
+			kept = append(kept, b)
+		}
+	}
+	d.breakpoints = kept
+}
+
+// setBreakpoints replaces the breakpoints of a file by the ones at lines
+func (d *debugger) setBreakpoints(file string, lines []int) {
+	d.clearBreakpoints(file, 0)
+	for _, line := range lines {
+		d.setBreakpoint(file, line)
+	}
+}
+
+func (d *debugger) listBreakpoints() []breakpoint {
+	d.Lock()
+	defer d.Unlock()
+	return append([]breakpoint{}, d.breakpoints...)
+}
+
+// frame returns the stopped frame i, 0 being the innermost
+func (d *debugger) frame(i int) (debugFrame, error) {
+	if i < 0 || i >= len(d.frames) {
+		return debugFrame{}, fmt.Errorf("no frame %d", i)
+	}
+	return d.frames[len(d.frames)-1-i], nil
+}
+
+// debugVar is a local variable of a frame
+type debugVar struct {
+	name  string
+	value interface{}
+}
+
+// locals returns the variables of each Environment from the one of frame
+// i up to the top level one, which is left out, innermost first
+func (d *debugger) locals(i int) ([][]debugVar, error) {
+	frame, err := d.frame(i)
+	if err != nil {
+		return nil, err
+	}
+	scopes := [][]debugVar{}
+	for env := frame.env; env != nil && env.Parent != nil; env = env.Parent {
+		vars := []debugVar{}
+		for symbol, value := range env.Scope {
+			vars = append(vars, debugVar{name: symbol.name, value: value})
+		}
+		sort.Slice(vars, func(i, j int) bool { return vars[i].name < vars[j].name })
+		scopes = append(scopes, vars)
+	}
+	return scopes, nil
+}
+
+// evalIn evaluates the form src in the Environment of frame i
+func (d *debugger) evalIn(i int, src string) (result interface{}, err error) {
+	frame, err := d.frame(i)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoveredError(r)
+		}
+	}()
+	return evaluate(frame.env.Read(src), frame.env), nil
+}
+
+// describeFrame returns the position and the form of a frame in a line
+func describeFrame(frame debugFrame) string {
+	pos := "-"
+	if p, ok := PositionOf(frame.ast); ok {
+		pos = p.String()
+	}
+	form := safeJSON(frame.ast)
+	if len(form) > traceFormWidth {
+		form = form[:traceFormWidth-3] + "..."
+	}
+	return pos + " " + form
+}
+
+// parseBreakpoint parses a file:line breakpoint
+func parseBreakpoint(s string) (string, int, error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		return "", 0, fmt.Errorf("breakpoints are written file:line (was %q)", s)
+	}
+	line, err := strconv.Atoi(s[i+1:])
+	if err != nil || line <= 0 {
+		return "", 0, fmt.Errorf("invalid line in breakpoint %q", s)
+	}
+	return s[:i], line, nil
+}
+
+// breakpointCommand runs the :break, :clear and :breaks commands shared by
+// the REPL and the debugger prompt, reporting whether line was one
+func breakpointCommand(d *debugger, line string, out io.Writer) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	switch fields[0] {
+	case ":break":
+		if len(fields) != 2 {
+			fmt.Fprintln(out, "usage: :break file:line")
+			return true
+		}
+		file, n, err := parseBreakpoint(fields[1])
+		if err != nil {
+			fmt.Fprintf(out, "error: %s\n", err)
+			return true
+		}
+		d.setBreakpoint(file, n)
+		fmt.Fprintf(out, "breakpoint at %s:%d\n", file, n)
+	case ":clear":
+		file, n := "", 0
+		if len(fields) == 2 {
+			var err error
+			if file, n, err = parseBreakpoint(fields[1]); err != nil {
+				fmt.Fprintf(out, "error: %s\n", err)
+				return true
+			}
+		}
+		d.clearBreakpoints(file, n)
+	case ":breaks":
+		for _, b := range d.listBreakpoints() {
+			fmt.Fprintln(out, b)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// terminalDebugger is the front end of the debugger of the REPL and of
+// -debug, reading commands from in
+type terminalDebugger struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+const debugHelp = `step, s        stop at the next form
+next, n        stop at the next form not nested in this one
+finish, f      stop at the next form of the caller
+continue, c    run until a breakpoint or a break form
+locals, l      show the local variables of the frame
+bt             show the frames, innermost first
+frame N        select frame N for locals and evaluation
+:break file:line, :clear [file:line], :breaks
+               set, remove and list breakpoints
+anything else is a form evaluated in the selected frame
+`
+
+func (t *terminalDebugger) stopped(d *debugger, reason string) {
+	if top, err := d.frame(0); err == nil {
+		fmt.Fprintf(t.out, "stopped at %s (%s)\n", describeFrame(top), reason)
+	} else {
+		// attached by a break form, before EVAL kept any frame
+		fmt.Fprintf(t.out, "stopped (%s)\n", reason)
+	}
+	selected := 0
+	for {
+		fmt.Fprint(t.out, "debug> ")
+		line, err := t.in.ReadString('\n')
+		if err == io.EOF {
+			fmt.Fprintln(t.out)
+			d.resume(stepNone)
+			return
+		}
+		line = strings.TrimSpace(line)
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "step", "s":
+			d.resume(stepInto)
+			return
+		case "next", "n":
+			d.resume(stepOver)
+			return
+		case "finish", "f":
+			d.resume(stepOut)
+			return
+		case "continue", "c":
+			d.resume(stepNone)
+			return
+		case "locals", "l":
+			scopes, err := d.locals(selected)
+			if err != nil {
+				fmt.Fprintf(t.out, "error: %s\n", err)
+				continue
+			}
+			for i, vars := range scopes {
+				for _, v := range vars {
+					fmt.Fprintf(t.out, "%s%s = %s\n", strings.Repeat("  ", i), v.name, safeJSON(v.value))
+				}
+			}
+		case "bt":
+			for i := range d.frames {
+				frame, _ := d.frame(i)
+				mark := " "
+				if i == selected {
+					mark = "*"
+				}
+				fmt.Fprintf(t.out, "%s%d %s\n", mark, i, describeFrame(frame))
+			}
+		case "frame":
+			n := -1
+			if len(fields) == 2 {
+				n, _ = strconv.Atoi(fields[1])
+			}
+			frame, err := d.frame(n)
+			if err != nil {
+				fmt.Fprintln(t.out, "usage: frame N, with N a frame shown by bt")
+				continue
+			}
+			selected = n
+			fmt.Fprintf(t.out, "%d %s\n", n, describeFrame(frame))
+		case "help", "?":
+			fmt.Fprint(t.out, debugHelp)
+		default:
+			if breakpointCommand(d, line, t.out) {
+				continue
+			}
+			result, err := d.evalIn(selected, line)
+			if err != nil {
+				fmt.Fprintf(t.out, "error: %s\n", err)
+				continue
+			}
+			fmt.Fprintln(t.out, safeJSON(result))
+		}
+	}
+}
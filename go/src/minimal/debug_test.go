@@ -0,0 +1,93 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const debugProgram = `["do",
+  ["def", "fact", ["fn", ["n"],
+    ["if", ["<", "n", 2],
+      1,
+      ["*", "n", ["fact", ["-", "n", 1]]]]]],
+  ["let", ["x", 10, "y", ["+", "x", 1]],
+    ["do", ["break"], ["*", "y", 2]]],
+  ["fact", 3]]`
+
+// debugSession evaluates debugProgram with a terminal debugger reading
+// commands and returns what it wrote
+func debugSession(t *testing.T, commands string, breakpoints ...int) string {
+	var out bytes.Buffer
+	env := newSymbolTable(&options{backend: "tree"}, []string{})
+	d := newDebugger(&terminalDebugger{in: bufio.NewReader(strings.NewReader(commands)), out: &out})
+	for _, line := range breakpoints {
+		d.setBreakpoint("fact.json", line)
+	}
+	env.ctx.debugger = d
+	if result := safeJSON(evaluate(readSource(debugProgram, "fact.json", readCompat), env)); result != "6" {
+		t.Errorf("result %s, want 6", result)
+	}
+	return out.String()
+}
+
+func TestDebugger(t *testing.T) {
+	tests := []struct {
+		name        string
+		commands    string
+		breakpoints []int
+		want        []string
+	}{
+		{"break form", "locals\n\"y\"\n[\"+\", \"x\", \"y\"]\nc\n", nil, []string{
+			`stopped at fact.json:7:12 ["break"] (break)`,
+			`debug> x = 10`,
+			`y = 11`,
+			`debug> 11`,
+			`debug> 21`,
+			`debug> `,
+		}},
+		{"breakpoint", "c\nlocals\nc\nbt\nframe 1\nlocals\nc\n", []int{5}, []string{
+			`stopped at fact.json:7:12 ["break"] (break)`,
+			`debug> stopped at fact.json:5:7 ["*","n",["fact",["-","n",1]]] (breakpoint)`,
+			`debug> n = 3`,
+			`debug> stopped at fact.json:5:7 ["*","n",["fact",["-","n",1]]] (breakpoint)`,
+			`debug> *0 fact.json:5:7 ["*","n",["fact",["-","n",1]]]`,
+			` 1 fact.json:5:7 ["*","n",["fact",["-","n",1]]]`,
+			`debug> 1 fact.json:5:7 ["*","n",["fact",["-","n",1]]]`,
+			`debug> n = 3`,
+			`debug> `,
+		}},
+		{"step", "s\ns\nn\nf\n", nil, []string{
+			`stopped at fact.json:7:12 ["break"] (break)`,
+			`debug> stopped at fact.json:7:23 ["*","y",2] (step)`,
+			`debug> stopped at fact.json:8:3 ["fact",3] (step)`,
+			`debug> stopped at fact.json:3:5 ["if",["\u003c","n",2],1,["*","n",["fact",["-","n",1]]]] (step)`,
+			`debug> `,
+		}},
+		{"breakpoint commands", ":break fact.json:3\n:break b.json:2\n:breaks\n:clear fact.json:3\n:breaks\n:clear\n:breaks\nc\n", nil, []string{
+			`stopped at fact.json:7:12 ["break"] (break)`,
+			`debug> breakpoint at fact.json:3`,
+			`debug> breakpoint at b.json:2`,
+			`debug> fact.json:3`,
+			`b.json:2`,
+			`debug> debug> b.json:2`,
+			`debug> debug> debug> `,
+		}},
+		{"end of input", "", nil, []string{
+			`stopped at fact.json:7:12 ["break"] (break)`,
+			`debug> `,
+			``,
+		}},
+	}
+	for _, test := range tests {
+		got := debugSession(t, test.commands, test.breakpoints...)
+		if want := strings.Join(test.want, "\n"); got != want {
+			t.Errorf("%s: debugger output\n%s\nwant\n%s", test.name, got, want)
+		}
+	}
+}
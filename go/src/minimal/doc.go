@@ -0,0 +1,287 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"sort"
+)
+
+// Doc is the documentation attached to a defined symbol
+type Doc struct {
+	Name string
+	Args interface{}
+	Doc  string
+	Pos  Position
+}
+
+// builtinGroup is the group name used for the Go builtins
+const builtinGroup = "builtin"
+
+// builtinDocs documents the functions of BaseSymbolTable. Args must accept
+// the same number of arguments as the args1/args2/args3 wrapper of each
+// builtin, as the static checker relies on them.
+var builtinDocs = map[string]*Doc{
+	"+":        {Args: []interface{}{"a", "b"}, Doc: "Returns the sum of two numbers."},
+	"-":        {Args: []interface{}{"a", "b"}, Doc: "Returns a minus b."},
+	"*":        {Args: []interface{}{"a", "b"}, Doc: "Returns the product of two numbers."},
+	"/":        {Args: []interface{}{"a", "b"}, Doc: "Returns a divided by b, truncated when both are integers."},
+	"<":        {Args: []interface{}{"a", "b"}, Doc: "Returns true if a is less than b."},
+	"<=":       {Args: []interface{}{"a", "b"}, Doc: "Returns true if a is less than or equal to b."},
+	">":        {Args: []interface{}{"a", "b"}, Doc: "Returns true if a is greater than b."},
+	">=":       {Args: []interface{}{"a", "b"}, Doc: "Returns true if a is greater than or equal to b."},
+	"=":        {Args: []interface{}{"a", "b"}, Doc: "Returns true if a and b are equal. Numbers are compared by value, other atoms structurally."},
+	"list":     {Args: []interface{}{"&", "items"}, Doc: "Returns a list with its arguments."},
+	"map":      {Args: []interface{}{"f", "items"}, Doc: "Returns the list of applying f to each item of a list."},
+	"eval":     {Args: []interface{}{"ast"}, Doc: "Evaluates ast in the top level environment."},
+	"read":     {Args: []interface{}{"str"}, Doc: "Parses a JSON encoded string and returns its AST."},
+	"slurp":    {Args: []interface{}{"filename"}, Doc: "Returns the contents of a file as a string."},
+	"load":     {Args: []interface{}{"filename"}, Doc: "Reads and evaluates a source file, returning its last value."},
+	"str":      {Args: []interface{}{"&", "items"}, Doc: "Concatenates its arguments. Strings are used unquoted and lists are flattened."},
+	"pr-str":   {Args: []interface{}{"&", "items"}, Doc: "Returns the JSON encoding of its arguments separated by spaces."},
+	"prn":      {Args: []interface{}{"&", "items"}, Doc: "Prints the JSON encoding of its arguments followed by a newline to *out*."},
+	"println":  {Args: []interface{}{"&", "items"}, Doc: "Prints its arguments as str does followed by a newline to *out*."},
+	"print":    {Args: []interface{}{"&", "items"}, Doc: "Prints its arguments as str does to *out*."},
+	"list?":    {Args: []interface{}{"a"}, Doc: "Returns true if a is a list."},
+	"count":    {Args: []interface{}{"l"}, Doc: "Returns the number of elements of a list."},
+	"empty?":   {Args: []interface{}{"l"}, Doc: "Returns true if the list has no elements."},
+	"string?":  {Args: []interface{}{"a"}, Doc: "Returns true if a is a string."},
+	"symbol":   {Args: []interface{}{"name"}, Doc: "Returns the symbol with the given name."},
+	"symbol?":  {Args: []interface{}{"a"}, Doc: "Returns true if a is a symbol."},
+	"keyword":  {Args: []interface{}{"name"}, Doc: "Returns the keyword with the given name, with or without its leading colon."},
+	"keyword?": {Args: []interface{}{"a"}, Doc: "Returns true if a is a keyword."},
+	"first":    {Args: []interface{}{"l"}, Doc: "Returns the first element of a list or null if it is empty."},
+	"last":     {Args: []interface{}{"l"}, Doc: "Returns the last element of a list or null if it is empty."},
+	"nth":      {Args: []interface{}{"l", "n"}, Doc: "Returns the element at index n of a list or null if it is out of range."},
+	"get":      {Args: []interface{}{"m", "key"}, Doc: "Returns the value of key in a map or null."},
+	"set":      {Args: []interface{}{"m", "key", "value"}, Doc: "Returns a copy of a map with key set to value."},
+
+	"gen-int":     {Args: []interface{}{"&", "bounds"}, Doc: "Returns a generator of integers between -size and size, or between lo and hi when called with them. They shrink towards 0."},
+	"gen-bool":    {Args: []interface{}{}, Doc: "Returns a generator of booleans, shrinking to false."},
+	"gen-string":  {Args: []interface{}{}, Doc: "Returns a generator of printable ASCII strings up to size characters long."},
+	"gen-json":    {Args: []interface{}{}, Doc: "Returns a generator of JSON documents: nulls, booleans, integers, strings and nested lists and maps of them."},
+	"gen-return":  {Args: []interface{}{"value"}, Doc: "Returns a generator that always generates value."},
+	"gen-list":    {Args: []interface{}{"g"}, Doc: "Returns a generator of lists of up to size values of g."},
+	"gen-map":     {Args: []interface{}{"kg", "vg"}, Doc: "Returns a generator of maps with string keys of kg and values of vg."},
+	"gen-fmap":    {Args: []interface{}{"f", "g"}, Doc: "Returns a generator of f applied to the values of g."},
+	"gen-bind":    {Args: []interface{}{"g", "f"}, Doc: "Returns a generator of the values of the generator f returns for each value of g."},
+	"one-of":      {Args: []interface{}{"gens"}, Doc: "Returns a generator of the values of a generator picked at random from a list."},
+	"such-that":   {Args: []interface{}{"pred", "g"}, Doc: "Returns a generator of the values of g satisfying pred. Fails after 100 values that do not."},
+	"for-all":     {Args: []interface{}{"gens", "f"}, Doc: "Returns a property holding when f returns a truthy value for the values of a generator or a list of generators."},
+	"quick-check": {Args: []interface{}{"options", "property"}, Doc: "Checks a property with the number of tests or a map of num-tests, seed and max-size. Returns a map with pass? and the shrunk smallest failing arguments."},
+	"sample":      {Args: []interface{}{"g", "n"}, Doc: "Returns n values of g of growing sizes."},
+
+	"trace":   {Args: []interface{}{"&", "names"}, Doc: "Replaces the named top level functions by functions writing their calls and results to the trace output. Returns the names traced."},
+	"untrace": {Args: []interface{}{"&", "names"}, Doc: "Restores the named traced functions, or all of them without names. Returns the names untraced."},
+	"break":   {Args: []interface{}{}, Doc: "Stops in the debugger of the REPL or of -debug, doing nothing without one. Returns null."},
+
+	"eprintln":     {Args: []interface{}{"&", "items"}, Doc: "Prints its arguments as str does followed by a newline to *err*."},
+	"flush":        {Args: []interface{}{}, Doc: "Writes what *out* and *err* buffer. Returns null."},
+	"read-line":    {Args: []interface{}{}, Doc: "Returns the next line of *in* without its newline, or null at the end of the input."},
+	"with-out-str": {Args: []interface{}{"f"}, Doc: "Calls f without arguments and returns what it prints to *out* as a string."},
+
+	"spit":         {Args: []interface{}{"filename", "content", "&", "options"}, Doc: "Writes a string to a file, replacing it or appending to it with the option append, like {\"append\": true}. Returns null."},
+	"file-exists?": {Args: []interface{}{"filename"}, Doc: "Returns true if a file or directory exists."},
+	"ls":           {Args: []interface{}{"dir"}, Doc: "Returns the sorted names of the entries of a directory."},
+	"glob":         {Args: []interface{}{"pattern"}, Doc: "Returns the sorted paths matching a shell pattern, like *.json."},
+	"mkdir":        {Args: []interface{}{"dir"}, Doc: "Creates a directory and its missing parents, as mkdir -p does. Returns null."},
+	"rm":           {Args: []interface{}{"path", "&", "options"}, Doc: "Removes a file or an empty directory, or a directory and its contents with the option recursive. Returns null."},
+	"mv":           {Args: []interface{}{"from", "to"}, Doc: "Renames a file or directory. Returns null."},
+	"stat":         {Args: []interface{}{"path"}, Doc: "Returns a map with the size in bytes, the mtime in seconds since the epoch, the mode, like -rw-r--r--, and dir? of a file."},
+	"tmpdir":       {Args: []interface{}{}, Doc: "Creates a new temporary directory and returns its path."},
+	"reduce-lines": {Args: []interface{}{"f", "init", "filename"}, Doc: "Reads a file line by line without loading it whole, calling f with the value so far, starting with init, and each line. Returns the last value of f."},
+}
+
+// docString extracts the docstring of a def form, written as a string
+// literal
+func docString(ast interface{}) string {
+	if docstring, ok := stringLiteral(ast); ok {
+		return docstring
+	}
+	panic(fmt.Errorf("def docstring must be a string"))
+}
+
+// setDoc records the documentation of a symbol defined by the def form ast
+func (e *Environment) setDoc(identifier string, docstring string, value interface{}, ast []interface{}) {
+	pos, ok := PositionOf(ast)
+	if !ok && docstring == "" {
+		return
+	}
+	doc := &Doc{Name: identifier, Doc: docstring, Pos: pos}
+	switch f := value.(type) {
+	case tcoFN:
+		doc.Args = f.argSpecAST
+	case *closure:
+		doc.Args = f.fn.argSpec
+	case *compiledFn:
+		doc.Args = f.fn.argSpec
+	case *vmClosure:
+		doc.Args = f.proto.argSpec
+	}
+	if e.Docs == nil {
+		e.Docs = map[string]*Doc{}
+	}
+	e.Docs[identifier] = doc
+}
+
+// docGroup is the set of entries defined in a single source file
+type docGroup struct {
+	Source  string
+	Entries []*Doc
+}
+
+// collectDocs returns the documented symbols of env grouped by source file,
+// builtins first and then files in alphabetical order
+func collectDocs(env *Environment) []docGroup {
+	groups := map[string][]*Doc{}
+	for symbol := range env.Scope {
+		name := symbol.name
+		if doc, ok := env.Docs[name]; ok {
+			source := doc.Pos.File
+			if source == "" {
+				source = "(unknown)"
+			}
+			groups[source] = append(groups[source], doc)
+			continue
+		}
+		if doc, ok := builtinDocs[name]; ok {
+			entry := *doc
+			entry.Name = name
+			groups[builtinGroup] = append(groups[builtinGroup], &entry)
+		}
+	}
+
+	sources := []string{}
+	for source, entries := range groups {
+		sort.Slice(entries, func(i, j int) bool {
+			if entries[i].Pos.Line != entries[j].Pos.Line {
+				return entries[i].Pos.Line < entries[j].Pos.Line
+			}
+			return entries[i].Name < entries[j].Name
+		})
+		if source != builtinGroup {
+			sources = append(sources, source)
+		}
+	}
+	sort.Strings(sources)
+	if _, ok := groups[builtinGroup]; ok {
+		sources = append([]string{builtinGroup}, sources...)
+	}
+
+	result := make([]docGroup, len(sources))
+	for i, source := range sources {
+		result[i] = docGroup{Source: source, Entries: groups[source]}
+	}
+	return result
+}
+
+func docArgs(doc *Doc) string {
+	if doc.Args == nil {
+		return ""
+	}
+	return JSON(doc.Args)
+}
+
+func docLink(doc *Doc) string {
+	return fmt.Sprintf("%s#L%d", doc.Pos.File, doc.Pos.Line)
+}
+
+func writeMarkdownDocs(w io.Writer, groups []docGroup) {
+	fmt.Fprintf(w, "# miniMAL reference\n")
+	for _, group := range groups {
+		fmt.Fprintf(w, "\n## %s\n", group.Source)
+		for _, doc := range group.Entries {
+			fmt.Fprintf(w, "\n### `%s`\n\n", doc.Name)
+			if args := docArgs(doc); args != "" {
+				fmt.Fprintf(w, "`%s`\n\n", args)
+			}
+			if doc.Doc != "" {
+				fmt.Fprintf(w, "%s\n\n", doc.Doc)
+			}
+			if doc.Pos.File != "" {
+				fmt.Fprintf(w, "[%s:%d](%s)\n", doc.Pos.File, doc.Pos.Line, docLink(doc))
+			}
+		}
+	}
+}
+
+func writeHTMLDocs(w io.Writer, groups []docGroup) {
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>miniMAL reference</title>\n</head>\n<body>\n")
+	fmt.Fprintf(w, "<h1>miniMAL reference</h1>\n<ul>\n")
+	for i, group := range groups {
+		fmt.Fprintf(w, "<li><a href=\"#group-%d\">%s</a></li>\n", i, html.EscapeString(group.Source))
+	}
+	fmt.Fprintf(w, "</ul>\n")
+	for i, group := range groups {
+		fmt.Fprintf(w, "<h2 id=\"group-%d\">%s</h2>\n", i, html.EscapeString(group.Source))
+		for _, doc := range group.Entries {
+			fmt.Fprintf(w, "<h3><code>%s</code></h3>\n", html.EscapeString(doc.Name))
+			if args := docArgs(doc); args != "" {
+				fmt.Fprintf(w, "<pre>%s</pre>\n", html.EscapeString(args))
+			}
+			if doc.Doc != "" {
+				fmt.Fprintf(w, "<p>%s</p>\n", html.EscapeString(doc.Doc))
+			}
+			if doc.Pos.File != "" {
+				fmt.Fprintf(w, "<p><a href=\"%s\">%s:%d</a></p>\n",
+					html.EscapeString(docLink(doc)), html.EscapeString(doc.Pos.File), doc.Pos.Line)
+			}
+		}
+	}
+	fmt.Fprintf(w, "</body>\n</html>\n")
+}
+
+// cmdDoc implements the doc command: it loads core.json and the given files
+// and writes a reference of every documented symbol
+func cmdDoc(opts *options, args []string) int {
+	flags := flag.NewFlagSet("doc", flag.ContinueOnError)
+	format := flags.String("format", "markdown", "output format: markdown or html")
+	output := flags.String("o", "", "output file (default stdout)")
+	core := flags.String("core", "core.json", "core library loaded before the files")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	var write func(io.Writer, []docGroup)
+	switch *format {
+	case "markdown", "md":
+		write = writeMarkdownDocs
+	case "html":
+		write = writeHTMLDocs
+	default:
+		fmt.Fprintf(os.Stderr, "unknown doc format %q\n", *format)
+		return exitUsage
+	}
+
+	symbolTable := newSymbolTable(opts, []string{})
+	files := flags.Args()
+	if *core != "" {
+		files = append([]string{*core}, files...)
+	}
+	for _, file := range files {
+		_, err := evalWithOptions(opts, symbolTable, func() interface{} {
+			return evaluate([]interface{}{Intern("load"), file}, symbolTable)
+		})
+		if err != nil {
+			return exitStatus(err)
+		}
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return exitStatus(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	write(w, collectDocs(symbolTable))
+	return exitOK
+}
@@ -0,0 +1,66 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const docLibrary = `["do",
+  ["def", "inc", ["` + "`" + `", "Returns <n> plus one."], ["fn", ["n"], ["+", "n", 1]]],
+  ["def", "undocumented", 1],
+  ["def", "pi", ["` + "`" + `", "Close enough."], 3]]
+`
+
+func TestDocs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minimal-doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "lib.json")
+	if err := ioutil.WriteFile(file, []byte(docLibrary), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := newSymbolTable(&options{backend: "tree"}, []string{})
+	evaluate([]interface{}{Intern("load"), file}, env)
+
+	groups := collectDocs(env)
+	if len(groups) != 2 || groups[0].Source != builtinGroup || groups[1].Source != file {
+		t.Fatalf("groups %v", groups)
+	}
+	var markdown bytes.Buffer
+	writeMarkdownDocs(&markdown, groups[1:])
+	want := "# miniMAL reference\n\n## " + file + "\n" +
+		"\n### `inc`\n\n`[\"n\"]`\n\nReturns <n> plus one.\n\n[" + file + ":2](" + file + "#L2)\n" +
+		"\n### `undocumented`\n\n[" + file + ":3](" + file + "#L3)\n" +
+		"\n### `pi`\n\nClose enough.\n\n[" + file + ":4](" + file + "#L4)\n"
+	if markdown.String() != want {
+		t.Errorf("markdown\n%s\nwant\n%s", markdown.String(), want)
+	}
+	var html bytes.Buffer
+	writeHTMLDocs(&html, groups[1:])
+	if !strings.Contains(html.String(), "<p>Returns &lt;n&gt; plus one.</p>") {
+		t.Errorf("html does not escape the docstrings\n%s", html.String())
+	}
+}
+
+func TestBuiltinDocs(t *testing.T) {
+	for symbol := range BaseSymbolTable().Scope {
+		if _, ok := builtinDocs[symbol.name]; !ok {
+			t.Errorf("builtin %s has no documentation", symbol.name)
+		}
+	}
+	for name := range builtinDocs {
+		if _, ok := BaseSymbolTable().Scope[Intern(name)]; !ok {
+			t.Errorf("documented builtin %s does not exist", name)
+		}
+	}
+}
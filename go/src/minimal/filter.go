@@ -0,0 +1,101 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// filterOptions are the flags of the JSON filter mode
+type filterOptions struct {
+	form  string
+	raw   bool
+	slurp bool
+}
+
+// cmdFilter evaluates form once per JSON value read from the files (or
+// stdin), binding the value to "." and "it", and writes each result as JSON
+func cmdFilter(opts *options, filter *filterOptions, files []string) int {
+	symbolTable := newSymbolTable(opts, []string{})
+	ast, err := evalWithOptions(opts, symbolTable, func() interface{} {
+		return symbolTable.Read(filter.form)
+	})
+	if err != nil {
+		return exitStatus(err)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	// what the form prints goes between the results written before and
+	// after it
+	symbolTable.SetOutput(out)
+
+	apply := func(input interface{}) int {
+		env := NewSymbolTable(symbolTable)
+		env.Set(".", input)
+		env.Set("it", input)
+		// the result is printed inside the recover, as values like
+		// functions cannot be written as JSON
+		printed, err := evalWithOptions(opts, env, func() interface{} {
+			result := evaluate(ast, env)
+			if s, ok := result.(string); ok && filter.raw {
+				return s
+			}
+			return JSON(result)
+		})
+		if err != nil {
+			out.Flush()
+			return exitStatus(err)
+		}
+		fmt.Fprintln(out, printed)
+		return exitOK
+	}
+
+	inputs := []io.Reader{os.Stdin}
+	if len(files) > 0 {
+		inputs = inputs[:0]
+		for _, file := range files {
+			f, err := os.Open(file)
+			if err != nil {
+				return exitStatus(err)
+			}
+			defer f.Close()
+			inputs = append(inputs, f)
+		}
+	}
+
+	slurped := []interface{}{}
+	for _, input := range inputs {
+		dec := json.NewDecoder(input)
+		dec.UseNumber()
+		for {
+			var value interface{}
+			err := dec.Decode(&value)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				out.Flush()
+				return exitStatus(fmt.Errorf("invalid JSON input: %s", err))
+			}
+			value = nativeNumbers(value)
+			if filter.slurp {
+				slurped = append(slurped, value)
+				continue
+			}
+			if status := apply(value); status != exitOK {
+				return status
+			}
+		}
+	}
+	if filter.slurp {
+		return apply(slurped)
+	}
+	return exitOK
+}
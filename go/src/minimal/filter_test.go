@@ -0,0 +1,59 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minimal-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte(`{"n": 1} {"n": 2}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "b.json"), []byte("[3]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		args           []string
+		stdin          string
+		stdout, stderr string
+		status         int
+	}{
+		{[]string{"-f", `["get", ".", ["` + "`" + `", "n"]]`}, `{"n": 1}` + "\n" + `{"n": 2.5}`, "1\n2.5\n", "", exitOK},
+		{[]string{"-f", `["+", "it", 1]`}, "1 2\n3", "2\n3\n4\n", "", exitOK},
+		{[]string{"-f", `"."`}, "", "", "", exitOK},
+		{[]string{"-f", `["str", ".", ["` + "`" + `", "!"]]`}, `"a" "b"`, "\"a!\"\n\"b!\"\n", "", exitOK},
+		{[]string{"-raw", "-f", `["str", ".", ["` + "`" + `", "!"]]`}, `"a" "b" 1`, "a!\nb!\n1!\n", "", exitOK},
+		{[]string{"-raw", "-f", `"."`}, `[1] "x"`, "[1]\nx\n", "", exitOK},
+		{[]string{"-slurp", "-f", `["count", "."]`}, "1 2 3", "3\n", "", exitOK},
+		{[]string{"-slurp", "-f", `"."`}, "", "[]\n", "", exitOK},
+		{[]string{"-f", `["do", ["println", "."], "."]`}, "1 2", "1\n1\n2\n2\n", "", exitOK},
+		{[]string{"-f", `["count", "."]`}, "[1] 2 [3]", "1\n", "error: Not a list\n", exitError},
+		{[]string{"-f", `["if", ["=", ".", 2], "+", "."]`}, "1 2 3", "1\n", "error: json: unsupported type: func([]interface {}) interface {}\n", exitError},
+		{[]string{"-f", `"."`}, "1 {", "1\n", "error: invalid JSON input: unexpected EOF\n", exitError},
+		{[]string{"-f", `"."`}, "1 ]", "1\n", "error: invalid JSON input: invalid character ']' looking for beginning of value\n", exitError},
+		{[]string{"-f", `["+", 1`}, "1", "", "error: unexpected EOF\n", exitError},
+		{[]string{"-f", `["get", ".", ["` + "`" + `", "n"]]`, "a.json", "b.json"}, "", "1\n2\n", "error: get requires a map\n", exitError},
+		{[]string{"-slurp", "-f", `"."`, "a.json", "b.json"}, "ignored", "[{\"n\":1},{\"n\":2},[3]]\n", "", exitOK},
+		{[]string{"-f", `"."`, "missing.json"}, "", "", "error: open missing.json: no such file or directory\n", exitError},
+		{[]string{"-timeout", "50ms", "-f", `["do", ["def", "f", ["fn", [], ["f"]]], ["f"]]`}, "1", "", "error: evaluation timed out\n", exitTimeout},
+	} {
+		stdout, stderr, status := runMinimal(t, dir, test.stdin, test.args...)
+		if stdout != test.stdout || stderr != test.stderr || status != test.status {
+			t.Errorf("minimal %s < %q: status %d, stdout %q, stderr %q\nwant status %d, stdout %q, stderr %q",
+				strings.Join(test.args, " "), test.stdin, status, stdout, stderr, test.status, test.stdout, test.stderr)
+		}
+	}
+}
@@ -0,0 +1,435 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"runtime/metrics"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fnProfiler attributes the time and the allocations of an evaluation to
+// the miniMAL functions running, named by the def that defined them. EVAL
+// reports every call and return, so the call counts and times are exact,
+// and a sampler reads the bytes allocated every allocSamplePeriod and
+// charges them to the function running then.
+//
+// A tail call replaces the frame of its caller, as it does in EVAL, and
+// the time outside any function is charged to "(top level)".
+type fnProfiler struct {
+	sync.Mutex
+	start time.Time
+	root  *stackNode
+	stack []profileFrame
+	// fns are the profiled functions by the address of their fn form
+	fns   map[*interface{}]*profiledFn
+	alloc []metrics.Sample
+	last  uint64
+	done  chan struct{}
+}
+
+// allocSamplePeriod is how often the profiler reads the allocated bytes
+const allocSamplePeriod = time.Millisecond
+
+type profiledFn struct {
+	id   uint64
+	name string
+	pos  Position
+	// named is true once a def has named the function
+	named bool
+}
+
+// stackNode is a call stack, keyed by the functions on it, with the
+// values of the calls that returned with it as their stack
+type stackNode struct {
+	fn       *profiledFn
+	parent   *stackNode
+	children map[*profiledFn]*stackNode
+	calls    int64
+	self     time.Duration
+	allocs   int64
+}
+
+type profileFrame struct {
+	node  *stackNode
+	start time.Time
+	// children is the time spent in the calls made by this one
+	children time.Duration
+}
+
+func newFnProfiler() *fnProfiler {
+	p := &fnProfiler{
+		start: time.Now(),
+		fns:   map[*interface{}]*profiledFn{},
+		alloc: []metrics.Sample{{Name: "/gc/heap/allocs:bytes"}},
+		done:  make(chan struct{}),
+	}
+	top := &profiledFn{id: 1, name: "(top level)"}
+	p.root = &stackNode{fn: top, children: map[*profiledFn]*stackNode{}}
+	p.stack = []profileFrame{{node: p.root, start: p.start}}
+	metrics.Read(p.alloc)
+	p.last = p.alloc[0].Value.Uint64()
+	go p.sample()
+	return p
+}
+
+// sample charges the allocated bytes to the running function until stop
+func (p *fnProfiler) sample() {
+	ticker := time.NewTicker(allocSamplePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.Lock()
+			p.sampleAllocs()
+			p.Unlock()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *fnProfiler) sampleAllocs() {
+	metrics.Read(p.alloc)
+	allocated := p.alloc[0].Value.Uint64()
+	p.stack[len(p.stack)-1].node.allocs += int64(allocated - p.last)
+	p.last = allocated
+}
+
+// stop ends the profile, charging the time since the start outside any
+// function to the top level
+func (p *fnProfiler) stop() {
+	// the sampler returns once it receives this
+	p.done <- struct{}{}
+	p.Lock()
+	defer p.Unlock()
+	p.sampleAllocs()
+	top := p.stack[0]
+	p.root.calls = 1
+	p.root.self = time.Since(top.start) - top.children
+}
+
+// function returns the profiled function of the fn form ast
+func (p *fnProfiler) function(ast []interface{}) *profiledFn {
+	fn := p.fns[&ast[0]]
+	if fn == nil {
+		pos, _ := PositionOf(ast)
+		fn = &profiledFn{id: uint64(len(p.fns) + 2), name: "fn", pos: pos}
+		if pos.File != "" {
+			fn.name = fmt.Sprintf("fn@%s:%d:%d", pos.File, pos.Line, pos.Col)
+		}
+		p.fns[&ast[0]] = fn
+	}
+	return fn
+}
+
+// name names the fn form ast after the symbol a def binds it to. The
+// first def of a function names it.
+func (p *fnProfiler) name(ast []interface{}, name string) {
+	p.Lock()
+	defer p.Unlock()
+	fn := p.function(ast)
+	if !fn.named {
+		fn.name = name
+		fn.named = true
+	}
+}
+
+// nameProfiled names the function value after identifier when profiling
+func (e *Environment) nameProfiled(identifier *Symbol, value interface{}) {
+	if f, ok := value.(tcoFN); ok && e.ctx.profile != nil {
+		e.ctx.profile.name(f.ast, identifier.name)
+	}
+}
+
+// enter pushes a call of the function with the fn form ast
+func (p *fnProfiler) enter(ast []interface{}) {
+	p.Lock()
+	defer p.Unlock()
+	fn := p.function(ast)
+	parent := p.stack[len(p.stack)-1].node
+	node := parent.children[fn]
+	if node == nil {
+		node = &stackNode{fn: fn, parent: parent, children: map[*profiledFn]*stackNode{}}
+		parent.children[fn] = node
+	}
+	p.stack = append(p.stack, profileFrame{node: node, start: time.Now()})
+}
+
+// exit pops the running call
+func (p *fnProfiler) exit() {
+	p.Lock()
+	defer p.Unlock()
+	frame := p.stack[len(p.stack)-1]
+	p.stack = p.stack[:len(p.stack)-1]
+	total := time.Since(frame.start)
+	frame.node.calls++
+	frame.node.self += total - frame.children
+	p.stack[len(p.stack)-1].children += total
+}
+
+// call evaluates body, the body of the fn form ast bound in env, as a
+// call of that function
+func (p *fnProfiler) call(ast []interface{}, body interface{}, env *Environment) interface{} {
+	p.enter(ast)
+	defer p.exit()
+	return evalTCO(body, env, inFrame)
+}
+
+// tailCall replaces the running call by a call of the fn form ast
+func (p *fnProfiler) tailCall(ast []interface{}) {
+	p.exit()
+	p.enter(ast)
+}
+
+// walk calls f with every stack node below node and the functions on it
+func (n *stackNode) walk(path []*profiledFn, f func(node *stackNode, path []*profiledFn)) {
+	path = append(path, n.fn)
+	f(n, path)
+	for _, child := range n.children {
+		child.walk(path, f)
+	}
+}
+
+// fnStats are the totals of a function in the profile table
+type fnStats struct {
+	fn                   *profiledFn
+	calls                int64
+	self, cumulative     time.Duration
+	selfAllocs, cumAlloc int64
+}
+
+// stats returns the totals of every function, by self time. Recursive
+// calls count once in the cumulative values.
+func (p *fnProfiler) stats() []*fnStats {
+	byFn := map[*profiledFn]*fnStats{}
+	p.root.walk(nil, func(node *stackNode, path []*profiledFn) {
+		s := byFn[node.fn]
+		if s == nil {
+			s = &fnStats{fn: node.fn}
+			byFn[node.fn] = s
+		}
+		s.calls += node.calls
+		s.self += node.self
+		s.selfAllocs += node.allocs
+		seen := map[*profiledFn]bool{}
+		for _, fn := range path {
+			if seen[fn] {
+				continue
+			}
+			seen[fn] = true
+			if byFn[fn] == nil {
+				byFn[fn] = &fnStats{fn: fn}
+			}
+			byFn[fn].cumulative += node.self
+			byFn[fn].cumAlloc += node.allocs
+		}
+	})
+	stats := []*fnStats{}
+	for _, s := range byFn {
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].self != stats[j].self {
+			return stats[i].self > stats[j].self
+		}
+		return stats[i].fn.name < stats[j].fn.name
+	})
+	return stats
+}
+
+// fnProfileFormats are the writers of the -fnprofileformat flag
+var fnProfileFormats = map[string]func(p *fnProfiler, w io.Writer) error{
+	"table": (*fnProfiler).writeTable,
+	"pprof": (*fnProfiler).writePprof,
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fkB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%dB", n)
+	}
+}
+
+// writeTable writes the totals of every function, by self time
+func (p *fnProfiler) writeTable(w io.Writer) error {
+	p.Lock()
+	defer p.Unlock()
+	stats := p.stats()
+	var total time.Duration
+	for _, s := range stats {
+		total += s.self
+	}
+	fmt.Fprintf(w, "%10s %12s %6s %12s %10s %10s  %s\n",
+		"calls", "self", "self%", "cumulative", "alloc", "cum alloc", "function")
+	for _, s := range stats {
+		share := 0.0
+		if total > 0 {
+			share = 100 * float64(s.self) / float64(total)
+		}
+		name := s.fn.name
+		if s.fn.named && s.fn.pos.File != "" {
+			name += " " + s.fn.pos.String()
+		}
+		fmt.Fprintf(w, "%10d %12s %5.1f%% %12s %10s %10s  %s\n",
+			s.calls, s.self.Round(time.Microsecond), share, s.cumulative.Round(time.Microsecond),
+			formatBytes(s.selfAllocs), formatBytes(s.cumAlloc), name)
+	}
+	return nil
+}
+
+// protoBuffer encodes the protocol buffer messages of a pprof profile
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.WriteByte(byte(x) | 0x80)
+		x >>= 7
+	}
+	b.WriteByte(byte(x))
+}
+
+func (b *protoBuffer) uint64Field(tag int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.varint(uint64(tag)<<3 | 0)
+	b.varint(x)
+}
+
+func (b *protoBuffer) int64Field(tag int, x int64) {
+	b.uint64Field(tag, uint64(x))
+}
+
+func (b *protoBuffer) bytesField(tag int, data []byte) {
+	b.varint(uint64(tag)<<3 | 2)
+	b.varint(uint64(len(data)))
+	b.Write(data)
+}
+
+// packedField writes a repeated integer field in packed encoding
+func (b *protoBuffer) packedField(tag int, xs []uint64) {
+	var packed protoBuffer
+	for _, x := range xs {
+		packed.varint(x)
+	}
+	b.bytesField(tag, packed.Bytes())
+}
+
+// message writes the message encoded by f as the field tag
+func (b *protoBuffer) message(tag int, f func(m *protoBuffer)) {
+	var m protoBuffer
+	f(&m)
+	b.bytesField(tag, m.Bytes())
+}
+
+// writePprof writes the profile in the gzipped profile.proto format read
+// by go tool pprof, with a frame for each miniMAL function on the stack
+// and the sample types calls, wall time and allocated bytes
+func (p *fnProfiler) writePprof(w io.Writer) error {
+	p.Lock()
+	defer p.Unlock()
+	indices := map[string]int64{"": 0}
+	table := []string{""}
+	str := func(s string) int64 {
+		if i, ok := indices[s]; ok {
+			return i
+		}
+		indices[s] = int64(len(table))
+		table = append(table, s)
+		return indices[s]
+	}
+
+	// profile.proto field numbers
+	const (
+		profileSampleType        = 1
+		profileSample            = 2
+		profileLocation          = 4
+		profileFunction          = 5
+		profileStringTable       = 6
+		profileTimeNanos         = 9
+		profileDurationNanos     = 10
+		profilePeriodType        = 11
+		profilePeriod            = 12
+		profileDefaultSampleType = 14
+	)
+	var b protoBuffer
+	valueType := func(tag int, typ, unit string) {
+		b.message(tag, func(m *protoBuffer) {
+			m.int64Field(1, str(typ))
+			m.int64Field(2, str(unit))
+		})
+	}
+	valueType(profileSampleType, "calls", "count")
+	valueType(profileSampleType, "wall", "nanoseconds")
+	valueType(profileSampleType, "alloc_space", "bytes")
+
+	fns := map[uint64]*profiledFn{}
+	p.root.walk(nil, func(node *stackNode, path []*profiledFn) {
+		fns[node.fn.id] = node.fn
+		if node.calls == 0 && node.self == 0 && node.allocs == 0 {
+			return
+		}
+		locations := make([]uint64, len(path))
+		for i, fn := range path {
+			locations[len(path)-1-i] = fn.id
+		}
+		b.message(profileSample, func(m *protoBuffer) {
+			m.packedField(1, locations)
+			m.packedField(2, []uint64{uint64(node.calls), uint64(node.self), uint64(node.allocs)})
+		})
+	})
+
+	ids := []uint64{}
+	for id := range fns {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		fn := fns[id]
+		// every function has a single location, where it starts
+		b.message(profileLocation, func(m *protoBuffer) {
+			m.uint64Field(1, id)
+			m.message(4, func(line *protoBuffer) {
+				line.uint64Field(1, id)
+				line.int64Field(2, int64(fn.pos.Line))
+			})
+		})
+		b.message(profileFunction, func(m *protoBuffer) {
+			m.uint64Field(1, id)
+			m.int64Field(2, str(fn.name))
+			m.int64Field(3, str(fn.name))
+			m.int64Field(4, str(fn.pos.File))
+			m.int64Field(5, int64(fn.pos.Line))
+		})
+	}
+
+	b.int64Field(profileTimeNanos, p.start.UnixNano())
+	b.int64Field(profileDurationNanos, int64(p.root.self+p.stack[0].children))
+	valueType(profilePeriodType, "wall", "nanoseconds")
+	b.int64Field(profilePeriod, 1)
+	b.int64Field(profileDefaultSampleType, str("wall"))
+	// the string table goes last, once every string has been added
+	for _, s := range table {
+		b.bytesField(profileStringTable, []byte(s))
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(b.Bytes()); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,74 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+)
+
+const sampleProfiled = `["do",
+  ["def", "fib", ["fn", ["n"],
+    ["if", ["<", "n", 2], "n", ["+", ["fib", ["-", "n", 1]], ["fib", ["-", "n", 2]]]]]],
+  ["def", "loop", ["fn", ["i"], ["if", ["=", "i", 0], 0, ["loop", ["-", "i", 1]]]]],
+  ["def", "twice", ["fn", ["a", "b"], ["map", ["fn", ["x"], ["fib", "x"]], ["list", "a", "b"]]]],
+  ["fib", 10],
+  ["loop", 100],
+  ["twice", 1, 2]]`
+
+func TestFnProfiler(t *testing.T) {
+	opts := &options{backend: "tree", fnProfiler: newFnProfiler()}
+	env := newSymbolTable(opts, []string{})
+	evaluate(readSource(sampleProfiled, "profiled.json", readCompat), env)
+	p := opts.fnProfiler
+	p.stop()
+
+	calls := map[string]int64{}
+	for _, s := range p.stats() {
+		calls[s.fn.name] = s.calls
+	}
+	want := map[string]int64{
+		"(top level)":           1,
+		"fib":                   177 + 1 + 3,
+		"loop":                  101,
+		"twice":                 1,
+		"fn@profiled.json:5:47": 2,
+	}
+	for name, n := range want {
+		if calls[name] != n {
+			t.Errorf("%s: %d calls, want %d", name, calls[name], n)
+		}
+	}
+	if len(calls) != len(want) {
+		t.Errorf("profiled functions %v, want %v", calls, want)
+	}
+
+	// tail calls replace their caller, so loop never calls loop
+	for fn, node := range p.root.children {
+		if fn.name == "loop" && len(node.children) != 0 {
+			t.Errorf("loop has callees on its stack: %v", node.children)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := p.writePprof(&b); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"fib", "loop", "profiled.json", "alloc_space", "nanoseconds"} {
+		if !bytes.Contains(profile, []byte(s)) {
+			t.Errorf("pprof profile without %q", s)
+		}
+	}
+}
@@ -0,0 +1,600 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// formatWidth is the line length the formatter tries not to exceed
+const formatWidth = 72
+
+// fmtNode is a form as written in a source file, keeping the comments
+// around it so it can be printed back
+type fmtNode struct {
+	// open is '[' or '{' for lists and maps and 0 for atoms
+	open byte
+	// text is the JSON text of an atom, or the key of a map entry
+	text     string
+	key      string
+	children []*fmtNode
+	// comments are the full line comments written before the node, with
+	// an empty string for each blank line among them
+	comments []string
+	// trailing is a comment written after the node on the same line
+	trailing string
+	// endComments are the comments before the closing bracket
+	endComments []string
+}
+
+// specialForms lists how many arguments of each special form stay on the
+// line of the form head. The rest of the arguments are its body.
+var specialForms = map[string]int{
+	"def": 1,
+	"fn":  1,
+	"let": 1,
+	"if":  1,
+	"do":  0,
+	"try": 0,
+}
+
+// fmtParser reads source text into fmtNodes
+type fmtParser struct {
+	src string
+	pos int
+}
+
+func (p *fmtParser) errorf(format string, args ...interface{}) {
+	line := strings.Count(p.src[:p.pos], "\n") + 1
+	panic(fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...)))
+}
+
+// space skips whitespace and comments, returning the comments found. Blank
+// lines are returned as empty comments.
+func (p *fmtParser) space() (comments []string) {
+	newlines := 0
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; c {
+		case '\n':
+			newlines++
+			if newlines == 2 {
+				comments = append(comments, "")
+			}
+			p.pos++
+		case ' ', '\t', '\r':
+			p.pos++
+		case ';':
+			end := strings.IndexByte(p.src[p.pos:], '\n')
+			if end < 0 {
+				end = len(p.src) - p.pos
+			}
+			comments = append(comments, strings.TrimRight(p.src[p.pos:p.pos+end], " \t\r"))
+			p.pos += end
+			newlines = 0
+		default:
+			return comments
+		}
+	}
+	return comments
+}
+
+// trimLeading removes the blank lines at the start of comments
+func trimLeading(comments []string) []string {
+	for len(comments) > 0 && comments[0] == "" {
+		comments = comments[1:]
+	}
+	return comments
+}
+
+// trimTrailing removes the blank lines at the end of comments
+func trimTrailing(comments []string) []string {
+	for len(comments) > 0 && comments[len(comments)-1] == "" {
+		comments = comments[:len(comments)-1]
+	}
+	return comments
+}
+
+// trailing reads a comment written on the rest of the current line
+func (p *fmtParser) trailing() string {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+	if p.pos < len(p.src) && p.src[p.pos] == ';' {
+		end := strings.IndexByte(p.src[p.pos:], '\n')
+		if end < 0 {
+			end = len(p.src) - p.pos
+		}
+		comment := strings.TrimRight(p.src[p.pos:p.pos+end], " \t\r")
+		p.pos += end
+		return comment
+	}
+	return ""
+}
+
+func (p *fmtParser) atom() string {
+	start := p.pos
+	if p.src[p.pos] == '"' {
+		p.pos++
+		for p.pos < len(p.src) && p.src[p.pos] != '"' {
+			if p.src[p.pos] == '\\' {
+				p.pos++
+			}
+			p.pos++
+		}
+		p.pos++
+	} else {
+		for p.pos < len(p.src) && strings.IndexByte(" \t\r\n,:]};", p.src[p.pos]) < 0 {
+			p.pos++
+		}
+	}
+	if p.pos > len(p.src) || !json.Valid([]byte(p.src[start:p.pos])) {
+		p.pos = start
+		p.errorf("invalid atom")
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *fmtParser) form() *fmtNode {
+	if p.pos >= len(p.src) {
+		p.errorf("unexpected end of input")
+	}
+	open := p.src[p.pos]
+	if open != '[' && open != '{' {
+		return &fmtNode{text: p.atom()}
+	}
+	closing := byte(']')
+	if open == '{' {
+		closing = '}'
+	}
+	node := &fmtNode{open: open}
+	p.pos++
+	for {
+		comments := p.space()
+		if p.pos >= len(p.src) {
+			p.errorf("unexpected end of input")
+		}
+		if p.src[p.pos] == closing {
+			p.pos++
+			node.endComments = trimTrailing(comments)
+			return node
+		}
+		if len(node.children) == 0 {
+			comments = trimLeading(comments)
+		}
+		var child *fmtNode
+		if open == '{' {
+			key := p.atom()
+			if key[0] != '"' {
+				p.errorf("map keys must be strings")
+			}
+			p.space()
+			if p.pos >= len(p.src) || p.src[p.pos] != ':' {
+				p.errorf("expected ':' after map key")
+			}
+			p.pos++
+			p.space()
+			child = p.form()
+			child.key = key
+		} else {
+			child = p.form()
+		}
+		child.comments = comments
+		node.children = append(node.children, child)
+
+		p.skipSeparator(closing)
+		child.trailing = p.trailing()
+	}
+}
+
+// skipSeparator skips the whitespace and comma that follow an element of
+// a list or map, but not the comments on the next lines
+func (p *fmtParser) skipSeparator(closing byte) {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+	if p.pos < len(p.src) && p.src[p.pos] == ',' {
+		p.pos++
+		return
+	}
+	save := p.pos
+	p.space()
+	if p.pos < len(p.src) && p.src[p.pos] != closing {
+		p.errorf("expected ',' or %q", closing)
+	}
+	p.pos = save
+}
+
+// parseFormatted reads all the top level forms of a source file
+func parseFormatted(src string) (forms []*fmtNode, endComments []string) {
+	p := &fmtParser{src: src}
+	for {
+		comments := p.space()
+		if p.pos >= len(p.src) {
+			return forms, trimTrailing(comments)
+		}
+		if len(forms) == 0 {
+			comments = trimLeading(comments)
+		}
+		form := p.form()
+		form.comments = comments
+		form.trailing = p.trailing()
+		forms = append(forms, form)
+	}
+}
+
+// formatter prints fmtNodes keeping track of the current column
+type formatter struct {
+	buf bytes.Buffer
+	col int
+}
+
+func (f *formatter) write(s string) {
+	f.buf.WriteString(s)
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		f.col = len(s) - i - 1
+	} else {
+		f.col += len(s)
+	}
+}
+
+func (f *formatter) newline(indent int) {
+	f.write("\n" + strings.Repeat(" ", indent))
+}
+
+// hasComments reports whether any comment or blank line is written inside
+// node
+func (n *fmtNode) hasComments() bool {
+	if len(n.endComments) > 0 {
+		return true
+	}
+	for _, child := range n.children {
+		if len(child.comments) > 0 || child.trailing != "" || child.hasComments() {
+			return true
+		}
+	}
+	return false
+}
+
+// flat returns the node written in a single line
+func (n *fmtNode) flat() string {
+	if n.open == 0 {
+		return n.text
+	}
+	parts := make([]string, len(n.children))
+	for i, child := range n.children {
+		if n.open == '{' {
+			parts[i] = child.key + ": " + child.flat()
+		} else {
+			parts[i] = child.flat()
+		}
+	}
+	if n.open == '{' {
+		return "{" + strings.Join(parts, ", ") + "}"
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// head returns the name of the symbol at the head of a list
+func (n *fmtNode) head() (string, bool) {
+	if n.open != '[' || len(n.children) == 0 || n.children[0].open != 0 {
+		return "", false
+	}
+	var name string
+	if err := json.Unmarshal([]byte(n.children[0].text), &name); err != nil {
+		return "", false
+	}
+	return name, true
+}
+
+func (f *formatter) comments(comments []string, indent int) {
+	for _, comment := range comments {
+		f.write(comment)
+		f.newline(indent)
+	}
+}
+
+// fits reports whether n can be written in a single line at the current
+// column, followed by tail characters
+func (f *formatter) fits(n *fmtNode, tail int) (string, bool) {
+	if n.hasComments() {
+		return "", false
+	}
+	flat := n.flat()
+	return flat, f.col+len(flat)+tail <= formatWidth
+}
+
+// childTail returns how many characters follow child i of n on its line
+// when n is followed by tail characters
+func childTail(n *fmtNode, i int, tail int, topLevel bool) int {
+	switch {
+	case i < len(n.children)-1:
+		return 1
+	case topLevel || n.children[i].trailing != "" || len(n.endComments) > 0:
+		return 0
+	default:
+		return tail + 1
+	}
+}
+
+// node writes n at the current column, followed by tail characters on the
+// same line. lineIndent is the indentation of the line where n starts,
+// used to indent the bodies of special forms.
+func (f *formatter) node(n *fmtNode, lineIndent int, tail int, topLevel bool) {
+	if n.open == 0 {
+		f.write(n.text)
+		return
+	}
+	if flat, ok := f.fits(n, tail); ok {
+		f.write(flat)
+		return
+	}
+	if n.open == '{' || len(n.children) == 0 {
+		f.data(n, tail)
+		return
+	}
+
+	column := f.col
+	name, isSymbol := n.head()
+	header, special := specialForms[name]
+	if !isSymbol {
+		f.data(n, tail)
+		return
+	}
+	bodyIndent := lineIndent + 2
+	if !special {
+		// function calls keep their first argument on the first line and
+		// align the rest with it
+		header = 1
+		bodyIndent = column + 1 + len(n.children[0].text) + 2
+	}
+	if name == "def" {
+		// the value of a def hangs from its line, unless it has a docstring
+		header = 2
+	}
+	if header > len(n.children)-1 {
+		header = len(n.children) - 1
+	}
+	for i := 0; i <= header; i++ {
+		if len(n.children[i].comments) > 0 {
+			header = i - 1
+			break
+		}
+		if n.children[i].trailing != "" {
+			header = i
+			break
+		}
+	}
+	if header < 0 {
+		// a commented head cannot share its line with the bracket
+		f.data(n, tail)
+		return
+	}
+
+	f.write("[")
+	for i, child := range n.children {
+		switch {
+		case i == 0:
+		case i <= header:
+			f.write(" ")
+		default:
+			f.newline(bodyIndent)
+			f.comments(child.comments, bodyIndent)
+		}
+		childTail := childTail(n, i, tail, topLevel)
+		if name == "let" && i == 1 && child.open == '[' {
+			f.bindings(child, lineIndent, childTail)
+		} else if i <= header {
+			f.node(child, lineIndent, childTail, false)
+		} else {
+			f.node(child, bodyIndent, childTail, false)
+		}
+		f.separator(n, i)
+	}
+	f.close(n, "]", column, bodyIndent, topLevel)
+}
+
+// separator writes the comma and the trailing comment after child i of n
+func (f *formatter) separator(n *fmtNode, i int) {
+	if i < len(n.children)-1 {
+		f.write(",")
+	}
+	if n.children[i].trailing != "" {
+		f.write(" " + n.children[i].trailing)
+	}
+}
+
+// close writes the end comments and the closing bracket of a broken list
+func (f *formatter) close(n *fmtNode, closing string, column int, indent int, topLevel bool) {
+	if len(n.endComments) > 0 {
+		f.newline(indent)
+		for i, comment := range n.endComments {
+			if i > 0 {
+				f.newline(indent)
+			}
+			f.write(comment)
+		}
+		f.newline(column)
+	} else if topLevel || n.children[len(n.children)-1].trailing != "" {
+		f.newline(column)
+	}
+	f.write(closing)
+}
+
+// data writes a list or map with an element per line
+func (f *formatter) data(n *fmtNode, tail int) {
+	column := f.col
+	open, closing := "[", "]"
+	if n.open == '{' {
+		open, closing = "{", "}"
+	}
+	f.write(open)
+	for i, child := range n.children {
+		if i > 0 {
+			f.newline(column + 1)
+		} else if len(child.comments) > 0 {
+			f.newline(column + 1)
+		}
+		f.comments(child.comments, column+1)
+		if n.open == '{' {
+			f.write(child.key + ": ")
+		}
+		f.node(child, column+1, childTail(n, i, tail, false), false)
+		f.separator(n, i)
+	}
+	if len(n.children) == 0 {
+		if len(n.endComments) > 0 {
+			f.newline(column + 1)
+			f.comments(n.endComments[:len(n.endComments)-1], column+1)
+			f.write(n.endComments[len(n.endComments)-1])
+			f.newline(column)
+		}
+		f.write(closing)
+		return
+	}
+	f.close(n, closing, column, column+1, false)
+}
+
+// bindings writes the binding list of a let with a name and value pair per
+// line
+func (f *formatter) bindings(n *fmtNode, lineIndent int, tail int) {
+	if flat, ok := f.fits(n, tail); ok {
+		f.write(flat)
+		return
+	}
+	column := f.col
+	f.write("[")
+	for i, child := range n.children {
+		switch {
+		case i == 0 && len(child.comments) > 0:
+			f.newline(column + 1)
+		case i == 0:
+		case i%2 == 0 || n.children[i-1].trailing != "" || len(child.comments) > 0:
+			f.newline(column + 1)
+		default:
+			f.write(" ")
+		}
+		f.comments(child.comments, column+1)
+		f.node(child, lineIndent+2, childTail(n, i, tail, false), false)
+		f.separator(n, i)
+	}
+	f.close(n, "]", column, column+1, false)
+}
+
+// formatSource returns the canonical layout of a source file
+func formatSource(src string) string {
+	forms, endComments := parseFormatted(src)
+	f := &formatter{}
+	for i, form := range forms {
+		if i > 0 {
+			f.write("\n")
+		}
+		f.comments(form.comments, 0)
+		f.node(form, 0, 0, true)
+		if form.trailing != "" {
+			f.write(" " + form.trailing)
+		}
+	}
+	if len(forms) > 0 && len(endComments) > 0 {
+		f.write("\n")
+	}
+	for i, comment := range endComments {
+		if i > 0 {
+			f.write("\n")
+		}
+		f.write(comment)
+	}
+	if f.buf.Len() == 0 {
+		return ""
+	}
+	// blank lines inside indented bodies leave trailing spaces behind
+	lines := strings.Split(f.buf.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " ")
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// cmdFormat implements the fmt command
+func cmdFormat(opts *options, args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	write := flags.Bool("w", false, "write the result to the source files instead of stdout")
+	check := flags.Bool("check", false, "list the files that are not formatted and fail if any")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	files := flags.Args()
+	if len(files) == 0 {
+		src, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return exitStatus(err)
+		}
+		formatted, err := formatSafely(string(src))
+		if err != nil {
+			return exitStatus(err)
+		}
+		if *check {
+			if formatted != string(src) {
+				fmt.Println("<stdin>")
+				return exitError
+			}
+			return exitOK
+		}
+		fmt.Print(formatted)
+		return exitOK
+	}
+
+	status := exitOK
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			status = exitStatus(err)
+			continue
+		}
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			status = exitStatus(err)
+			continue
+		}
+		formatted, err := formatSafely(string(src))
+		if err != nil {
+			status = exitStatus(fmt.Errorf("%s: %s", file, err))
+			continue
+		}
+		switch {
+		case *check:
+			if formatted != string(src) {
+				fmt.Println(file)
+				status = exitError
+			}
+		case *write:
+			if formatted != string(src) {
+				if err := ioutil.WriteFile(file, []byte(formatted), info.Mode().Perm()); err != nil {
+					status = exitStatus(err)
+				}
+			}
+		default:
+			fmt.Print(formatted)
+		}
+	}
+	return status
+}
+
+// formatSafely returns the errors of the formatter parser instead of
+// panicking
+func formatSafely(src string) (formatted string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoveredError(r)
+		}
+	}()
+	return formatSource(src), nil
+}
@@ -0,0 +1,117 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestFormatIdempotent formats the core library and the conformance tests
+// twice, as fmt -check expects a formatted file to stay the same
+func TestFormatIdempotent(t *testing.T) {
+	files, err := filepath.Glob("../../../tests/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = append([]string{"../../core.json"}, files...)
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		once, err := formatSafely(string(src))
+		if err != nil {
+			t.Errorf("%s: %s", file, err)
+			continue
+		}
+		twice, err := formatSafely(once)
+		if err != nil {
+			t.Errorf("%s formatted: %s", file, err)
+			continue
+		}
+		if twice != once {
+			t.Errorf("%s: formatting twice changes\n%s\ninto\n%s", file, once, twice)
+		}
+	}
+
+	core, _ := ioutil.ReadFile("../../core.json")
+	formatted, _ := formatSafely(string(core))
+	if JSON(READ(stripComments(formatted))) != JSON(READ(stripComments(string(core)))) {
+		t.Errorf("formatting changes the forms of core.json")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	for _, test := range []struct {
+		src, want string
+	}{
+		{`["+",1,2]`, "[\"+\", 1, 2]\n"},
+		{"[\"do\", [\"def\", \"x\", 1],\n\n\n      [\"prn\", \"x\"]]", "[\"do\",\n  [\"def\", \"x\", 1],\n\n  [\"prn\", \"x\"]\n]\n"},
+		{"; note\n[\"list\", 1, ; one\n 2]", "; note\n[\"list\", 1, ; one\n         2\n]\n"},
+	} {
+		got, err := formatSafely(test.src)
+		if err != nil || got != test.want {
+			t.Errorf("format %q = %q, %v, want %q", test.src, got, err, test.want)
+		}
+		if again, _ := formatSafely(got); again != got {
+			t.Errorf("format %q is not stable: %q", got, again)
+		}
+	}
+	if _, err := formatSafely(`["+" 1]`); err == nil {
+		t.Errorf("formatting a missing comma succeeds")
+	}
+}
+
+func TestFormatCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minimal-fmt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	formatted := "[\"+\", 1, 2]\n"
+	for name, src := range map[string]string{"ok.json": formatted, "bad.json": `["+",1,2]`} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		args   []string
+		stdin  string
+		stdout string
+		status int
+	}{
+		{[]string{"fmt", "-check", "ok.json"}, "", "", exitOK},
+		{[]string{"fmt", "-check", "ok.json", "bad.json"}, "", "bad.json\n", exitError},
+		{[]string{"fmt", "-check"}, formatted, "", exitOK},
+		{[]string{"fmt", "-check"}, `["+",1,2]`, "<stdin>\n", exitError},
+		{[]string{"fmt"}, `["+",1,2]`, formatted, exitOK},
+		{[]string{"fmt", "bad.json"}, "", formatted, exitOK},
+	} {
+		stdout, _, status := runMinimal(t, dir, test.stdin, test.args...)
+		if stdout != test.stdout || status != test.status {
+			t.Errorf("minimal %s: status %d, stdout %q, want status %d, stdout %q",
+				strings.Join(test.args, " "), status, stdout, test.status, test.stdout)
+		}
+	}
+
+	if _, _, status := runMinimal(t, dir, "", "fmt", "-w", "bad.json"); status != exitOK {
+		t.Errorf("fmt -w status %d", status)
+	}
+	bad := filepath.Join(dir, "bad.json")
+	if src, _ := ioutil.ReadFile(bad); string(src) != formatted {
+		t.Errorf("fmt -w wrote %q", src)
+	}
+	if info, err := os.Stat(bad); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("fmt -w changed the mode to %v", info.Mode())
+	}
+	if _, _, status := runMinimal(t, dir, "", "fmt", "-check", "bad.json"); status != exitOK {
+		t.Errorf("fmt -check after fmt -w status %d", status)
+	}
+}
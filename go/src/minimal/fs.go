@@ -0,0 +1,341 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// sandboxRoot returns the absolute path of the directory root, with its
+// symbolic links resolved
+func sandboxRoot(root string) (string, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	abs, err = filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("root %s is not a directory", root)
+	}
+	return abs, nil
+}
+
+// SetRoot confines load, slurp and the other filesystem builtins of e and
+// its children to the directory root: relative paths are relative to it
+// and paths leading out of it, symbolic links included, are refused. An
+// empty root allows any path, relative to the working directory.
+func (e *Environment) SetRoot(root string) error {
+	if root == "" {
+		e.ctx.root = ""
+		return nil
+	}
+	abs, err := sandboxRoot(root)
+	if err != nil {
+		return err
+	}
+	e.ctx.root = abs
+	return nil
+}
+
+// maxLinks is the number of symbolic links resolveLinks follows before it
+// gives up on a path, as the kernel does with ELOOP
+const maxLinks = 255
+
+// resolveLinks returns the clean absolute path p with its symbolic links
+// resolved one component at a time. Dangling links are replaced by their
+// targets too, since creating a file through one creates its target, and
+// the components that do not exist are kept as they are.
+func resolveLinks(p string) (string, error) {
+	separator := string(filepath.Separator)
+	resolved := filepath.VolumeName(p) + separator
+	rest := strings.Split(p[len(resolved):], separator)
+	links := 0
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, name)
+		info, err := os.Lstat(next)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		links++
+		if links > maxLinks {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", p)
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = filepath.VolumeName(target) + separator
+			target = target[len(resolved):]
+		}
+		rest = append(strings.Split(target, separator), rest...)
+	}
+	return resolved, nil
+}
+
+// inRoot reports whether the absolute path p is root or inside it
+func inRoot(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// path returns the path the builtin named builtin uses for its filename
+// argument name, panicking if it leads out of the root
+func (c *evalContext) path(builtin string, name interface{}) string {
+	return c.confine(builtin, name, true)
+}
+
+// entryPath is path for the builtins acting on the directory entry named,
+// which for a symbolic link is the link and not the file it points to
+func (c *evalContext) entryPath(builtin string, name interface{}) string {
+	return c.confine(builtin, name, false)
+}
+
+// confine returns the path for name under the root, resolving the links
+// of its last element only when follow is true
+func (c *evalContext) confine(builtin string, name interface{}, follow bool) string {
+	filename, ok := name.(string)
+	if !ok {
+		panic(fmt.Errorf("%s requires a filename", builtin))
+	}
+	if c.root == "" {
+		return filename
+	}
+	p := filename
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(c.root, p)
+	}
+	resolved, err := c.resolveEntry(filepath.Clean(p), follow)
+	if err != nil {
+		panic(fmt.Errorf("%s: %s", builtin, err))
+	}
+	if !inRoot(c.root, resolved) {
+		panic(fmt.Errorf("%s: %s is outside the root %s", builtin, filename, c.root))
+	}
+	return p
+}
+
+// resolveEntry is resolveLinks, leaving the last element of p as it is
+// unless follow is true
+func (c *evalContext) resolveEntry(p string, follow bool) (string, error) {
+	if follow || p == c.root {
+		return resolveLinks(p)
+	}
+	dir, err := resolveLinks(filepath.Dir(p))
+	return filepath.Join(dir, filepath.Base(p)), err
+}
+
+// fileOptions returns the boolean options of the builtin named builtin,
+// a map of the names given, when it is called with more than required
+// arguments
+func fileOptions(builtin string, args []interface{}, required int, names ...string) map[string]bool {
+	if len(args) < required || len(args) > required+1 {
+		panic(fmt.Errorf("wrong number of arguments (%d instead of %d or %d)", len(args), required, required+1))
+	}
+	options := map[string]bool{}
+	if len(args) == required {
+		return options
+	}
+	m, ok := args[required].(map[string]interface{})
+	if !ok {
+		panic(fmt.Errorf("%s options must be a map", builtin))
+	}
+	for key, value := range m {
+		known := false
+		for _, name := range names {
+			known = known || key == name
+		}
+		if !known {
+			panic(fmt.Errorf("unknown %s option %q", builtin, key))
+		}
+		options[key] = truthy(value)
+	}
+	return options
+}
+
+// spit writes content to a file, replacing it or appending to it with
+// the append option
+func (c *evalContext) spit(args []interface{}) interface{} {
+	options := fileOptions("spit", args, 2, "append")
+	filename := c.path("spit", args[0])
+	content, ok := args[1].(string)
+	if !ok {
+		panic(fmt.Errorf("spit requires a string content (was %T)", args[1]))
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if options["append"] {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(filename, flags, 0644)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		panic(err)
+	}
+	if err := f.Close(); err != nil {
+		panic(err)
+	}
+	return nil
+}
+
+func (c *evalContext) fileExists(args []interface{}) interface{} {
+	_, err := os.Stat(c.path("file-exists?", args[0]))
+	return err == nil
+}
+
+// ls returns the sorted names of the entries of a directory
+func (c *evalContext) ls(args []interface{}) interface{} {
+	infos, err := ioutil.ReadDir(c.path("ls", args[0]))
+	if err != nil {
+		panic(err)
+	}
+	names := []interface{}{}
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+// glob returns the sorted paths matching a pattern. Under a root, the
+// paths of a relative pattern are relative to the root and the ones out
+// of it are left out.
+func (c *evalContext) glob(args []interface{}) interface{} {
+	pattern, ok := args[0].(string)
+	if !ok {
+		panic(fmt.Errorf("glob requires a pattern"))
+	}
+	relative := !filepath.IsAbs(pattern)
+	if c.root != "" && relative {
+		pattern = filepath.Join(c.root, pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		panic(fmt.Errorf("glob: %s", err))
+	}
+	sort.Strings(matches)
+	paths := []interface{}{}
+	for _, match := range matches {
+		if c.root != "" {
+			if resolved, err := resolveLinks(match); err != nil || !inRoot(c.root, resolved) {
+				continue
+			}
+			if relative {
+				match, _ = filepath.Rel(c.root, match)
+			}
+		}
+		paths = append(paths, match)
+	}
+	return paths
+}
+
+// mkdir creates a directory and its missing parents, as mkdir -p does
+func (c *evalContext) mkdir(args []interface{}) interface{} {
+	if err := os.MkdirAll(c.path("mkdir", args[0]), 0755); err != nil {
+		panic(err)
+	}
+	return nil
+}
+
+// rm removes a file or an empty directory, or a directory and its
+// contents with the recursive option
+func (c *evalContext) rm(args []interface{}) interface{} {
+	options := fileOptions("rm", args, 1, "recursive")
+	// a symbolic link is removed, not the file it points to
+	filename := c.entryPath("rm", args[0])
+	if c.root != "" {
+		if resolved, _ := c.resolveEntry(filepath.Clean(filename), false); resolved == c.root {
+			panic(fmt.Errorf("rm: cannot remove the root %s", c.root))
+		}
+	}
+	remove := os.Remove
+	if options["recursive"] {
+		if _, err := os.Lstat(filename); err != nil {
+			panic(err)
+		}
+		remove = os.RemoveAll
+	}
+	if err := remove(filename); err != nil {
+		panic(err)
+	}
+	return nil
+}
+
+func (c *evalContext) mv(args []interface{}) interface{} {
+	// symbolic links are moved, and replaced, themselves
+	if err := os.Rename(c.entryPath("mv", args[0]), c.entryPath("mv", args[1])); err != nil {
+		panic(err)
+	}
+	return nil
+}
+
+// stat returns the size in bytes, the modification time in seconds since
+// the epoch and the mode of a file as a map
+func (c *evalContext) stat(args []interface{}) interface{} {
+	info, err := os.Stat(c.path("stat", args[0]))
+	if err != nil {
+		panic(err)
+	}
+	return map[string]interface{}{
+		"size":  info.Size(),
+		"mtime": info.ModTime().Unix(),
+		"mode":  info.Mode().String(),
+		"dir?":  info.IsDir(),
+	}
+}
+
+// tmpdir creates a new temporary directory, inside the root when there
+// is one, and returns its path
+func (c *evalContext) tmpdir(args []interface{}) interface{} {
+	dir, err := ioutil.TempDir(c.root, "minimal")
+	if err != nil {
+		panic(err)
+	}
+	return dir
+}
+
+// reduceLines reads a file line by line, calling f with the value so far,
+// starting with init, and each line without its line terminator. It
+// returns the last value f returns.
+func (c *evalContext) reduceLines(args []interface{}) interface{} {
+	f, err := os.Open(c.path("reduce-lines", args[2]))
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	acc := args[1]
+	for {
+		line, ok := nextLine("reduce-lines", r)
+		if !ok {
+			return acc
+		}
+		acc = apply(args[0], []interface{}{acc, line})
+	}
+}
@@ -0,0 +1,150 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileBuiltins(t *testing.T) {
+	root, err := ioutil.TempDir("", "minimal-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "minimal-fs-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	// dangling links out of the root, which writing through would create
+	for name, target := range map[string]string{
+		"dangling":     filepath.Join(outside, "created"),
+		"dangling-dir": filepath.Join(outside, "dir"),
+		"relative":     "../" + filepath.Base(outside) + "/relative",
+		"chain":        "dangling",
+		"loop":         "loop",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	env := newSymbolTable(&options{backend: "tree"}, []string{})
+	if err := env.SetRoot(root); err != nil {
+		t.Fatal(err)
+	}
+	run := func(program string) (result string, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = recoveredError(r)
+			}
+		}()
+		return JSON(evaluate(READ(program), env)), nil
+	}
+	q := func(s string) string { return `["` + "`" + `", "` + s + `"]` }
+
+	for _, test := range []struct {
+		program, want string
+	}{
+		{`["mkdir", ` + q("a/b") + `]`, `null`},
+		{`["spit", ` + q("a/b/lines.txt") + `, ` + q(`one\ntwo\r\n`) + `]`, `null`},
+		{`["spit", ` + q("a/b/lines.txt") + `, ` + q("three") + `, {"append": true}]`, `null`},
+		{`["slurp", ` + q("a/b/lines.txt") + `]`, `"one\ntwo\r\nthree"`},
+		{`["reduce-lines", ["fn", ["acc", "line"], ["list", "acc", "line"]], ["list"], ` + q("a/b/lines.txt") + `]`, `[[[[],"one"],"two"],"three"]`},
+		{`["spit", ` + q("a/main.json") + `, ` + q(`[\"def\", \"x\", 7]`) + `]`, `null`},
+		{`["do", ["load", ` + q("a/main.json") + `], "x"]`, `7`},
+		{`["file-exists?", ` + q("a/main.json") + `]`, `true`},
+		{`["file-exists?", ` + q("a/missing") + `]`, `false`},
+		{`["ls", ` + q("a") + `]`, `["b","main.json"]`},
+		{`["glob", ` + q("a/*/*.txt") + `]`, `["a/b/lines.txt"]`},
+		{`["glob", ` + q("*") + `]`, `["a"]`},
+		{`["get", ["stat", ` + q("a/main.json") + `], ` + q("size") + `]`, `15`},
+		{`["get", ["stat", ` + q("a") + `], ` + q("dir?") + `]`, `true`},
+		{`["mv", ` + q("a/main.json") + `, ` + q("a/moved.json") + `]`, `null`},
+		{`["ls", ` + q("a") + `]`, `["b","moved.json"]`},
+		{`["rm", ` + q("a/moved.json") + `]`, `null`},
+		{`["rm", ` + q("a") + `, {"recursive": true}]`, `null`},
+		{`["file-exists?", ` + q("a") + `]`, `false`},
+	} {
+		if got, err := run(test.program); err != nil || got != test.want {
+			t.Errorf("%s = %s, %v, want %s", test.program, got, err, test.want)
+		}
+	}
+
+	for _, test := range []struct {
+		program, want string
+	}{
+		{`["slurp", ` + q("../x") + `]`, "slurp: ../x is outside the root " + root},
+		{`["load", ` + q("/etc/passwd") + `]`, "load: /etc/passwd is outside the root " + root},
+		{`["spit", ` + q("escape/x") + `, ` + q("x") + `]`, "spit: escape/x is outside the root " + root},
+		{`["spit", ` + q("dangling") + `, ` + q("x") + `]`, "spit: dangling is outside the root " + root},
+		{`["spit", ` + q("relative") + `, ` + q("x") + `, {"append": true}]`, "spit: relative is outside the root " + root},
+		{`["spit", ` + q("chain") + `, ` + q("x") + `]`, "spit: chain is outside the root " + root},
+		{`["mkdir", ` + q("dangling-dir") + `]`, "mkdir: dangling-dir is outside the root " + root},
+		{`["mkdir", ` + q("dangling-dir/a/b") + `]`, "mkdir: dangling-dir/a/b is outside the root " + root},
+		{`["spit", ` + q("loop/x") + `, ` + q("x") + `]`, "spit: " + filepath.Join(root, "loop/x") + ": too many levels of symbolic links"},
+		{`["rm", ` + q(".") + `, {"recursive": true}]`, "rm: cannot remove the root " + root},
+		{`["rm", ` + q("x") + `, {"force": true}]`, `unknown rm option "force"`},
+		{`["spit", ` + q("x") + `, 1]`, "spit requires a string content (was int64)"},
+		{`["mv", ` + q("x") + `, ` + q("../moved") + `]`, "mv: ../moved is outside the root " + root},
+		{`["rm", ` + q("escape/x") + `]`, "rm: escape/x is outside the root " + root},
+	} {
+		if _, err := run(test.program); err == nil || err.Error() != test.want {
+			t.Errorf("%s: error %v, want %s", test.program, err, test.want)
+		}
+	}
+	if got, _ := run(`["glob", ` + q("escape/*") + `]`); got != `[]` {
+		t.Errorf("glob through a link out of the root: %s", got)
+	}
+
+	// rm and mv act on links out of the root, not on their targets
+	if err := ioutil.WriteFile(filepath.Join(outside, "kept"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "kept"), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		program, want string
+	}{
+		{`["mv", ` + q("link") + `, ` + q("moved-link") + `]`, `null`},
+		{`["rm", ` + q("moved-link") + `]`, `null`},
+		{`["rm", ` + q("dangling") + `]`, `null`},
+		{`["rm", ` + q("escape") + `, {"recursive": true}]`, `null`},
+		{`["file-exists?", ` + q("moved-link") + `]`, `false`},
+	} {
+		if got, err := run(test.program); err != nil || got != test.want {
+			t.Errorf("%s = %s, %v, want %s", test.program, got, err, test.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "kept")); err != nil {
+		t.Errorf("rm removed the target of a link: %v", err)
+	}
+	os.Remove(filepath.Join(outside, "kept"))
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("rm removed the directory a link points to: %v", err)
+	}
+
+	mode, err := run(`["do", ["spit", ` + q("f") + `, ` + q("") + `], ["get", ["stat", ` + q("f") + `], ` + q("mode") + `]]`)
+	if info, _ := os.Stat(filepath.Join(root, "f")); err != nil || info == nil || mode != `"`+info.Mode().String()+`"` {
+		t.Errorf("stat mode %s, %v", mode, err)
+	}
+
+	dir, err := run(`["tmpdir"]`)
+	if err != nil || !strings.HasPrefix(dir, `"`+filepath.Join(root, "minimal")) {
+		t.Errorf("tmpdir %s, %v", dir, err)
+	}
+	if entries, _ := ioutil.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("files written out of the root")
+	}
+}
@@ -0,0 +1,258 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+)
+
+// The fuzz targets fail when reading or evaluating panics with a Go
+// runtime error, like an index out of range or a failed type assertion,
+// instead of a miniMAL error. Run them with
+//
+//	make fuzz FUZZ=FuzzREAD FUZZTIME=5m
+
+// mustNotCrash calls f and fails the test if it panics with anything but
+// an error raised by the interpreter
+func mustNotCrash(t *testing.T, input string, f func()) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if err, ok := r.(runtime.Error); ok {
+			t.Fatalf("%q: %s", input, err)
+		}
+		if _, ok := r.(error); !ok {
+			t.Fatalf("%q: panic with %T: %v", input, r, r)
+		}
+	}()
+	f()
+}
+
+var readSeeds = []string{
+	``, ` `, `1`, `-1.5e3`, `99999999999999999999`, `1e400`, `"abc"`, `":key"`,
+	`true`, `null`, `[]`, `{}`, `["+", 1, 2]`, `["` + "`" + `", "abc"]`,
+	`{"a": ["b", 1]}`, `[`, `]`, `{"a"`, `"`, `-`, `x`, `[1,]`, `[1] 2`,
+}
+
+func FuzzREAD(f *testing.F) {
+	for _, seed := range readSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		for _, mode := range []readMode{readCompat, readSymbols} {
+			mustNotCrash(t, input, func() { symbolize(readJSON(input), mode, false) })
+			mustNotCrash(t, input, func() { readSource(input, "fuzz.json", mode) })
+		}
+	})
+}
+
+// FuzzRoundTrip checks that printing what READ returns and reading it
+// again gives the same AST
+func FuzzRoundTrip(f *testing.F) {
+	for _, seed := range readSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		printed := ""
+		func() {
+			defer func() { recover() }()
+			printed = JSON(READ(input))
+		}()
+		if printed == "" {
+			return
+		}
+		var again string
+		mustNotCrash(t, printed, func() { again = JSON(READ(printed)) })
+		if again != printed {
+			t.Fatalf("%q printed as %s and then as %s", input, printed, again)
+		}
+	})
+}
+
+// astGenerator builds a well formed AST from the bytes of a fuzz input.
+// The special forms get any number of arguments of any kind, but fns can
+// only call builtins, map only gets fns written in place and the defs of
+// the top level can only call the defs before them, so no AST recurses
+// forever: that would overflow the Go stack, which cannot be recovered.
+type astGenerator struct {
+	data  []byte
+	depth int
+}
+
+var (
+	fuzzBuiltins = []string{
+		"+", "-", "*", "/", "<", "<=", "=", "list", "map", "first", "last",
+		"nth", "count", "empty?", "list?", "string?", "get", "set", "str",
+		"pr-str", "read", "symbol", "symbol?", "keyword", "keyword?",
+	}
+	fuzzForms  = []string{"def", "`", "fn", "let", "if", "do", "&"}
+	fuzzLocals = []string{"a", "b", "c"}
+	fuzzDefs   = []string{"x", "y"}
+)
+
+func (g *astGenerator) byte() int {
+	if len(g.data) == 0 {
+		return 0
+	}
+	b := g.data[0]
+	g.data = g.data[1:]
+	return int(b)
+}
+
+func (g *astGenerator) pick(names []string) *Symbol {
+	return Intern(names[g.byte()%len(names)])
+}
+
+// form returns a form that can call the builtins and the symbols in
+// callable and refer to the symbols in visible
+func (g *astGenerator) form(visible, callable []string) interface{} {
+	if g.depth > 6 {
+		return g.atom(visible)
+	}
+	g.depth++
+	defer func() { g.depth-- }()
+	switch g.byte() % 8 {
+	case 0, 1:
+		return g.atom(visible)
+	case 2, 3:
+		call := []interface{}{g.pick(concat(fuzzBuiltins, callable))}
+		if call[0] == Intern("map") {
+			call = append(call, g.fn())
+		}
+		return g.arguments(call, visible, callable)
+	case 4:
+		return g.fn()
+	case 5:
+		bindings := []interface{}{}
+		for n := g.byte() % 5; n > 0; n-- {
+			bindings = append(bindings, g.pick(fuzzLocals), g.form(visible, callable))
+		}
+		return []interface{}{symLet, bindings, g.form(concat(visible, fuzzLocals), callable)}
+	case 6:
+		return g.arguments([]interface{}{g.pick(fuzzForms)}, visible, callable)
+	default:
+		return []interface{}{symQuote, g.atom(visible)}
+	}
+}
+
+// fn returns a fn form, which only sees its locals and calls builtins
+func (g *astGenerator) fn() interface{} {
+	params := []interface{}{}
+	for n := g.byte() % 4; n > 0; n-- {
+		params = append(params, g.pick(concat(fuzzLocals, []string{"&"})))
+	}
+	return []interface{}{symFn, params, g.form(fuzzLocals, nil)}
+}
+
+// concat returns a new slice with the names of a and b
+func concat(a, b []string) []string {
+	return append(append([]string{}, a...), b...)
+}
+
+func (g *astGenerator) arguments(call []interface{}, visible, callable []string) []interface{} {
+	for n := g.byte() % 4; n > 0; n-- {
+		call = append(call, g.form(visible, callable))
+	}
+	return call
+}
+
+func (g *astGenerator) atom(visible []string) interface{} {
+	switch g.byte() % 8 {
+	case 0:
+		return int64(g.byte() - 128)
+	case 7:
+		return map[string]interface{}{"a": int64(g.byte())}
+	case 1:
+		return float64(g.byte()) / 4
+	case 2:
+		return "str"
+	case 3:
+		return g.byte()%2 == 0
+	case 4:
+		return nil
+	case 5:
+		return InternKeyword("k")
+	default:
+		if len(visible) == 0 {
+			return []interface{}{}
+		}
+		return g.pick(visible)
+	}
+}
+
+// program returns a few top level forms, defining the fuzzDefs
+func (g *astGenerator) program() []interface{} {
+	forms := []interface{}{}
+	defined := []string{}
+	for n := 1 + g.byte()%4; n > 0; n-- {
+		if g.byte()%2 == 0 {
+			name := fuzzDefs[len(defined)%len(fuzzDefs)]
+			forms = append(forms, []interface{}{symDef, Intern(name), g.form(defined, defined)})
+			defined = concat(defined, []string{name})
+			continue
+		}
+		forms = append(forms, g.form(defined, defined))
+	}
+	return forms
+}
+
+// crashers are forms the fuzz targets found panicking with runtime errors
+var crashers = []string{
+	`[]`,
+	`["def"]`,
+	`["def", "x", ["def"]]`,
+	`["let", ["a"]]`,
+	`["if", true]`,
+	`["do"]`,
+	`["nth", ["list", 1], 1]`,
+	`["nth", ["list", 1], -1]`,
+	`["get", ["` + "`" + `", {"a": 1}], 1]`,
+	`["set", ["` + "`" + `", {"a": 1}], 1, 2]`,
+	`[["fn", ["a", "b"], "a"], 1]`,
+	`[["fn", ["a", "&", 1], "a"], 1]`,
+	`["map", ["fn", ["a", "a"], "a"], -128]`,
+}
+
+func TestCrashers(t *testing.T) {
+	for _, backend := range []string{"tree", "resolved", "compiled", "bytecode"} {
+		env := newSymbolTable(&options{backend: backend}, []string{})
+		for _, input := range crashers {
+			mustNotCrash(t, backend+": "+input, func() { evaluate(READ(input), env) })
+			mustNotCrash(t, input, func() { readJSON(input[:len(input)/2]) })
+		}
+	}
+}
+
+func FuzzEVAL(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{2, 0, 3, 0, 1, 0, 2})
+	f.Add([]byte{1, 0, 4, 2, 0, 3, 2, 6, 1, 2, 0})
+	f.Add([]byte{3, 1, 6, 3, 5, 5, 0, 4, 2, 2, 4, 3, 1, 7, 0, 8})
+	f.Add([]byte("let us fuzz the evaluators with these bytes"))
+
+	names := []string{}
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		program := (&astGenerator{data: data}).program()
+		for _, backend := range names {
+			env := newSymbolTable(&options{backend: backend}, []string{})
+			for _, form := range program {
+				timer := time.AfterFunc(time.Second, func() { env.Interrupt(errTimeout) })
+				mustNotCrash(t, backend+": "+JSON(form), func() { JSON(evaluate(form, env)) })
+				timer.Stop()
+				env.ctx.reset()
+			}
+		}
+	})
+}
@@ -0,0 +1,736 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// lspServer speaks the Language Server Protocol with an editor over a
+// pair of streams. It keeps the text of the open documents and analyzes
+// them again for each request, as they are small.
+type lspServer struct {
+	mode readMode
+	in   *bufio.Reader
+	out  io.Writer
+	// root is the directory of the workspace, where the files loaded with
+	// relative paths are read from
+	root string
+	// core is a library whose definitions every document sees, as with
+	// check -core
+	core string
+	docs map[string]*lspDocument
+}
+
+type lspDocument struct {
+	uri  string
+	path string
+	text string
+}
+
+func newLSPServer(opts *options, in io.Reader, out io.Writer) *lspServer {
+	return &lspServer{mode: opts.mode, in: bufio.NewReader(in), out: out, docs: map[string]*lspDocument{}}
+}
+
+// lspMessage is a JSON-RPC request or notification, which has no id
+type lspMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// lspError is a JSON-RPC error
+type lspError struct {
+	code    int
+	message string
+}
+
+func (e *lspError) Error() string {
+	return e.message
+}
+
+// JSON-RPC and LSP error codes
+const (
+	lspParseError     = -32700
+	lspInvalidParams  = -32602
+	lspMethodNotFound = -32601
+	lspRequestFailed  = -32803
+)
+
+// lspPosition is a position in a document as the protocol counts them:
+// lines and UTF-16 code units from 0
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+// lspTextPosition is the params of the requests about a place in a document
+type lspTextPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+func (s *lspServer) send(message map[string]interface{}) {
+	message["jsonrpc"] = "2.0"
+	body, err := json.Marshal(message)
+	if err != nil {
+		panic(err)
+	}
+	writeFramedMessage(s.out, body)
+}
+
+func (s *lspServer) reply(id json.RawMessage, result interface{}, err error) {
+	message := map[string]interface{}{"id": id}
+	if err != nil {
+		e, ok := err.(*lspError)
+		if !ok {
+			e = &lspError{code: lspRequestFailed, message: err.Error()}
+		}
+		message["error"] = map[string]interface{}{"code": e.code, "message": e.message}
+	} else {
+		message["result"] = result
+	}
+	s.send(message)
+}
+
+func (s *lspServer) notify(method string, params interface{}) {
+	s.send(map[string]interface{}{"method": method, "params": params})
+}
+
+// serve handles the messages of the editor until it sends exit or closes
+// the input
+func (s *lspServer) serve() error {
+	for {
+		body, err := readFramedMessage(s.in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		message := &lspMessage{}
+		if err := json.Unmarshal(body, message); err != nil {
+			s.reply(json.RawMessage("null"), nil, &lspError{code: lspParseError, message: err.Error()})
+			continue
+		}
+		if message.Method == "exit" {
+			return nil
+		}
+		result, err := s.handle(message)
+		if len(message.ID) > 0 {
+			s.reply(message.ID, result, err)
+		}
+	}
+}
+
+// params decodes the params of a message into v
+func params(message *lspMessage, v interface{}) error {
+	if err := json.Unmarshal(message.Params, v); err != nil {
+		return &lspError{code: lspInvalidParams, message: fmt.Sprintf("invalid params of %s: %s", message.Method, err)}
+	}
+	return nil
+}
+
+func (s *lspServer) handle(message *lspMessage) (interface{}, error) {
+	switch message.Method {
+	case "initialize":
+		var p struct {
+			RootURI  string `json:"rootUri"`
+			RootPath string `json:"rootPath"`
+		}
+		if err := params(message, &p); err != nil {
+			return nil, err
+		}
+		s.root = p.RootPath
+		if p.RootURI != "" {
+			s.root = uriToPath(p.RootURI)
+		}
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":           1,
+				"hoverProvider":              true,
+				"definitionProvider":         true,
+				"completionProvider":         map[string]interface{}{"triggerCharacters": []string{`"`}},
+				"documentFormattingProvider": true,
+			},
+			"serverInfo": map[string]interface{}{"name": "minimal"},
+		}, nil
+	case "shutdown":
+		return nil, nil
+	case "textDocument/didOpen":
+		var p struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := params(message, &p); err != nil {
+			return nil, err
+		}
+		doc := &lspDocument{uri: p.TextDocument.URI, path: uriToPath(p.TextDocument.URI), text: p.TextDocument.Text}
+		s.docs[doc.uri] = doc
+		s.diagnose(doc)
+	case "textDocument/didChange":
+		var p struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := params(message, &p); err != nil {
+			return nil, err
+		}
+		doc := s.docs[p.TextDocument.URI]
+		if doc == nil || len(p.ContentChanges) == 0 {
+			return nil, nil
+		}
+		// the server asked for the full text on every change
+		doc.text = p.ContentChanges[len(p.ContentChanges)-1].Text
+		s.diagnose(doc)
+	case "textDocument/didSave":
+		var p lspTextPosition
+		if err := params(message, &p); err != nil {
+			return nil, err
+		}
+		if doc := s.docs[p.TextDocument.URI]; doc != nil {
+			s.diagnose(doc)
+		}
+	case "textDocument/didClose":
+		var p lspTextPosition
+		if err := params(message, &p); err != nil {
+			return nil, err
+		}
+		delete(s.docs, p.TextDocument.URI)
+		s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+			"uri": p.TextDocument.URI, "diagnostics": []interface{}{},
+		})
+	case "textDocument/hover", "textDocument/definition", "textDocument/completion":
+		var p lspTextPosition
+		if err := params(message, &p); err != nil {
+			return nil, err
+		}
+		doc := s.docs[p.TextDocument.URI]
+		if doc == nil {
+			return nil, fmt.Errorf("%s is not open", p.TextDocument.URI)
+		}
+		a := s.analyze(doc)
+		offset := a.offset(p.Position)
+		switch message.Method {
+		case "textDocument/hover":
+			return a.hover(offset), nil
+		case "textDocument/definition":
+			return a.definition(offset), nil
+		default:
+			return a.completion(offset), nil
+		}
+	case "textDocument/formatting":
+		var p lspTextPosition
+		if err := params(message, &p); err != nil {
+			return nil, err
+		}
+		doc := s.docs[p.TextDocument.URI]
+		if doc == nil {
+			return nil, fmt.Errorf("%s is not open", p.TextDocument.URI)
+		}
+		formatted, err := formatSafely(doc.text)
+		if err != nil {
+			return nil, err
+		}
+		edits := []interface{}{}
+		if formatted != doc.text {
+			text := newLSPText(doc.text)
+			edits = append(edits, map[string]interface{}{
+				"range":   lspRange{Start: lspPosition{}, End: text.position(len(doc.text))},
+				"newText": formatted,
+			})
+		}
+		return edits, nil
+	default:
+		if len(message.ID) > 0 {
+			return nil, &lspError{code: lspMethodNotFound, message: "unsupported method " + message.Method}
+		}
+	}
+	return nil, nil
+}
+
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+func pathToURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// resolve returns where a file loaded as name is read from
+func (s *lspServer) resolve(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(s.root, name)
+}
+
+// source returns the text of a file, taken from the editor when it is open
+func (s *lspServer) source(path string) (string, error) {
+	for _, doc := range s.docs {
+		if doc.path == path {
+			return doc.text, nil
+		}
+	}
+	contents, err := ioutil.ReadFile(path)
+	return string(contents), err
+}
+
+// lspText converts between byte offsets in a text and protocol positions
+type lspText struct {
+	text       string
+	lineStarts []int
+}
+
+func newLSPText(text string) *lspText {
+	t := &lspText{text: text, lineStarts: []int{0}}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			t.lineStarts = append(t.lineStarts, i+1)
+		}
+	}
+	return t
+}
+
+func (t *lspText) position(offset int) lspPosition {
+	line := sort.Search(len(t.lineStarts), func(i int) bool { return t.lineStarts[i] > offset }) - 1
+	return lspPosition{Line: line, Character: len(utf16.Encode([]rune(t.text[t.lineStarts[line]:offset])))}
+}
+
+func (t *lspText) offset(pos lspPosition) int {
+	if pos.Line >= len(t.lineStarts) {
+		return len(t.text)
+	}
+	offset := t.lineStarts[pos.Line]
+	for units := 0; units < pos.Character && offset < len(t.text) && t.text[offset] != '\n'; {
+		r, size := utf8.DecodeRuneInString(t.text[offset:])
+		offset += size
+		units += len(utf16.Encode([]rune{r}))
+	}
+	return offset
+}
+
+// offsetOf returns the offset of a position read by readSource
+func (t *lspText) offsetOf(pos Position) int {
+	if pos.Line < 1 || pos.Line > len(t.lineStarts) {
+		return 0
+	}
+	return t.lineStarts[pos.Line-1] + pos.Col - 1
+}
+
+// rangeOf returns the range of the value starting at pos
+func (t *lspText) rangeOf(pos Position) lspRange {
+	start := t.offsetOf(pos)
+	return lspRange{Start: t.position(start), End: t.position(valueEnd(t.text, start))}
+}
+
+// valueEnd returns the offset where the JSON value starting at start ends,
+// in a text without comments
+func valueEnd(text string, start int) int {
+	depth := 0
+	for i := start; i < len(text); i++ {
+		switch text[i] {
+		case '"':
+			for i++; i < len(text) && text[i] != '"'; i++ {
+				if text[i] == '\\' {
+					i++
+				}
+			}
+			if depth == 0 {
+				return i + 1
+			}
+		case '[', '{':
+			depth++
+		case ']', '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		case ' ', '\t', '\r', '\n', ',', ':':
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(text)
+}
+
+// stringAt returns the JSON string of text at offset and where it starts
+func stringAt(text string, offset int) (value string, start int, ok bool) {
+	for i := 0; i < len(text) && i <= offset; i++ {
+		if text[i] != '"' {
+			continue
+		}
+		start := i
+		end := valueEnd(text, i)
+		if offset < end {
+			if err := json.Unmarshal([]byte(text[start:end]), &value); err != nil {
+				return "", 0, false
+			}
+			return value, start, true
+		}
+		i = end - 1
+	}
+	return "", 0, false
+}
+
+// lspDefinition is a symbol defined with def and where
+type lspDefinition struct {
+	Doc
+	location lspLocation
+}
+
+// lspLocal is a name bound by a fn or a let enclosing a place
+type lspLocal struct {
+	name string
+	kind string
+	form lspRange
+}
+
+// lspAnalysis is what the server knows of a document while it handles a
+// request: its text without comments, its AST and the symbols defined by
+// it and the files it loads
+type lspAnalysis struct {
+	server *lspServer
+	doc    *lspDocument
+	*lspText
+	ast         interface{}
+	definitions map[string]*lspDefinition
+}
+
+func (s *lspServer) analyze(doc *lspDocument) *lspAnalysis {
+	a := &lspAnalysis{
+		server:      s,
+		doc:         doc,
+		lspText:     newLSPText(stripComments(doc.text)),
+		definitions: map[string]*lspDefinition{},
+	}
+	loaded := map[string]bool{}
+	if s.core != "" {
+		a.load(s.core, loaded)
+	}
+	loaded[doc.path] = true
+	a.ast, _ = a.read(doc.text, doc.path)
+	a.define(a.ast, a.lspText, doc.path, loaded)
+	return a
+}
+
+// read reads a source recovering the errors of the reader, which the
+// diagnostics report
+func (a *lspAnalysis) read(src, file string) (ast interface{}, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			ast, ok = nil, false
+		}
+	}()
+	return readSource(src, file, a.server.mode), true
+}
+
+// load collects the definitions of a loaded file
+func (a *lspAnalysis) load(name string, loaded map[string]bool) {
+	path := a.server.resolve(name)
+	if loaded[path] {
+		return
+	}
+	loaded[path] = true
+	src, err := a.server.source(path)
+	if err != nil {
+		return
+	}
+	if ast, ok := a.read(src, name); ok {
+		a.define(ast, newLSPText(stripComments(src)), path, loaded)
+	}
+}
+
+// define collects the defs of ast, read from path, in the order load
+// would evaluate them
+func (a *lspAnalysis) define(ast interface{}, text *lspText, path string, loaded map[string]bool) {
+	list, ok := ast.([]interface{})
+	if !ok || len(list) == 0 || list[0] == symQuote {
+		return
+	}
+	if head, ok := symbolName(list[0]); ok && head == "load" {
+		if file, ok := quotedString(list); ok {
+			a.load(file, loaded)
+			return
+		}
+	}
+	if list[0] == symDef && len(list) >= 3 {
+		if name, ok := symbolName(list[1]); ok {
+			pos, _ := PositionOf(list)
+			def := &lspDefinition{
+				Doc:      Doc{Name: name, Pos: pos},
+				location: lspLocation{URI: pathToURI(path), Range: text.rangeOf(pos)},
+			}
+			if len(list) == 4 {
+				def.Doc.Doc, _ = stringLiteral(list[2])
+			}
+			if fn, ok := list[len(list)-1].([]interface{}); ok && len(fn) == 3 && fn[0] == symFn {
+				def.Args = fn[1]
+			}
+			a.definitions[name] = def
+		}
+	}
+	for _, element := range list {
+		a.define(element, text, path, loaded)
+	}
+}
+
+// locals returns the names bound by the fn and let forms enclosing offset,
+// innermost last
+func (a *lspAnalysis) locals(offset int) []lspLocal {
+	locals := []lspLocal{}
+	var walk func(ast interface{})
+	walk = func(ast interface{}) {
+		list, ok := ast.([]interface{})
+		if !ok || len(list) == 0 || list[0] == symQuote {
+			return
+		}
+		pos, ok := PositionOf(list)
+		if !ok {
+			return
+		}
+		start := a.offsetOf(pos)
+		if offset <= start || offset >= valueEnd(a.text, start) {
+			return
+		}
+		form := a.rangeOf(pos)
+		switch {
+		case list[0] == symFn && len(list) == 3:
+			params, _ := list[1].([]interface{})
+			for _, param := range params {
+				if name, ok := symbolName(param); ok && name != "&" {
+					locals = append(locals, lspLocal{name: name, kind: "parameter", form: form})
+				}
+			}
+			walk(list[2])
+			return
+		case list[0] == symLet && len(list) >= 3:
+			bindings, _ := list[1].([]interface{})
+			for i := 0; i < len(bindings); i += 2 {
+				if name, ok := symbolName(bindings[i]); ok {
+					locals = append(locals, lspLocal{name: name, kind: "let binding", form: form})
+				}
+			}
+		}
+		for _, element := range list {
+			walk(element)
+		}
+	}
+	walk(a.ast)
+	return locals
+}
+
+// local returns the innermost local named name at offset
+func (a *lspAnalysis) local(name string, offset int) (lspLocal, bool) {
+	locals := a.locals(offset)
+	for i := len(locals) - 1; i >= 0; i-- {
+		if locals[i].name == name {
+			return locals[i], true
+		}
+	}
+	return lspLocal{}, false
+}
+
+func (a *lspAnalysis) hover(offset int) interface{} {
+	name, start, ok := stringAt(a.text, offset)
+	if !ok {
+		return nil
+	}
+	var contents string
+	if local, ok := a.local(name, offset); ok {
+		contents = fmt.Sprintf("`%s` %s", name, local.kind)
+	} else if def, ok := a.definitions[name]; ok {
+		contents = hoverDoc(&def.Doc)
+	} else if doc, ok := builtinDocs[name]; ok {
+		entry := *doc
+		entry.Name = name
+		contents = hoverDoc(&entry)
+	} else {
+		return nil
+	}
+	return map[string]interface{}{
+		"contents": map[string]interface{}{"kind": "markdown", "value": contents},
+		"range":    lspRange{Start: a.position(start), End: a.position(valueEnd(a.text, start))},
+	}
+}
+
+// hoverDoc writes a doc as the markdown of a hover
+func hoverDoc(doc *Doc) string {
+	contents := fmt.Sprintf("`%s`", doc.Name)
+	if args := docArgs(doc); args != "" {
+		contents += fmt.Sprintf(" `%s`", args)
+	}
+	if doc.Doc != "" {
+		contents += "\n\n" + doc.Doc
+	}
+	return contents
+}
+
+func (a *lspAnalysis) definition(offset int) interface{} {
+	name, _, ok := stringAt(a.text, offset)
+	if !ok {
+		return nil
+	}
+	if local, ok := a.local(name, offset); ok {
+		return lspLocation{URI: a.doc.uri, Range: local.form}
+	}
+	if def, ok := a.definitions[name]; ok {
+		return def.location
+	}
+	return nil
+}
+
+// Kinds of the completion items
+const (
+	completionFunction = 3
+	completionVariable = 6
+	completionKeyword  = 14
+)
+
+// completion returns the symbols in scope at offset: locals, defs,
+// builtins and special forms, the innermost ones hiding the rest
+func (a *lspAnalysis) completion(offset int) interface{} {
+	items := map[string]map[string]interface{}{}
+	add := func(name string, kind int, detail string, doc string) {
+		if _, ok := items[name]; ok {
+			return
+		}
+		item := map[string]interface{}{"label": name, "kind": kind}
+		if detail != "" {
+			item["detail"] = detail
+		}
+		if doc != "" {
+			item["documentation"] = doc
+		}
+		items[name] = item
+	}
+	locals := a.locals(offset)
+	for i := len(locals) - 1; i >= 0; i-- {
+		add(locals[i].name, completionVariable, locals[i].kind, "")
+	}
+	for name, def := range a.definitions {
+		kind := completionVariable
+		if def.Args != nil {
+			kind = completionFunction
+		}
+		add(name, kind, docArgs(&def.Doc), def.Doc.Doc)
+	}
+	for symbol := range BaseSymbolTable().Scope {
+		doc := builtinDocs[symbol.name]
+		if doc == nil {
+			add(symbol.name, completionFunction, "", "")
+			continue
+		}
+		add(symbol.name, completionFunction, docArgs(doc), doc.Doc)
+	}
+	add("ARGS", completionVariable, "", "The arguments of the program.")
+	for _, name := range []string{"def", "fn", "let", "if", "do", "`"} {
+		add(name, completionKeyword, "special form", "")
+	}
+	names := []string{}
+	for name := range items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := []interface{}{}
+	for _, name := range names {
+		list = append(list, items[name])
+	}
+	return map[string]interface{}{"isIncomplete": false, "items": list}
+}
+
+// diagnose publishes the errors of the reader and of the static checker in
+// a document
+func (s *lspServer) diagnose(doc *lspDocument) {
+	c := newChecker(s.mode)
+	c.root = s.root
+	if s.core != "" {
+		c.checkFile(s.core)
+	}
+	c.loaded[doc.path] = true
+	c.checkSource(doc.text, doc.path)
+	found := c.finish()
+	text := newLSPText(stripComments(doc.text))
+	diagnostics := []interface{}{}
+	for _, d := range found {
+		if d.Pos.File != doc.path {
+			continue
+		}
+		severity := 1
+		if d.Severity == severityWarning {
+			severity = 2
+		}
+		diagnostics = append(diagnostics, map[string]interface{}{
+			"range":    text.rangeOf(d.Pos),
+			"severity": severity,
+			"source":   "minimal",
+			"message":  d.Message,
+		})
+	}
+	s.notify("textDocument/publishDiagnostics", map[string]interface{}{"uri": doc.uri, "diagnostics": diagnostics})
+}
+
+// cmdLSP serves the Language Server Protocol over stdin and stdout
+func cmdLSP(opts *options, args []string) int {
+	flags := flag.NewFlagSet("lsp", flag.ContinueOnError)
+	core := flags.String("core", "", "library whose definitions are visible to the documents, such as core.json")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	s := newLSPServer(opts, stdin, os.Stdout)
+	if *core != "" {
+		path, err := filepath.Abs(*core)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		s.core = path
+	}
+	if err := s.serve(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	return exitOK
+}
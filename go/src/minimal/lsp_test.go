@@ -0,0 +1,179 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const lspLibrary = `["do",
+  ["def", "square", ["` + "`" + `", "Returns x times x."], ["fn", ["x"], ["*", "x", "x"]]],
+  ["def", "answer", 42]]
+`
+
+const lspMain = `["do",
+  ["load", ["` + "`" + `", "lib.json"]],
+  ["def", "f", ["fn", ["a"],
+    ["let", ["b", ["square", "a"]],
+      ["+", "b", "answer"]]]],
+  ["prn", ["f", 2], "missing"]]
+`
+
+// lspExchange sends messages to a language server and returns its replies
+// by id and its notifications
+func lspExchange(t *testing.T, messages []map[string]interface{}) (map[float64]map[string]interface{}, []map[string]interface{}) {
+	var in, out bytes.Buffer
+	for _, message := range messages {
+		message["jsonrpc"] = "2.0"
+		body, _ := json.Marshal(message)
+		writeFramedMessage(&in, body)
+	}
+	s := newLSPServer(&options{mode: readCompat}, &in, &out)
+	if err := s.serve(); err != nil {
+		t.Fatal(err)
+	}
+	replies := map[float64]map[string]interface{}{}
+	notifications := []map[string]interface{}{}
+	r := bufio.NewReader(&out)
+	for {
+		body, err := readFramedMessage(r)
+		if err != nil {
+			break
+		}
+		message := map[string]interface{}{}
+		json.Unmarshal(body, &message)
+		if id, ok := message["id"].(float64); ok {
+			replies[id] = message
+		} else {
+			notifications = append(notifications, message)
+		}
+	}
+	return replies, notifications
+}
+
+func lspAt(id int, method, uri string, line, character int) map[string]interface{} {
+	return map[string]interface{}{"id": id, "method": method, "params": map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri},
+		"position":     map[string]interface{}{"line": line, "character": character},
+	}}
+}
+
+func TestLSP(t *testing.T) {
+	root, err := ioutil.TempDir("", "minimal-lsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := ioutil.WriteFile(filepath.Join(root, "lib.json"), []byte(lspLibrary), 0644); err != nil {
+		t.Fatal(err)
+	}
+	uri := pathToURI(filepath.Join(root, "main.json"))
+	libURI := pathToURI(filepath.Join(root, "lib.json"))
+	unformatted := "[\"do\", [\"def\", \"x\", 1],\n\n\n      [\"prn\", \"x\"]]"
+
+	replies, notifications := lspExchange(t, []map[string]interface{}{
+		{"id": 1, "method": "initialize", "params": map[string]interface{}{"rootUri": pathToURI(root)}},
+		{"method": "initialized", "params": map[string]interface{}{}},
+		{"method": "textDocument/didOpen", "params": map[string]interface{}{
+			"textDocument": map[string]interface{}{"uri": uri, "languageId": "json", "version": 1, "text": lspMain},
+		}},
+		lspAt(2, "textDocument/hover", uri, 3, 20),
+		lspAt(3, "textDocument/hover", uri, 4, 8),
+		lspAt(4, "textDocument/hover", uri, 4, 14),
+		lspAt(5, "textDocument/definition", uri, 3, 20),
+		lspAt(6, "textDocument/definition", uri, 3, 30),
+		lspAt(7, "textDocument/completion", uri, 4, 14),
+		lspAt(8, "textDocument/hover", uri, 0, 0),
+		{"method": "textDocument/didChange", "params": map[string]interface{}{
+			"textDocument":   map[string]interface{}{"uri": uri, "version": 2},
+			"contentChanges": []interface{}{map[string]interface{}{"text": unformatted}},
+		}},
+		{"id": 9, "method": "textDocument/formatting", "params": map[string]interface{}{
+			"textDocument": map[string]interface{}{"uri": uri},
+			"options":      map[string]interface{}{"tabSize": 2, "insertSpaces": true},
+		}},
+		{"method": "textDocument/didChange", "params": map[string]interface{}{
+			"textDocument":   map[string]interface{}{"uri": uri, "version": 3},
+			"contentChanges": []interface{}{map[string]interface{}{"text": "[\"do\",\n  [\"+\", 1 2]]"}},
+		}},
+		{"id": 10, "method": "textDocument/rename", "params": map[string]interface{}{}},
+		{"id": 11, "method": "shutdown"},
+		{"method": "exit"},
+	})
+
+	result := func(id float64) string {
+		return toJSON(replies[id]["result"])
+	}
+	capabilities := replies[1]["result"].(map[string]interface{})["capabilities"].(map[string]interface{})
+	if capabilities["hoverProvider"] != true || capabilities["textDocumentSync"] != 1.0 {
+		t.Errorf("capabilities %s", toJSON(capabilities))
+	}
+	for _, test := range []struct {
+		id   float64
+		want string
+	}{
+		{2, `{"contents":{"kind":"markdown","value":"` + "`square` `[\\\"x\\\"]`" + `\n\nReturns x times x."},"range":{"end":{"character":27,"line":3},"start":{"character":19,"line":3}}}`},
+		{3, `{"contents":{"kind":"markdown","value":"` + "`+` `[\\\"a\\\",\\\"b\\\"]`" + `\n\nReturns the sum of two numbers."},"range":{"end":{"character":10,"line":4},"start":{"character":7,"line":4}}}`},
+		{4, `{"contents":{"kind":"markdown","value":"` + "`b` let binding" + `"},"range":{"end":{"character":15,"line":4},"start":{"character":12,"line":4}}}`},
+		{5, `{"range":{"end":{"character":80,"line":1},"start":{"character":2,"line":1}},"uri":"` + libURI + `"}`},
+		{6, `{"range":{"end":{"character":28,"line":4},"start":{"character":15,"line":2}},"uri":"` + uri + `"}`},
+		{8, `null`},
+		{9, `[{"newText":"[\"do\",\n  [\"def\", \"x\", 1],\n\n  [\"prn\", \"x\"]\n]\n","range":{"end":{"character":19,"line":3},"start":{"character":0,"line":0}}}]`},
+	} {
+		if got := result(test.id); got != test.want {
+			t.Errorf("reply %v: %s\nwant %s", test.id, got, test.want)
+		}
+	}
+
+	items := map[string]string{}
+	for _, item := range replies[7]["result"].(map[string]interface{})["items"].([]interface{}) {
+		item := item.(map[string]interface{})
+		items[item["label"].(string)] = toJSON(item)
+	}
+	for label, want := range map[string]string{
+		"a":      `{"detail":"parameter","kind":6,"label":"a"}`,
+		"b":      `{"detail":"let binding","kind":6,"label":"b"}`,
+		"square": `{"detail":"[\"x\"]","documentation":"Returns x times x.","kind":3,"label":"square"}`,
+		"answer": `{"kind":6,"label":"answer"}`,
+		"first":  `{"detail":"[\"l\"]","documentation":"Returns the first element of a list or null if it is empty.","kind":3,"label":"first"}`,
+		"let":    `{"detail":"special form","kind":14,"label":"let"}`,
+	} {
+		if items[label] != want {
+			t.Errorf("completion %s: %s, want %s", label, items[label], want)
+		}
+	}
+	if _, ok := items["x"]; ok {
+		t.Errorf("completion offers x, a parameter out of scope")
+	}
+
+	if got := toJSON(replies[10]["error"]); got != `{"code":-32601,"message":"unsupported method textDocument/rename"}` {
+		t.Errorf("rename error %s", got)
+	}
+	if _, ok := replies[11]; !ok {
+		t.Errorf("no reply to shutdown")
+	}
+
+	diagnostics := []string{}
+	for _, n := range notifications {
+		if n["method"] == "textDocument/publishDiagnostics" {
+			diagnostics = append(diagnostics, toJSON(n["params"].(map[string]interface{})["diagnostics"]))
+		}
+	}
+	want := []string{
+		`[{"message":"undefined symbol \"missing\"","range":{"end":{"character":30,"line":5},"start":{"character":2,"line":5}},"severity":1,"source":"minimal"}]`,
+		`[]`,
+		`[{"message":"invalid character '2' after array element","range":{"end":{"character":11,"line":1},"start":{"character":10,"line":1}},"severity":1,"source":"minimal"}]`,
+	}
+	if strings.Join(diagnostics, "\n") != strings.Join(want, "\n") {
+		t.Errorf("diagnostics\n%s\nwant\n%s", strings.Join(diagnostics, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,826 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"reflect"
+	"strings"
+	"sync/atomic"
+)
+
+// Environment contains the scope symbols
+type Environment struct {
+	Scope  map[*Symbol]interface{}
+	Parent *Environment
+	Docs   map[string]*Doc
+	ctx    *evalContext
+}
+
+// evalContext is the state shared by an environment and all its children
+type evalContext struct {
+	interrupted int32
+	reason      error
+	// eval is the evaluator used by evaluate, EVAL when nil
+	eval func(ast interface{}, env *Environment) interface{}
+	// mode is how read and load tell symbols from strings
+	mode readMode
+	// cover records the forms evaluated by EVAL when not nil
+	cover *coverage
+	// profile records the calls of the fns evaluated by EVAL when not nil
+	profile *fnProfiler
+	tracer  *tracer
+	// traceEval makes EVAL trace every form it evaluates
+	traceEval bool
+	// debugger can stop EVAL before the forms it evaluates when not nil
+	debugger *debugger
+	// breakDebugger becomes the debugger at the first break form evaluated
+	// without one, so that EVAL only keeps frames once debugging starts
+	breakDebugger *debugger
+	// root confines the filesystem builtins when not empty, see SetRoot
+	root string
+	// out, err and in are *out*, *err* and *in*, the streams of the
+	// printing and reading builtins, os.Stdout, os.Stderr and stdin when nil
+	out io.Writer
+	err io.Writer
+	in  *bufio.Reader
+}
+
+// evaluate evaluates ast with the evaluator selected for env
+func evaluate(ast interface{}, env *Environment) interface{} {
+	if env.ctx.eval != nil {
+		return env.ctx.eval(ast, env)
+	}
+	return EVAL(ast, env)
+}
+
+// Interrupt stops any evaluation running on env or its children. The
+// evaluation panics with reason the next time EVAL loops.
+func (e *Environment) Interrupt(reason error) {
+	e.ctx.reason = reason
+	atomic.StoreInt32(&e.ctx.interrupted, 1)
+}
+
+func (c *evalContext) reset() {
+	atomic.StoreInt32(&c.interrupted, 0)
+}
+
+// isInterrupted reports whether the evaluation was interrupted, so the
+// error it panics with must not be handled as a miniMAL error
+func (c *evalContext) isInterrupted() bool {
+	return atomic.LoadInt32(&c.interrupted) != 0
+}
+
+func (c *evalContext) check() {
+	if atomic.LoadInt32(&c.interrupted) != 0 {
+		panic(c.reason)
+	}
+}
+
+// BaseSymbolTable returns a symbol table with predefined contents
+func BaseSymbolTable() (env *Environment) {
+	env = &Environment{
+		Scope: map[*Symbol]interface{}{},
+		ctx:   &evalContext{tracer: newTracer()},
+	}
+	builtins := map[string]interface{}{
+		"+":  args2(functionAdd),
+		"*":  args2(functionMul),
+		"-":  args2(functionSub),
+		"/":  args2(functionDiv),
+		"<":  args2(functionLT),
+		"<=": args2(functionLE),
+		">":  args2(functionGT),
+		">=": args2(functionGE),
+		"=": args2(func(args []interface{}) interface{} {
+			if isNumber(args[0]) {
+				return functionEqual(args)
+			}
+			return reflect.DeepEqual(args[0], args[1])
+		}),
+		"list": argsVariadic(func(args []interface{}) interface{} { return args }),
+		"map": args2(func(args []interface{}) interface{} {
+			items, ok := args[1].([]interface{})
+			if !ok {
+				panic(fmt.Errorf("map requires a list (was %T)", args[1]))
+			}
+			result := make([]interface{}, len(items))
+			for i, value := range items {
+				result[i] = apply(args[0], []interface{}{value})
+			}
+			return result
+		}),
+
+		// FILESYSTEM
+		"eval": args1(func(args []interface{}) interface{} {
+			ast := args[0]
+			if env.ctx.mode == readCompat {
+				// code built from strings, like ["list", ["`", "+"], 1, 2]
+				ast = symbolize(ast, readCompat, false)
+			}
+			return evaluate(ast, env)
+		}),
+		"read": args1(func(args []interface{}) interface{} {
+			return env.Read(castString(args[0]))
+		}),
+		"slurp": args1(func(args []interface{}) interface{} {
+			return functionSlurp([]interface{}{env.ctx.path("slurp", args[0])})
+		}),
+		"load": args1(func(args []interface{}) interface{} {
+			// functionLoad reads an AST from file
+			fileContents := functionSlurp([]interface{}{env.ctx.path("load", args[0])})
+			ast := readSource(fileContents.(string), args[0].(string), env.ctx.mode)
+			if env.ctx.cover != nil {
+				env.ctx.cover.add(args[0].(string), fileContents.(string), ast)
+			}
+			return evaluate(ast, env)
+		}),
+		"spit":         argsVariadic(env.ctx.spit),
+		"file-exists?": args1(env.ctx.fileExists),
+		"ls":           args1(env.ctx.ls),
+		"glob":         args1(env.ctx.glob),
+		"mkdir":        args1(env.ctx.mkdir),
+		"rm":           argsVariadic(env.ctx.rm),
+		"mv":           args2(env.ctx.mv),
+		"stat":         args1(env.ctx.stat),
+		"tmpdir":       args0(env.ctx.tmpdir),
+		"reduce-lines": args3(env.ctx.reduceLines),
+
+		"str":    argsVariadic(functionStr),
+		"pr-str": argsVariadic(functionPrStr),
+		"prn": argsVariadic(func(args []interface{}) interface{} {
+			return functionPrn(env.ctx.output(), args)
+		}),
+		"println": argsVariadic(func(args []interface{}) interface{} {
+			return functionPrintln(env.ctx.output(), args)
+		}),
+		"print": argsVariadic(func(args []interface{}) interface{} {
+			return functionPrint(env.ctx.output(), args)
+		}),
+		"list?":    args1(functionListQ),
+		"count":    args1(functionCount),
+		"empty?":   args1(functionEmptyQ),
+		"string?":  args1(functionStringQ),
+		"first":    args1(functionFirst),
+		"last":     args1(functionLast),
+		"nth":      args2(functionNth),
+		"get":      args2(functionHashMapGet),
+		"set":      args3(functionHashMapSet),
+		"symbol":   args1(functionSymbol),
+		"symbol?":  args1(functionSymbolQ),
+		"keyword":  args1(functionKeyword),
+		"keyword?": args1(functionKeywordQ),
+
+		// PROPERTY BASED TESTING
+		"gen-int":    argsVariadic(functionGenInt),
+		"gen-bool":   args0(functionGenBool),
+		"gen-string": args0(functionGenString),
+		"gen-json":   args0(functionGenJSON),
+		"gen-return": args1(functionGenReturn),
+		"gen-list":   args1(functionGenList),
+		"gen-map":    args2(functionGenMap),
+		"gen-fmap":   args2(functionGenFmap),
+		"gen-bind":   args2(functionGenBind),
+		"one-of":     args1(functionOneOf),
+		"such-that":  args2(functionSuchThat),
+		"for-all":    args2(functionForAll),
+		"quick-check": args2(func(args []interface{}) interface{} {
+			return quickCheck(env, args)
+		}),
+		"sample": args2(functionSample),
+
+		// STREAMS
+		"eprintln": argsVariadic(func(args []interface{}) interface{} {
+			return functionPrintln(env.ctx.errOutput(), args)
+		}),
+		"read-line": args0(func(args []interface{}) interface{} {
+			return env.ctx.readLine()
+		}),
+		"flush": args0(func(args []interface{}) interface{} {
+			return env.ctx.flush()
+		}),
+		"with-out-str": args1(func(args []interface{}) interface{} {
+			return env.ctx.withOutStr(args[0])
+		}),
+
+		// TRACING
+		"trace": argsVariadic(func(args []interface{}) interface{} {
+			return env.ctx.tracer.trace(env, args)
+		}),
+		"untrace": argsVariadic(func(args []interface{}) interface{} {
+			return env.ctx.tracer.untrace(env, args)
+		}),
+
+		// DEBUGGING
+		"break": args0(func(args []interface{}) interface{} {
+			if env.ctx.debugger == nil {
+				env.ctx.debugger = env.ctx.breakDebugger
+			}
+			if d := env.ctx.debugger; d != nil && !d.stopped {
+				d.stop("break")
+			}
+			return nil
+		}),
+	}
+	for name, value := range builtins {
+		env.Scope[Intern(name)] = value
+	}
+	return env
+}
+
+func castString(arg interface{}) string {
+	switch arg := arg.(type) {
+	case string:
+		return arg
+	default:
+		panic(fmt.Errorf("cannot cast %T to string", arg))
+	}
+}
+
+func functionHashMapGet(args []interface{}) interface{} {
+	switch hashMap := args[0].(type) {
+	case map[string]interface{}:
+		key, ok := hashMap[mapKey("get", args[1])]
+		if ok {
+			return key
+		}
+		return nil
+	default:
+		panic(fmt.Errorf("get requires a map"))
+	}
+}
+
+// mapKey returns the key argument of the map builtin named name
+func mapKey(name string, key interface{}) string {
+	switch key := key.(type) {
+	case string:
+		return key
+	default:
+		panic(fmt.Errorf("%s requires a string key (was %T)", name, key))
+	}
+}
+
+func dupMap(m map[string]interface{}) (rm map[string]interface{}) {
+	rm = make(map[string]interface{}, len(m))
+	for k, v := range m {
+		rm[k] = v
+	}
+	return
+}
+
+func functionHashMapSet(args []interface{}) interface{} {
+	switch hashMap := args[0].(type) {
+	case map[string]interface{}:
+		result := dupMap(hashMap)
+		result[mapKey("set", args[1])] = args[2]
+		return result
+	default:
+		panic(fmt.Errorf("set requires a map"))
+	}
+}
+
+func functionFirst(args []interface{}) interface{} {
+	switch arg0 := args[0].(type) {
+	case []interface{}:
+		l := len(arg0)
+		if l == 0 {
+			return nil
+		}
+		return arg0[0]
+	default:
+		panic(fmt.Errorf("first argument must be a list"))
+	}
+}
+
+func functionLast(args []interface{}) interface{} {
+	switch arg0 := args[0].(type) {
+	case []interface{}:
+		l := len(arg0)
+		if l == 0 {
+			return nil
+		}
+		return arg0[l-1]
+	default:
+		panic(fmt.Errorf("last argument must be a list"))
+	}
+}
+
+func functionNth(args []interface{}) interface{} {
+	switch {
+	case isNumber(args[1]):
+		n := intArg(args[1])
+		switch arg0 := args[0].(type) {
+		case []interface{}:
+			if n < 0 || n >= int64(len(arg0)) {
+				return nil
+			}
+			return arg0[n]
+		default:
+			panic(fmt.Errorf("nth second argument must be a list"))
+		}
+	default:
+		panic(fmt.Errorf("nth first argument must be a number"))
+	}
+}
+
+func functionStringQ(args []interface{}) interface{} {
+	_, ok := args[0].(string)
+	return ok
+}
+
+func functionListQ(args []interface{}) interface{} {
+	_, ok := args[0].([]interface{})
+	return ok
+}
+
+func functionCount(args []interface{}) interface{} {
+	elements, ok := args[0].([]interface{})
+	if !ok {
+		panic(fmt.Errorf("Not a list"))
+	}
+	return int64(len(elements))
+}
+
+func functionEmptyQ(args []interface{}) interface{} {
+	elements, ok := args[0].([]interface{})
+	if !ok {
+		panic(fmt.Errorf("Not a list"))
+	}
+	return len(elements) == 0
+}
+
+func functionStr(args []interface{}) interface{} {
+	strs := ""
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case string:
+			strs += arg
+		case []interface{}:
+			strs += functionStr(arg).(string)
+		case *Symbol, *Keyword:
+			strs += fmt.Sprint(arg)
+		default:
+			strs += JSON(arg)
+		}
+	}
+	return strs
+}
+
+func functionPrStr(args []interface{}) interface{} {
+	strs := []string{}
+	for _, arg := range args {
+		strs = append(strs, JSON(arg))
+	}
+	return strings.Join(strs, " ")
+}
+
+func functionPrn(w io.Writer, args []interface{}) interface{} {
+	fmt.Fprintln(w, functionPrStr(args))
+	return nil
+}
+
+func functionPrintln(w io.Writer, args []interface{}) interface{} {
+	fmt.Fprintln(w, functionStr(args))
+	return nil
+}
+
+func functionPrint(w io.Writer, args []interface{}) interface{} {
+	fmt.Fprint(w, functionStr(args))
+	return nil
+}
+
+// functionSlurp reads a file
+func functionSlurp(args []interface{}) interface{} {
+	switch fileName := args[0].(type) {
+	case string:
+		contents, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			panic(err)
+		}
+		return string(contents)
+	default:
+		panic(fmt.Errorf("slurp requires a filename"))
+	}
+}
+
+func args0(f func(args []interface{}) interface{}) func(args []interface{}) interface{} {
+	return func(args []interface{}) interface{} {
+		if len(args) != 0 {
+			panic(fmt.Errorf("wrong number of arguments (%d instead of 0)", len(args)))
+		}
+		return f(args)
+	}
+}
+
+func args1(f func(args []interface{}) interface{}) func(args []interface{}) interface{} {
+	return func(args []interface{}) interface{} {
+		if len(args) != 1 {
+			panic(fmt.Errorf("wrong number of arguments (%d instead of 1)", len(args)))
+		}
+		return f(args)
+	}
+}
+
+func args2(f func(args []interface{}) interface{}) func(args []interface{}) interface{} {
+	return func(args []interface{}) interface{} {
+		if len(args) != 2 {
+			panic(fmt.Errorf("wrong number of arguments (%d instead of 2)", len(args)))
+		}
+		return f(args)
+	}
+}
+
+func args3(f func(args []interface{}) interface{}) func(args []interface{}) interface{} {
+	return func(args []interface{}) interface{} {
+		if len(args) != 3 {
+			panic(fmt.Errorf("wrong number of arguments (%d instead of 3)", len(args)))
+		}
+		return f(args)
+	}
+}
+
+func argsVariadic(f func(args []interface{}) interface{}) func(args []interface{}) interface{} {
+	return func(args []interface{}) interface{} {
+		return f(args)
+	}
+}
+
+// NewSymbolTable creates a copy of an environtment table
+func NewSymbolTable(parent *Environment) *Environment {
+	return &Environment{
+		Scope:  map[*Symbol]interface{}{},
+		Parent: parent,
+		ctx:    parent.ctx,
+	}
+}
+
+// Get returns the value of the symbol named index
+func (e *Environment) Get(index string) interface{} {
+	return e.Lookup(Intern(index))
+}
+
+// Set defines the symbol named index
+func (e *Environment) Set(index string, value interface{}) interface{} {
+	return e.Define(Intern(index), value)
+}
+
+// Lookup returns the value of a symbol
+func (e *Environment) Lookup(symbol *Symbol) interface{} {
+	for env := e; env != nil; env = env.Parent {
+		if value, ok := env.Scope[symbol]; ok {
+			return value
+		}
+	}
+	panic(fmt.Errorf("Symbol %q undefined", symbol.name))
+}
+
+// Define defines a new symbol
+func (e *Environment) Define(symbol *Symbol, value interface{}) interface{} {
+	e.Scope[symbol] = value
+	return value
+}
+
+// Read parses a JSON encoded string into an AST with the read mode of e
+func (e *Environment) Read(str string) interface{} {
+	return symbolize(readJSON(str), e.ctx.mode, false)
+}
+
+// READ parses a JSON encoded string into an AST, reading strings as
+// symbols or string literals with the readCompat convention
+func READ(str string) interface{} {
+	return symbolize(readJSON(str), readCompat, false)
+}
+
+// readJSON parses a JSON encoded string with native numbers
+func readJSON(str string) (ast interface{}) {
+	switch str {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	}
+	if str == "" {
+		panic(fmt.Errorf("Cannot unmarshal: empty input"))
+	}
+
+	switch str[0] {
+	case '{':
+		ast = map[string]interface{}{}
+	case '[':
+		ast = []interface{}{}
+	case '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		var number json.Number
+		ast = number
+	case '"':
+		ast = ""
+	default:
+		panic(fmt.Errorf("Cannot unmarshal: %s", str))
+	}
+	dec := json.NewDecoder(strings.NewReader(str))
+	dec.UseNumber()
+
+	if err := dec.Decode(&ast); err != nil {
+		panic(err)
+	}
+	return nativeNumbers(ast)
+}
+
+func evalAST(ast interface{}, env *Environment) interface{} {
+	switch ast := ast.(type) {
+	case []interface{}:
+		outAST := make([]interface{}, len(ast))
+		for i, atom := range ast {
+			outAST[i] = EVAL(atom, env)
+		}
+		return outAST
+	case *Symbol:
+		return env.Lookup(ast)
+	default:
+		return ast
+	}
+}
+
+func envBind(ast interface{}, env *Environment, expressions []interface{}) *Environment {
+	switch ast := ast.(type) {
+	case []interface{}:
+		newEnv := NewSymbolTable(env)
+		for i, atom := range ast {
+			switch atom := atom.(type) {
+			default:
+				panic(fmt.Errorf("Variable identifier must be a symbol (was %T)", atom))
+			case *Symbol:
+				if atom == symAmp {
+					if i+1 == len(ast) {
+						panic(fmt.Errorf("binding list cannot end with &"))
+					}
+					rest, ok := ast[i+1].(*Symbol)
+					if !ok {
+						panic(fmt.Errorf("Variable identifier must be a symbol (was %T)", ast[i+1]))
+					}
+					if len(expressions) < i {
+						panic(fmt.Errorf("wrong number of arguments (%d instead of %d)", len(expressions), i))
+					}
+					newEnv.Define(rest, expressions[i:])
+					return newEnv
+				}
+				if i >= len(expressions) {
+					panic(fmt.Errorf("wrong number of arguments (%d instead of %d)", len(expressions), len(ast)))
+				}
+				newEnv.Define(atom, expressions[i])
+			}
+		}
+		if len(expressions) > len(ast) {
+			panic(fmt.Errorf("wrong number of arguments (%d instead of %d)", len(expressions), len(ast)))
+		}
+		return newEnv
+	default:
+		panic(fmt.Errorf("Binding must receive an array"))
+	}
+}
+
+// truthy returns the boolean value of an if condition
+func truthy(condition interface{}) bool {
+	switch condition := condition.(type) {
+	case bool:
+		return condition
+	case int64, float64, json.Number, *big.Int:
+		return !isZero(condition)
+	case nil:
+		return false
+	case []interface{}:
+		return len(condition) > 0
+	case string:
+		return condition != ""
+	case *Keyword:
+		return true
+	default:
+		panic(fmt.Errorf("if requires a quasi boolean condition but got %T", condition))
+	}
+}
+
+// apply calls f, a fn of any of the evaluators or a builtin, with args
+func apply(f interface{}, args []interface{}) interface{} {
+	switch f := f.(type) {
+	case func([]interface{}) interface{}:
+		return f(args)
+	case tcoFN:
+		return f.f(args)
+	case *closure:
+		return f.call(args)
+	case *compiledFn:
+		return f.call(args)
+	case *vmClosure:
+		return f.call(args)
+	default:
+		panic(fmt.Errorf("Non callable atom %T", f))
+	}
+}
+
+type tcoFN struct {
+	f          func(args []interface{}) interface{}
+	bodyAST    interface{}
+	env        *Environment
+	argSpecAST interface{}
+	// ast is the fn form, which identifies the function in profiles
+	ast []interface{}
+}
+
+// EVAL returns an atom after evaluating an atom entry
+func EVAL(ast interface{}, env *Environment) interface{} {
+	return evalTCO(ast, env, 0)
+}
+
+// evalFlags tell evalTCO what the caller of EVAL already did
+type evalFlags uint8
+
+const (
+	// inFrame is set when ast is the body of a call the profiler is
+	// timing, which the tail calls of ast replace
+	inFrame evalFlags = 1 << iota
+	// hooked is set when hookedEVAL already counted this evaluation
+	hooked
+)
+
+// evalTCO is EVAL
+func evalTCO(ast interface{}, env *Environment, flags evalFlags) interface{} {
+	if (env.ctx.traceEval || env.ctx.debugger != nil) && flags&hooked == 0 {
+		return hookedEVAL(ast, env, flags)
+	}
+	for iteration := 0; ; iteration++ {
+		env.ctx.check()
+		if env.ctx.traceEval {
+			env.ctx.tracer.eval(ast, iteration)
+		}
+		if d := env.ctx.debugger; d != nil {
+			d.eval(ast, env)
+		}
+		switch typedAST := ast.(type) {
+		case []interface{}:
+			if len(typedAST) == 0 {
+				panic(fmt.Errorf("cannot evaluate an empty list"))
+			}
+			if env.ctx.cover != nil {
+				env.ctx.cover.hit(typedAST)
+			}
+			switch first := typedAST[0].(type) {
+			case *Symbol:
+				switch first {
+
+				// apply
+				case symDef:
+					if len(typedAST) < 3 || len(typedAST) > 4 {
+						panic(fmt.Errorf("def needs 2 or 3 arguments (found %d)", len(typedAST)-1))
+					}
+					identifier, ok := typedAST[1].(*Symbol)
+					if !ok {
+						panic(fmt.Errorf("Second argument in def %q must be a symbol", typedAST[1]))
+					}
+					switch len(typedAST) {
+					case 3:
+						value := EVAL(typedAST[2], env)
+						env.Define(identifier, value)
+						env.setDoc(identifier.name, "", value, typedAST)
+						env.nameProfiled(identifier, value)
+						return value
+					default:
+						docstring := docString(typedAST[2])
+						value := EVAL(typedAST[3], env)
+						env.Define(identifier, value)
+						env.setDoc(identifier.name, docstring, value, typedAST)
+						env.nameProfiled(identifier, value)
+						return value
+					}
+				case symQuote:
+					if len(typedAST) != 2 {
+						panic(fmt.Errorf("quote needs 1 argument (found %d)", len(typedAST)-1))
+					}
+					return typedAST[1]
+				case symFn:
+					if len(typedAST) != 3 {
+						panic(fmt.Errorf("fn need 2 arguments (found %d)", len(typedAST)))
+					}
+					return tcoFN{
+						f: func(args []interface{}) interface{} {
+							newEnv := envBind(typedAST[1], env, args)
+							if p := env.ctx.profile; p != nil {
+								return p.call(typedAST, typedAST[2], newEnv)
+							}
+							return EVAL(typedAST[2], newEnv)
+						},
+						bodyAST:    typedAST[2],
+						env:        env,
+						argSpecAST: typedAST[1],
+						ast:        typedAST,
+					}
+
+				// TCO
+				case symLet:
+					if len(typedAST) != 3 {
+						panic(fmt.Errorf("let needs 2 arguments (found %d)", len(typedAST)-1))
+					}
+					newEnv := NewSymbolTable(env)
+					variables, ok := typedAST[1].([]interface{})
+					if !ok {
+						panic(fmt.Errorf("Second argument in let must be a list"))
+					}
+					if len(variables)%2 != 0 {
+						panic(fmt.Errorf("Second argument in let must be a list of pairs of name value"))
+					}
+					for i := range variables {
+						if i%2 != 0 {
+							continue
+						}
+						name, ok := variables[i].(*Symbol)
+						if !ok {
+							panic(fmt.Errorf("Variable identifier must be a symbol (was %T)", variables[i]))
+						}
+						newEnv.Define(name, EVAL(variables[i+1], newEnv))
+					}
+					env = newEnv
+					ast = typedAST[2]
+					goto contTCO
+				case symIf:
+					if len(typedAST) != 4 {
+						panic(fmt.Errorf("if needs 3 arguments (found %d)", len(typedAST)-1))
+					}
+					if truthy(EVAL(typedAST[1], env)) {
+						if env.ctx.cover != nil {
+							env.ctx.cover.branch(typedAST, 0)
+						}
+						ast = typedAST[2]
+					} else {
+						if env.ctx.cover != nil {
+							env.ctx.cover.branch(typedAST, 1)
+						}
+						ast = typedAST[3]
+					}
+					goto contTCO
+				case symDo:
+					if len(typedAST) < 2 {
+						panic(fmt.Errorf("do needs at least 1 argument"))
+					}
+					if len(typedAST) > 2 {
+						evalAST(typedAST[1:len(typedAST)-1], env)
+					}
+					ast = typedAST[len(typedAST)-1]
+					goto contTCO
+				}
+			}
+
+			// default cases for both switches
+			// -> fnCall(ast, env)
+			elements := evalAST(typedAST, env)
+
+			switch elements := elements.(type) {
+			case []interface{}:
+				f := elements[0]
+				switch f := f.(type) {
+				case func([]interface{}) interface{}:
+					result := f(elements[1:])
+					return result
+				case tcoFN:
+					ast = f.bodyAST
+					env = envBind(f.argSpecAST, f.env, elements[1:])
+					if p := env.ctx.profile; p != nil {
+						if flags&inFrame == 0 {
+							return p.call(f.ast, ast, env)
+						}
+						p.tailCall(f.ast)
+					}
+					goto contTCO
+				case *closure:
+					return f.call(elements[1:])
+				case *compiledFn:
+					return f.call(elements[1:])
+				case *vmClosure:
+					return f.call(elements[1:])
+				default:
+					panic(fmt.Errorf("Non callable atom %T", f))
+				}
+			default:
+				panic(fmt.Errorf("?? BOGUS %T", elements))
+			}
+		default:
+			return evalAST(ast, env)
+		}
+	contTCO:
+	}
+}
+
+// JSON returns the atom JSON sencoded
+func JSON(ast interface{}) string {
+	b, err := json.Marshal(ast)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,299 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Numbers are int64 when they fit and *big.Int for larger integers.
+// Integer arithmetic overflows into *big.Int and comes back to int64 when
+// the result fits, so the printer writes the same digits json.Number did
+// for integers. Numbers written with a fraction or an exponent stay the
+// json.Number they were read as, so 1.0 and 1e3 print as written, and
+// float arithmetic on them returns float64 values.
+
+// parseNumber converts a JSON number literal to its native value
+func parseNumber(literal string) interface{} {
+	if !strings.ContainsAny(literal, ".eE") {
+		if n, err := strconv.ParseInt(literal, 10, 64); err == nil {
+			return n
+		}
+		if n, ok := new(big.Int).SetString(literal, 10); ok {
+			return n
+		}
+	}
+	if _, err := strconv.ParseFloat(literal, 64); err != nil {
+		panic(err)
+	}
+	return json.Number(literal)
+}
+
+// nativeNumbers replaces the json.Number values inside a decoded JSON
+// value with native numbers
+func nativeNumbers(ast interface{}) interface{} {
+	switch ast := ast.(type) {
+	case json.Number:
+		return parseNumber(string(ast))
+	case []interface{}:
+		for i, value := range ast {
+			ast[i] = nativeNumbers(value)
+		}
+	case map[string]interface{}:
+		for key, value := range ast {
+			ast[key] = nativeNumbers(value)
+		}
+	}
+	return ast
+}
+
+func isNumber(value interface{}) bool {
+	switch value.(type) {
+	case int64, float64, json.Number, *big.Int:
+		return true
+	default:
+		return false
+	}
+}
+
+// isFloat reports whether a number is a float64 or a float literal
+func isFloat(value interface{}) bool {
+	switch value.(type) {
+	case float64, json.Number:
+		return true
+	default:
+		return false
+	}
+}
+
+// normalize returns n as an int64 when it fits
+func normalize(n *big.Int) interface{} {
+	if n.IsInt64() {
+		return n.Int64()
+	}
+	return n
+}
+
+func toBig(n interface{}) *big.Int {
+	switch n := n.(type) {
+	case int64:
+		return big.NewInt(n)
+	case *big.Int:
+		return n
+	default:
+		panic(fmt.Errorf("%T is not an integer", n))
+	}
+}
+
+func toFloat(n interface{}) float64 {
+	switch n := n.(type) {
+	case int64:
+		return float64(n)
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(n).Float64()
+		return f
+	case float64:
+		return n
+	case json.Number:
+		f, _ := strconv.ParseFloat(string(n), 64)
+		return f
+	default:
+		panic(fmt.Errorf("%T is not a number", n))
+	}
+}
+
+// numbers2 returns the two arguments of an arithmetic builtin converted
+// to the same representation: both int64, both *big.Int or both float64
+func numbers2(args []interface{}) (a, b interface{}) {
+	a, b = args[0], args[1]
+	if !isNumber(a) {
+		panic(fmt.Errorf("%s is not a number", JSON(a)))
+	}
+	if !isNumber(b) {
+		panic(fmt.Errorf("%s is not a number", JSON(b)))
+	}
+	if isFloat(a) || isFloat(b) {
+		return toFloat(a), toFloat(b)
+	}
+	_, aInt := a.(int64)
+	_, bInt := b.(int64)
+	if aInt && bInt {
+		return a, b
+	}
+	return toBig(a), toBig(b)
+}
+
+// finite returns the result of a float operation, which must be a number
+// JSON can write
+func finite(f float64) float64 {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		panic(fmt.Errorf("float overflow"))
+	}
+	return f
+}
+
+func functionAdd(args []interface{}) interface{} {
+	switch a := args[0].(type) {
+	case int64:
+		// the fast path, without allocations
+		if b, ok := args[1].(int64); ok {
+			if c := a + b; (c > a) == (b > 0) {
+				return c
+			}
+		}
+	}
+	a, b := numbers2(args)
+	switch a := a.(type) {
+	case float64:
+		return finite(a + b.(float64))
+	default:
+		return normalize(new(big.Int).Add(toBig(a), toBig(b)))
+	}
+}
+
+func functionSub(args []interface{}) interface{} {
+	switch a := args[0].(type) {
+	case int64:
+		if b, ok := args[1].(int64); ok {
+			if c := a - b; (c < a) == (b > 0) {
+				return c
+			}
+		}
+	}
+	a, b := numbers2(args)
+	switch a := a.(type) {
+	case float64:
+		return finite(a - b.(float64))
+	default:
+		return normalize(new(big.Int).Sub(toBig(a), toBig(b)))
+	}
+}
+
+func functionMul(args []interface{}) interface{} {
+	switch a := args[0].(type) {
+	case int64:
+		if b, ok := args[1].(int64); ok {
+			if a == 0 || b == 0 {
+				return int64(0)
+			}
+			if c := a * b; c/b == a && !(a == math.MinInt64 && b == -1) {
+				return c
+			}
+		}
+	}
+	a, b := numbers2(args)
+	switch a := a.(type) {
+	case float64:
+		return finite(a * b.(float64))
+	default:
+		return normalize(new(big.Int).Mul(toBig(a), toBig(b)))
+	}
+}
+
+// functionDiv divides integers truncating the result, like the int64
+// division it always did, and floats exactly
+func functionDiv(args []interface{}) interface{} {
+	a, b := numbers2(args)
+	switch a := a.(type) {
+	case int64:
+		b := b.(int64)
+		if b == 0 {
+			panic(fmt.Errorf("division by zero"))
+		}
+		if a != math.MinInt64 || b != -1 {
+			return a / b
+		}
+	case float64:
+		if b.(float64) == 0 {
+			panic(fmt.Errorf("division by zero"))
+		}
+		return finite(a / b.(float64))
+	}
+	if toBig(b).Sign() == 0 {
+		panic(fmt.Errorf("division by zero"))
+	}
+	return normalize(new(big.Int).Quo(toBig(a), toBig(b)))
+}
+
+// compareNumbers returns -1, 0 or 1 as args[0] is less than, equal to or
+// greater than args[1]
+func compareNumbers(args []interface{}) int {
+	a, b := numbers2(args)
+	switch a := a.(type) {
+	case int64:
+		b := b.(int64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case float64:
+		b := b.(float64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	default:
+		return a.(*big.Int).Cmp(b.(*big.Int))
+	}
+}
+
+func functionEqual(args []interface{}) interface{} {
+	return compareNumbers(args) == 0
+}
+
+func functionLT(args []interface{}) interface{} {
+	return compareNumbers(args) < 0
+}
+
+func functionGT(args []interface{}) interface{} {
+	return compareNumbers(args) > 0
+}
+
+func functionGE(args []interface{}) interface{} {
+	return compareNumbers(args) >= 0
+}
+
+func functionLE(args []interface{}) interface{} {
+	return compareNumbers(args) <= 0
+}
+
+// intArg returns an integer argument of a builtin
+func intArg(value interface{}) int64 {
+	switch value := value.(type) {
+	case int64:
+		return value
+	case *big.Int:
+		panic(fmt.Errorf("%s is out of range", value))
+	default:
+		panic(fmt.Errorf("%s is not an integer", JSON(value)))
+	}
+}
+
+// isZero reports whether a number is zero
+func isZero(value interface{}) bool {
+	switch value := value.(type) {
+	case int64:
+		return value == 0
+	case float64:
+		return value == 0
+	case json.Number:
+		return toFloat(value) == 0
+	case *big.Int:
+		return value.Sign() == 0
+	default:
+		panic(fmt.Errorf("%T is not a number", value))
+	}
+}
@@ -0,0 +1,119 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"testing"
+)
+
+func TestNumbers(t *testing.T) {
+	for _, test := range []struct{ src, want string }{
+		// numbers print as they were read
+		{`1`, `1`},
+		{`1.0`, `1.0`},
+		{`1e3`, `1e3`},
+		{`-2.50`, `-2.50`},
+		{`123456789012345678901234567890`, `123456789012345678901234567890`},
+		{`["list", 1.0, 1e3, 7]`, `[1.0,1e3,7]`},
+		// = compares values across representations
+		{`["=", 1, 1.0]`, `true`},
+		{`["=", 1e3, 1000]`, `true`},
+		{`["=", 0.5, 1]`, `false`},
+		{`["=", 9223372036854775808, 9223372036854775808]`, `true`},
+		{`["=", 9223372036854775808, 9223372036854775807]`, `false`},
+		{`["=", 9223372036854775808, 9.223372036854775808e18]`, `true`},
+		{`["<", 9223372036854775807, 9223372036854775808]`, `true`},
+		{`["<", 1, 1.5]`, `true`},
+		// integer arithmetic overflows into big integers and back
+		{`["+", 9223372036854775807, 1]`, `9223372036854775808`},
+		{`["-", -9223372036854775808, 1]`, `-9223372036854775809`},
+		{`["*", 4294967296, 4294967296]`, `18446744073709551616`},
+		{`["/", -9223372036854775808, -1]`, `9223372036854775808`},
+		{`["-", 9223372036854775808, 1]`, `9223372036854775807`},
+		{`["/", 18446744073709551616, 4294967296]`, `4294967296`},
+		{`["/", 7, 2]`, `3`},
+		// float arithmetic
+		{`["+", 1, 0.5]`, `1.5`},
+		{`["*", 1.0, 1e3]`, `1000`},
+		{`["/", 7, 2.0]`, `3.5`},
+		{`["/", 1, 0]`, `error: division by zero`},
+		{`["/", 1.0, 0]`, `error: division by zero`},
+		{`["*", 1e308, 10]`, `error: float overflow`},
+		{`["+", 1e308, 1e308]`, `error: float overflow`},
+		{`["-", -1e308, 1e308]`, `error: float overflow`},
+		{`["/", 1e308, 1e-308]`, `error: float overflow`},
+		{`["if", 0.0, 1, 2]`, `2`},
+		{`["+", 1, ["list"]]`, `error: [] is not a number`},
+	} {
+		symbolTable := newSymbolTable(&options{}, []string{})
+		result, err := evalWithOptions(&options{}, symbolTable, func() interface{} {
+			return evaluate(symbolTable.Read(test.src), symbolTable)
+		})
+		got := JSON(result)
+		if err != nil {
+			got = "error: " + err.Error()
+		}
+		if got != test.want {
+			t.Errorf("%s = %s, want %s", test.src, got, test.want)
+		}
+	}
+}
+
+func TestNumberTypes(t *testing.T) {
+	for _, test := range []struct {
+		literal string
+		want    interface{}
+	}{
+		{"1", int64(1)},
+		{"-9223372036854775808", int64(-9223372036854775808)},
+		{"9223372036854775808", new(big.Int).Lsh(big.NewInt(1), 63)},
+		{"1.5", json.Number("1.5")},
+		{"1E+2", json.Number("1E+2")},
+	} {
+		got := parseNumber(test.literal)
+		if JSON(got) != JSON(test.want) || fmt.Sprintf("%T", got) != fmt.Sprintf("%T", test.want) {
+			t.Errorf("parseNumber(%s) = %T %v, want %T %v", test.literal, got, got, test.want, test.want)
+		}
+	}
+	if sum := functionAdd([]interface{}{int64(9223372036854775807), int64(1)}); fmt.Sprintf("%T", sum) != "*big.Int" {
+		t.Errorf("int64 overflow gave a %T", sum)
+	}
+	if difference := functionSub([]interface{}{new(big.Int).Lsh(big.NewInt(1), 63), int64(1)}); difference != int64(9223372036854775807) {
+		t.Errorf("a big.Int result that fits gave %T %v", difference, difference)
+	}
+}
+
+// jsonNumberAdd is + as it was when numbers were json.Number strings
+func jsonNumberAdd(args []interface{}) interface{} {
+	a, err := args[0].(json.Number).Int64()
+	if err != nil {
+		panic(err)
+	}
+	b, err := args[1].(json.Number).Int64()
+	if err != nil {
+		panic(err)
+	}
+	return json.Number(strconv.FormatInt(a+b, 10))
+}
+
+func BenchmarkAddJSONNumber(b *testing.B) {
+	var sum interface{} = json.Number("0")
+	one := json.Number("1")
+	for i := 0; i < b.N; i++ {
+		sum = jsonNumberAdd([]interface{}{sum, one})
+	}
+}
+
+func BenchmarkAddNative(b *testing.B) {
+	var sum interface{} = int64(0)
+	one := int64(1)
+	for i := 0; i < b.N; i++ {
+		sum = functionAdd([]interface{}{sum, one})
+	}
+}
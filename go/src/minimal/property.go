@@ -0,0 +1,472 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Property based testing: generators produce random values and a property
+// built with for-all is checked against many of them by quick-check. A
+// generator returns a rose tree, the value and the lazy tree of its
+// smaller versions, so the values made by gen-fmap, gen-bind and
+// such-that shrink with the generators they are built on.
+//
+//	["quick-check", 100,
+//	  ["for-all", ["gen-list", ["gen-int"]],
+//	    ["fn", ["l"], ["=", ["count", "l"], ["count", ["map", ["fn", ["x"], "x"], "l"]]]]]]
+//
+// The random source is seeded with defaultSeed unless quick-check gets a
+// {"seed": n} option, so a failure reproduces every time it runs.
+
+// defaultSeed seeds the random source of quick-check and sample
+const defaultSeed = 1
+
+// rose is a generated value and the values it shrinks to, simplest first
+type rose struct {
+	value   interface{}
+	shrinks func() []*rose
+}
+
+func leaf(value interface{}) *rose {
+	return &rose{value: value, shrinks: func() []*rose { return nil }}
+}
+
+func (r *rose) fmap(f func(interface{}) interface{}) *rose {
+	return &rose{value: f(r.value), shrinks: func() []*rose {
+		children := r.shrinks()
+		mapped := make([]*rose, len(children))
+		for i, child := range children {
+			mapped[i] = child.fmap(f)
+		}
+		return mapped
+	}}
+}
+
+// filter removes the shrinks that do not satisfy pred
+func (r *rose) filter(pred func(interface{}) bool) *rose {
+	return &rose{value: r.value, shrinks: func() []*rose {
+		kept := []*rose{}
+		for _, child := range r.shrinks() {
+			if pred(child.value) {
+				kept = append(kept, child.filter(pred))
+			}
+		}
+		return kept
+	}}
+}
+
+// bind returns the tree of f applied to the value of r. It shrinks the
+// value of r first and then the value f returned.
+func (r *rose) bind(f func(interface{}) *rose) *rose {
+	inner := f(r.value)
+	return &rose{value: inner.value, shrinks: func() []*rose {
+		children := []*rose{}
+		for _, child := range r.shrinks() {
+			children = append(children, child.bind(f))
+		}
+		return append(children, inner.shrinks()...)
+	}}
+}
+
+// generator is a miniMAL generator value
+type generator struct {
+	generate func(rnd *rand.Rand, size int) *rose
+}
+
+func genArg(name string, value interface{}) *generator {
+	g, ok := value.(*generator)
+	if !ok {
+		panic(fmt.Errorf("%s requires a generator (found %s)", name, safeJSON(value)))
+	}
+	return g
+}
+
+// shrinkInt returns the tree of x shrinking towards target
+func shrinkInt(x, target int64) *rose {
+	return &rose{value: x, shrinks: func() []*rose {
+		children := []*rose{}
+		for d := x - target; d != 0; d /= 2 {
+			children = append(children, shrinkInt(x-d, target))
+		}
+		return children
+	}}
+}
+
+// maxGenInt bounds gen-int so the distances between its values fit int64
+const maxGenInt = 1 << 62
+
+func functionGenInt(args []interface{}) interface{} {
+	var lo, hi int64
+	switch len(args) {
+	case 0:
+	case 2:
+		lo, hi = intArg(args[0]), intArg(args[1])
+		if lo > hi || lo < -maxGenInt || hi > maxGenInt {
+			panic(fmt.Errorf("gen-int requires lo <= hi, both between -2^62 and 2^62"))
+		}
+	default:
+		panic(fmt.Errorf("wrong number of arguments (%d instead of 0 or 2)", len(args)))
+	}
+	return &generator{generate: func(rnd *rand.Rand, size int) *rose {
+		lo, hi := lo, hi
+		if len(args) == 0 {
+			lo, hi = -int64(size), int64(size)
+		}
+		target := int64(0)
+		if target < lo {
+			target = lo
+		} else if target > hi {
+			target = hi
+		}
+		return shrinkInt(lo+rnd.Int63n(hi-lo+1), target)
+	}}
+}
+
+func functionGenBool(args []interface{}) interface{} {
+	return &generator{generate: func(rnd *rand.Rand, size int) *rose {
+		if rnd.Intn(2) == 0 {
+			return leaf(false)
+		}
+		return &rose{value: true, shrinks: func() []*rose { return []*rose{leaf(false)} }}
+	}}
+}
+
+func functionGenReturn(args []interface{}) interface{} {
+	value := args[0]
+	return &generator{generate: func(rnd *rand.Rand, size int) *rose {
+		return leaf(value)
+	}}
+}
+
+// shrinkList returns the tree of a list of elements, shrinking by removing
+// elements, down to min of them, and then by shrinking each element
+func shrinkList(elements []*rose, min int) *rose {
+	value := make([]interface{}, len(elements))
+	for i, element := range elements {
+		value[i] = element.value
+	}
+	return &rose{value: value, shrinks: func() []*rose {
+		children := []*rose{}
+		n := len(elements)
+		for k := n; k > 0 && n-k >= min; k /= 2 {
+			for i := 0; i+k <= n; i += k {
+				rest := append(append([]*rose{}, elements[:i]...), elements[i+k:]...)
+				children = append(children, shrinkList(rest, min))
+			}
+		}
+		for i, element := range elements {
+			for _, child := range element.shrinks() {
+				shrunk := append([]*rose{}, elements...)
+				shrunk[i] = child
+				children = append(children, shrinkList(shrunk, min))
+			}
+		}
+		return children
+	}}
+}
+
+// generateList generates up to size elements with g
+func generateList(g *generator, rnd *rand.Rand, size int) *rose {
+	elements := make([]*rose, rnd.Intn(size+1))
+	for i := range elements {
+		elements[i] = g.generate(rnd, size)
+	}
+	return shrinkList(elements, 0)
+}
+
+func functionGenList(args []interface{}) interface{} {
+	g := genArg("gen-list", args[0])
+	return &generator{generate: func(rnd *rand.Rand, size int) *rose {
+		return generateList(g, rnd, size)
+	}}
+}
+
+// genChar generates printable ASCII characters, shrinking to "a"
+var genChar = &generator{generate: func(rnd *rand.Rand, size int) *rose {
+	c := string(rune(' ' + rnd.Intn('~'-' '+1)))
+	if c == "a" {
+		return leaf(c)
+	}
+	return &rose{value: c, shrinks: func() []*rose { return []*rose{leaf("a")} }}
+}}
+
+func joinChars(value interface{}) interface{} {
+	s := ""
+	for _, c := range value.([]interface{}) {
+		s += c.(string)
+	}
+	return s
+}
+
+func functionGenString(args []interface{}) interface{} {
+	return &generator{generate: func(rnd *rand.Rand, size int) *rose {
+		return generateList(genChar, rnd, size).fmap(joinChars)
+	}}
+}
+
+// pairsToMap converts a list of [key, value] lists to a map
+func pairsToMap(value interface{}) interface{} {
+	m := map[string]interface{}{}
+	for _, pair := range value.([]interface{}) {
+		pair := pair.([]interface{})
+		key, ok := pair[0].(string)
+		if !ok {
+			panic(fmt.Errorf("gen-map keys must be strings (found %s)", safeJSON(pair[0])))
+		}
+		m[key] = pair[1]
+	}
+	return m
+}
+
+func generateMap(keys, values *generator, rnd *rand.Rand, size int) *rose {
+	pairs := &generator{generate: func(rnd *rand.Rand, size int) *rose {
+		return shrinkList([]*rose{keys.generate(rnd, size), values.generate(rnd, size)}, 2)
+	}}
+	return generateList(pairs, rnd, size).fmap(pairsToMap)
+}
+
+func functionGenMap(args []interface{}) interface{} {
+	keys, values := genArg("gen-map", args[0]), genArg("gen-map", args[1])
+	return &generator{generate: func(rnd *rand.Rand, size int) *rose {
+		return generateMap(keys, values, rnd, size)
+	}}
+}
+
+// genJSON generates JSON documents: scalars, and lists and maps of
+// documents half the size
+var genJSON *generator
+
+func init() {
+	scalars := []*generator{
+		functionGenReturn([]interface{}{nil}).(*generator),
+		functionGenBool(nil).(*generator),
+		functionGenInt(nil).(*generator),
+		functionGenString(nil).(*generator),
+	}
+	keys := functionGenString(nil).(*generator)
+	genJSON = &generator{generate: func(rnd *rand.Rand, size int) *rose {
+		if size < 2 || rnd.Intn(3) == 0 {
+			return scalars[rnd.Intn(len(scalars))].generate(rnd, size)
+		}
+		if rnd.Intn(2) == 0 {
+			return generateList(genJSON, rnd, size/2)
+		}
+		return generateMap(keys, genJSON, rnd, size/2)
+	}}
+}
+
+func functionGenJSON(args []interface{}) interface{} {
+	return genJSON
+}
+
+func functionGenFmap(args []interface{}) interface{} {
+	f, g := args[0], genArg("gen-fmap", args[1])
+	return &generator{generate: func(rnd *rand.Rand, size int) *rose {
+		return g.generate(rnd, size).fmap(func(value interface{}) interface{} {
+			return apply(f, []interface{}{value})
+		})
+	}}
+}
+
+func functionGenBind(args []interface{}) interface{} {
+	g, f := genArg("gen-bind", args[0]), args[1]
+	return &generator{generate: func(rnd *rand.Rand, size int) *rose {
+		// the generators f returns always get the same random source, so
+		// shrinking the value of g does not change the rest
+		seed := rnd.Int63()
+		return g.generate(rnd, size).bind(func(value interface{}) *rose {
+			inner := genArg("gen-bind fn result", apply(f, []interface{}{value}))
+			return inner.generate(rand.New(rand.NewSource(seed)), size)
+		})
+	}}
+}
+
+func functionOneOf(args []interface{}) interface{} {
+	list, ok := args[0].([]interface{})
+	if !ok || len(list) == 0 {
+		panic(fmt.Errorf("one-of requires a list of generators"))
+	}
+	gens := make([]*generator, len(list))
+	for i, g := range list {
+		gens[i] = genArg("one-of", g)
+	}
+	return &generator{generate: func(rnd *rand.Rand, size int) *rose {
+		return gens[rnd.Intn(len(gens))].generate(rnd, size)
+	}}
+}
+
+// suchThatTries is how many values such-that generates before giving up
+const suchThatTries = 100
+
+func functionSuchThat(args []interface{}) interface{} {
+	pred, g := args[0], genArg("such-that", args[1])
+	satisfies := func(value interface{}) bool {
+		return truthy(apply(pred, []interface{}{value}))
+	}
+	return &generator{generate: func(rnd *rand.Rand, size int) *rose {
+		for i := 0; i < suchThatTries; i++ {
+			r := g.generate(rnd, size+i)
+			if satisfies(r.value) {
+				return r.filter(satisfies)
+			}
+		}
+		panic(fmt.Errorf("such-that found no value satisfying its predicate in %d tries", suchThatTries))
+	}}
+}
+
+// property is the value of for-all: a fn and the generators of its
+// arguments
+type property struct {
+	gens []*generator
+	fn   interface{}
+}
+
+// generate returns the tree of a list of arguments for the fn
+func (p *property) generate(rnd *rand.Rand, size int) *rose {
+	args := make([]*rose, len(p.gens))
+	for i, g := range p.gens {
+		args[i] = g.generate(rnd, size)
+	}
+	return shrinkList(args, len(args))
+}
+
+func functionForAll(args []interface{}) interface{} {
+	p := &property{fn: args[1]}
+	switch gens := args[0].(type) {
+	case *generator:
+		p.gens = []*generator{gens}
+	case []interface{}:
+		for _, g := range gens {
+			p.gens = append(p.gens, genArg("for-all", g))
+		}
+	default:
+		panic(fmt.Errorf("for-all requires a generator or a list of generators"))
+	}
+	return p
+}
+
+// checkOptions are the options of quick-check
+type checkOptions struct {
+	numTests int64
+	seed     int64
+	maxSize  int64
+}
+
+func parseCheckOptions(arg interface{}) checkOptions {
+	opts := checkOptions{numTests: 100, seed: defaultSeed, maxSize: 100}
+	switch arg := arg.(type) {
+	case map[string]interface{}:
+		for key, value := range arg {
+			switch key {
+			case "num-tests":
+				opts.numTests = intArg(value)
+			case "seed":
+				opts.seed = intArg(value)
+			case "max-size":
+				opts.maxSize = intArg(value)
+			default:
+				panic(fmt.Errorf("unknown quick-check option %q", key))
+			}
+		}
+	default:
+		opts.numTests = intArg(arg)
+	}
+	if opts.numTests < 0 || opts.maxSize < 0 {
+		panic(fmt.Errorf("quick-check num-tests and max-size must not be negative"))
+	}
+	return opts
+}
+
+// quickCheck runs the property args[1] with the options args[0], a
+// number of tests or a map, and returns its results as a map
+func quickCheck(env *Environment, args []interface{}) interface{} {
+	opts := parseCheckOptions(args[0])
+	p, ok := args[1].(*property)
+	if !ok {
+		panic(fmt.Errorf("quick-check requires a for-all property"))
+	}
+
+	// holds reports whether the property holds for args, or returns why it
+	// fails: the falsy result, false or null, or the error message
+	holds := func(args interface{}) (ok bool, failure interface{}) {
+		defer func() {
+			if r := recover(); r != nil {
+				if env.ctx.isInterrupted() {
+					panic(r)
+				}
+				ok, failure = false, recoveredError(r).Error()
+			}
+		}()
+		if result := apply(p.fn, args.([]interface{})); !truthy(result) {
+			return false, result
+		}
+		return true, nil
+	}
+
+	rnd := rand.New(rand.NewSource(opts.seed))
+	for i := int64(0); i < opts.numTests; i++ {
+		size := i
+		if size > opts.maxSize {
+			size = opts.maxSize
+		}
+		tree := p.generate(rnd, int(size))
+		ok, failure := holds(tree.value)
+		if ok {
+			continue
+		}
+
+		// shrink, moving to the first smaller arguments that still fail
+		visited, depth := int64(0), int64(0)
+		smallest, smallestFailure := tree, failure
+		for shrinking := true; shrinking; {
+			shrinking = false
+			for _, child := range smallest.shrinks() {
+				visited++
+				if ok, f := holds(child.value); !ok {
+					smallest, smallestFailure = child, f
+					depth++
+					shrinking = true
+					break
+				}
+			}
+		}
+		return map[string]interface{}{
+			"pass?":     false,
+			"num-tests": i + 1,
+			"seed":      opts.seed,
+			"fail":      tree.value,
+			"result":    failure,
+			"shrunk": map[string]interface{}{
+				"smallest":            smallest.value,
+				"result":              smallestFailure,
+				"depth":               depth,
+				"total-nodes-visited": visited,
+			},
+		}
+	}
+	return map[string]interface{}{
+		"pass?":     true,
+		"num-tests": opts.numTests,
+		"seed":      opts.seed,
+	}
+}
+
+// functionSample returns args[1] values of the generator args[0], of
+// growing sizes
+func functionSample(args []interface{}) interface{} {
+	g := genArg("sample", args[0])
+	n := intArg(args[1])
+	if n < 0 {
+		panic(fmt.Errorf("sample requires a non negative count"))
+	}
+	rnd := rand.New(rand.NewSource(defaultSeed))
+	values := make([]interface{}, n)
+	for i := range values {
+		values[i] = g.generate(rnd, i).value
+	}
+	return values
+}
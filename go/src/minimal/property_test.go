@@ -0,0 +1,56 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"testing"
+)
+
+func TestQuickCheck(t *testing.T) {
+	tests := []struct {
+		form, want string
+	}{
+		// the example of the property.go header
+		{`["get", ["quick-check", 100,
+		   ["for-all", ["gen-list", ["gen-int"]],
+		     ["fn", ["l"], ["=", ["count", "l"], ["count", ["map", ["fn", ["x"], "x"], "l"]]]]]],
+		  ["` + "`" + `", "pass?"]]`,
+			`true`},
+		{`["get", ["quick-check", 100,
+		   ["for-all", ["gen-list", ["gen-int"]], ["fn", ["l"], ["<", ["count", "l"], 3]]]],
+		  ["` + "`" + `", "shrunk"]]`,
+			`{"depth":3,"result":false,"smallest":[[0,0,0]],"total-nodes-visited":19}`},
+		{`["get", ["get", ["quick-check", {"seed": 7},
+		   ["for-all", ["list", ["gen-int"], ["gen-int", 0, 20]],
+		     ["fn", ["a", "b"], ["<", ["+", "a", "b"], 10]]]],
+		  ["` + "`" + `", "shrunk"]], ["` + "`" + `", "smallest"]]`,
+			`[0,10]`},
+		// null is falsy, so a property returning it fails
+		{`["get", ["quick-check", 10,
+		   ["for-all", ["gen-int"], ["fn", ["x"], null]]],
+		  ["` + "`" + `", "pass?"]]`,
+			`false`},
+		{`["get", ["quick-check", 10,
+		   ["for-all", ["gen-int"], ["fn", ["x"], ["first", "x"]]]],
+		  ["` + "`" + `", "result"]]`,
+			`"first argument must be a list"`},
+		{`["get", ["quick-check", 100,
+		   ["for-all", ["such-that", ["fn", ["x"], [">", "x", 0]], ["gen-int"]],
+		     ["fn", ["x"], [">", "x", 0]]]],
+		  ["` + "`" + `", "pass?"]]`,
+			`true`},
+		{`["sample", ["gen-bind", ["gen-int", 1, 3],
+		   ["fn", ["n"], ["gen-fmap", ["fn", ["s"], ["list", "n", "s"]], ["gen-string"]]]], 4]`,
+			`[[2,""],[3,""],[3,""],[3,"w#{"]]`},
+	}
+	for _, backend := range []string{"tree", "resolved", "compiled", "bytecode"} {
+		env := newSymbolTable(&options{backend: backend}, []string{})
+		for _, test := range tests {
+			if got := JSON(evaluate(READ(test.form), env)); got != test.want {
+				t.Errorf("%s: %s\ngot  %s\nwant %s", backend, test.form, got, test.want)
+			}
+		}
+	}
+}
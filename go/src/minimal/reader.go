@@ -0,0 +1,190 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"weak"
+)
+
+// Position is the place of a form inside a source file
+type Position struct {
+	File string
+	Line int
+	Col  int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+// positions maps the first element of every list read from a source file
+// to its place in that file. Lists are keyed by the address of their first
+// element so the AST keeps its plain []interface{} representation. The
+// keys are weak, and an entry is deleted once its list is collected, so
+// the REPL and the servers reading sources for ever keep only the
+// positions of the ASTs they still hold.
+var positions = struct {
+	sync.RWMutex
+	m map[weak.Pointer[interface{}]]Position
+}{m: map[weak.Pointer[interface{}]]Position{}}
+
+// PositionOf returns the source position of a list read by readSource
+func PositionOf(ast interface{}) (Position, bool) {
+	list, ok := ast.([]interface{})
+	if !ok || len(list) == 0 {
+		return Position{}, false
+	}
+	positions.RLock()
+	defer positions.RUnlock()
+	pos, ok := positions.m[weak.Make(&list[0])]
+	return pos, ok
+}
+
+func setPosition(list []interface{}, pos Position) {
+	if len(list) == 0 {
+		return
+	}
+	key := weak.Make(&list[0])
+	positions.Lock()
+	_, known := positions.m[key]
+	positions.m[key] = pos
+	positions.Unlock()
+	if !known {
+		runtime.AddCleanup(&list[0], forgetPosition, key)
+	}
+}
+
+// forgetPosition deletes the position of a list collected
+func forgetPosition(key weak.Pointer[interface{}]) {
+	positions.Lock()
+	delete(positions.m, key)
+	positions.Unlock()
+}
+
+// sourceReader decodes a JSON document token by token, recording where
+// each list starts
+type sourceReader struct {
+	dec        *json.Decoder
+	file       string
+	mode       readMode
+	lineStarts []int
+}
+
+// readSource parses the contents of a source file like READ does, with
+// the given read mode, and records the position of every list it reads
+func readSource(str string, file string, mode readMode) interface{} {
+	str = stripComments(str)
+	r := &sourceReader{
+		dec:        json.NewDecoder(strings.NewReader(str)),
+		file:       file,
+		mode:       mode,
+		lineStarts: []int{0},
+	}
+	for i, c := range str {
+		if c == '\n' {
+			r.lineStarts = append(r.lineStarts, i+1)
+		}
+	}
+	r.dec.UseNumber()
+
+	tok, err := r.dec.Token()
+	if err == io.EOF {
+		panic(fmt.Errorf("Cannot unmarshal: empty source %s", file))
+	}
+	if err != nil {
+		panic(err)
+	}
+	return r.form(tok, false)
+}
+
+// stripComments blanks the ; comments of a source file, which run to the
+// end of the line, keeping the offsets of everything else
+func stripComments(str string) string {
+	if strings.IndexByte(str, ';') < 0 {
+		return str
+	}
+	b := []byte(str)
+	inString := false
+	for i := 0; i < len(b); i++ {
+		switch {
+		case inString && b[i] == '\\':
+			i++
+		case b[i] == '"':
+			inString = !inString
+		case !inString && b[i] == ';':
+			for ; i < len(b) && b[i] != '\n'; i++ {
+				b[i] = ' '
+			}
+		}
+	}
+	return string(b)
+}
+
+func (r *sourceReader) position(offset int64) Position {
+	line := sort.Search(len(r.lineStarts), func(i int) bool {
+		return int64(r.lineStarts[i]) > offset
+	})
+	return Position{
+		File: r.file,
+		Line: line,
+		Col:  int(offset) - r.lineStarts[line-1] + 1,
+	}
+}
+
+func (r *sourceReader) next() json.Token {
+	tok, err := r.dec.Token()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		panic(err)
+	}
+	return tok
+}
+
+// form reads the value starting with tok. quoted is true inside quoted
+// forms and maps, as in symbolize.
+func (r *sourceReader) form(tok json.Token, quoted bool) interface{} {
+	switch tok := tok.(type) {
+	case json.Delim:
+		switch tok {
+		case '[':
+			pos := r.position(r.dec.InputOffset() - 1)
+			list := []interface{}{}
+			for r.dec.More() {
+				list = append(list, r.form(r.next(), quoted))
+				if len(list) == 1 && list[0] == symQuote {
+					quoted = true
+				}
+			}
+			r.next()
+			setPosition(list, pos)
+			return list
+		case '{':
+			hashMap := map[string]interface{}{}
+			for r.dec.More() {
+				key := r.next().(string)
+				hashMap[key] = r.form(r.next(), true)
+			}
+			r.next()
+			return hashMap
+		default:
+			panic(fmt.Errorf("Cannot unmarshal: unexpected %q", tok))
+		}
+	case json.Number:
+		return parseNumber(string(tok))
+	case string:
+		return r.mode.atom(tok, quoted)
+	default:
+		return tok
+	}
+}
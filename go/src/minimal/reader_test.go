@@ -0,0 +1,40 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func countPositions() int {
+	positions.RLock()
+	defer positions.RUnlock()
+	return len(positions.m)
+}
+
+func TestPositionsFreed(t *testing.T) {
+	src := `["do", ["def", "f", ["fn", ["x"], ["+", "x", 1]]], ["f", 2]]`
+	ast := readSource(src, "kept.json", readCompat)
+	if pos, ok := PositionOf(ast.([]interface{})[1]); !ok || pos.String() != "kept.json:1:8" {
+		t.Errorf("position %v, %v", pos, ok)
+	}
+	before := countPositions()
+	for i := 0; i < 1000; i++ {
+		readSource(src, "dropped.json", readCompat)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for countPositions() > before && time.Now().Before(deadline) {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := countPositions(); n > before {
+		t.Errorf("%d positions kept, %d before reading the dropped sources", n, before)
+	}
+	if _, ok := PositionOf(ast); !ok {
+		t.Errorf("the position of a live AST was dropped")
+	}
+}
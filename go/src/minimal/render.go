@@ -0,0 +1,251 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// renderExt is a repeatable name=value flag of the render command, which
+// keeps the variables in the order of the flags
+type renderExt []renderVar
+
+// renderVar is an external variable of the render command
+type renderVar struct {
+	name, value string
+}
+
+func (e *renderExt) String() string {
+	pairs := []string{}
+	for _, v := range *e {
+		pairs = append(pairs, v.name+"="+v.value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (e *renderExt) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("external variable must be written as name=value")
+	}
+	*e = append(*e, renderVar{value[:i], value[i+1:]})
+	return nil
+}
+
+// cmdRender implements the render command: it evaluates a program and
+// writes its final value as canonical JSON or YAML
+func cmdRender(opts *options, args []string) int {
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	format := flags.String("format", "json", "output format: json or yaml")
+	output := flags.String("o", "", "output file (default stdout)")
+	var extStr, extCode renderExt
+	flags.Var(&extStr, "ext-str", "external string variable name=value (can be repeated)")
+	flags.Var(&extCode, "ext-code", "external variable name=form, evaluated in order after the strings (can be repeated)")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "render requires exactly one file")
+		return exitUsage
+	}
+
+	var write func(io.Writer, interface{})
+	switch *format {
+	case "json":
+		write = writeCanonicalJSON
+	case "yaml", "yml":
+		write = writeYAML
+	default:
+		fmt.Fprintf(os.Stderr, "unknown render format %q\n", *format)
+		return exitUsage
+	}
+
+	symbolTable := newSymbolTable(opts, []string{})
+	ext := map[string]interface{}{}
+	for _, v := range extStr {
+		ext[v.name] = v.value
+	}
+	symbolTable.Set("ext-var", args1(func(args []interface{}) interface{} {
+		name := castString(args[0])
+		value, ok := ext[name]
+		if !ok {
+			panic(fmt.Errorf("undefined external variable %q", name))
+		}
+		return value
+	}))
+
+	file := flags.Arg(0)
+	result, err := evalWithOptions(opts, symbolTable, func() interface{} {
+		for _, v := range extCode {
+			ext[v.name] = evaluate(symbolTable.Read(v.value), symbolTable)
+		}
+		return evaluate([]interface{}{Intern("load"), file}, symbolTable)
+	})
+	if err != nil {
+		return exitStatus(err)
+	}
+	if err := checkSerializable(result, "$"); err != nil {
+		return exitStatus(err)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return exitStatus(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	write(w, result)
+	return exitOK
+}
+
+// checkSerializable returns an error naming the first value inside ast that
+// has no JSON representation
+func checkSerializable(ast interface{}, path string) error {
+	switch ast := ast.(type) {
+	case float64:
+		if math.IsInf(ast, 0) || math.IsNaN(ast) {
+			return fmt.Errorf("cannot render %v value at %s", ast, path)
+		}
+		return nil
+	case nil, bool, string, json.Number, int64, int, *big.Int, *Symbol, *Keyword:
+		return nil
+	case []string:
+		return nil
+	case []interface{}:
+		for i, value := range ast {
+			if err := checkSerializable(value, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]interface{}:
+		for key, value := range ast {
+			if err := checkSerializable(value, fmt.Sprintf("%s[%q]", path, key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case tcoFN, *closure, *compiledFn, *vmClosure, func([]interface{}) interface{}:
+		return fmt.Errorf("cannot render function value at %s", path)
+	default:
+		return fmt.Errorf("cannot render %T value at %s", ast, path)
+	}
+}
+
+func writeCanonicalJSON(w io.Writer, ast interface{}) {
+	// encoding/json already writes map keys in sorted order
+	b, err := json.MarshalIndent(ast, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(w, "%s\n", b)
+}
+
+func writeYAML(w io.Writer, ast interface{}) {
+	switch ast.(type) {
+	case []interface{}, []string, map[string]interface{}:
+		writeYAMLBlock(w, ast, "")
+	default:
+		fmt.Fprintf(w, "%s\n", yamlScalar(ast))
+	}
+}
+
+// yamlPlain matches the strings that can be written without quotes
+var yamlPlain = regexp.MustCompile(`^[A-Za-z_/][A-Za-z0-9_./-]*( [A-Za-z0-9_./-]+)*$`)
+
+// yamlReserved are the plain scalars a YAML parser would not read as strings
+var yamlReserved = map[string]bool{
+	"true": true, "false": true, "null": true, "yes": true, "no": true,
+	"on": true, "off": true, "y": true, "n": true,
+}
+
+func yamlScalar(ast interface{}) string {
+	switch ast := ast.(type) {
+	case nil:
+		return "null"
+	case string:
+		if yamlPlain.MatchString(ast) && !yamlReserved[strings.ToLower(ast)] {
+			return ast
+		}
+		// a JSON string is a valid YAML double quoted scalar
+		return JSON(ast)
+	case *Symbol, *Keyword:
+		return yamlScalar(fmt.Sprint(ast))
+	case []interface{}:
+		return "[]"
+	case []string:
+		return "[]"
+	case map[string]interface{}:
+		return "{}"
+	default:
+		return JSON(ast)
+	}
+}
+
+func isYAMLBlock(ast interface{}) bool {
+	switch ast := ast.(type) {
+	case []interface{}:
+		return len(ast) > 0
+	case []string:
+		return len(ast) > 0
+	case map[string]interface{}:
+		return len(ast) > 0
+	default:
+		return false
+	}
+}
+
+func writeYAMLBlock(w io.Writer, ast interface{}, indent string) {
+	switch ast := ast.(type) {
+	case []string:
+		list := make([]interface{}, len(ast))
+		for i, s := range ast {
+			list[i] = s
+		}
+		writeYAMLBlock(w, list, indent)
+	case []interface{}:
+		if len(ast) == 0 {
+			fmt.Fprintf(w, "%s[]\n", indent)
+		}
+		for _, value := range ast {
+			if isYAMLBlock(value) {
+				fmt.Fprintf(w, "%s-\n", indent)
+				writeYAMLBlock(w, value, indent+"  ")
+			} else {
+				fmt.Fprintf(w, "%s- %s\n", indent, yamlScalar(value))
+			}
+		}
+	case map[string]interface{}:
+		if len(ast) == 0 {
+			fmt.Fprintf(w, "%s{}\n", indent)
+		}
+		keys := make([]string, 0, len(ast))
+		for key := range ast {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := ast[key]
+			if isYAMLBlock(value) {
+				fmt.Fprintf(w, "%s%s:\n", indent, yamlScalar(key))
+				writeYAMLBlock(w, value, indent+"  ")
+			} else {
+				fmt.Fprintf(w, "%s%s: %s\n", indent, yamlScalar(key), yamlScalar(value))
+			}
+		}
+	}
+}
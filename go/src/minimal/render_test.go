@@ -0,0 +1,113 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const renderProgram = `["do",
+  ["set", ["set", ["set", ["set", ["set", ["set",
+    {},
+    ["` + "`" + `", "name"], ["ext-var", ["` + "`" + `", "name"]]],
+    ["` + "`" + `", "replicas"], ["ext-var", ["` + "`" + `", "replicas"]]],
+    ["` + "`" + `", "ports"], ["list", 80, 443]],
+    ["` + "`" + `", "empty"], ["list"]],
+    ["` + "`" + `", "on"], true],
+    ["` + "`" + `", "labels"], ["set", {}, ["` + "`" + `", "tier"], ["` + "`" + `", "web app"]]]]
+`
+
+func TestRender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minimal-render")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, src := range map[string]string{
+		"service.json": renderProgram,
+		"fn.json":      `["list", 1, ["fn", [], 1]]`,
+		"x.json":       `["ext-var", ["` + "`" + `", "x"]]`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		args           []string
+		stdout, stderr string
+		status         int
+	}{
+		{[]string{"render", "-ext-str", "name=api", "-ext-code", "replicas=3", "service.json"},
+			"{\n  \"empty\": [],\n  \"labels\": {\n    \"tier\": \"web app\"\n  },\n  \"name\": \"api\",\n  \"on\": true,\n  \"ports\": [\n    80,\n    443\n  ],\n  \"replicas\": 3\n}\n", "", exitOK},
+		{[]string{"render", "-format", "yaml", "-ext-str", "name=true", "-ext-code", "replicas=2.5", "service.json"},
+			"empty: []\nlabels:\n  tier: web app\nname: \"true\"\n\"on\": true\nports:\n  - 80\n  - 443\nreplicas: 2.5\n", "", exitOK},
+		// the ext-codes run in the order of the flags
+		{[]string{"render", "-ext-code", `a=["def", "n", 1]`, "-ext-code", `b=["def", "n", ["+", "n", 1]]`, "-ext-code", `x=["*", "n", 10]`, "x.json"},
+			"20\n", "", exitOK},
+		{[]string{"render", "-ext-str", "x=1", "-ext-str", "x=2", "x.json"}, "\"2\"\n", "", exitOK},
+		{[]string{"render", "x.json"}, "", "error: undefined external variable \"x\"\n", exitError},
+		{[]string{"render", "fn.json"}, "", "error: cannot render function value at $[1]\n", exitError},
+		{[]string{"render", "-ext-str", "novalue", "x.json"}, "", "", exitUsage},
+		{[]string{"render", "-format", "toml", "x.json"}, "", "unknown render format \"toml\"\n", exitUsage},
+		{[]string{"render"}, "", "render requires exactly one file\n", exitUsage},
+	} {
+		stdout, stderr, status := runMinimal(t, dir, "", test.args...)
+		if test.status == exitUsage && test.stderr == "" {
+			stderr = ""
+		}
+		if stdout != test.stdout || stderr != test.stderr || status != test.status {
+			t.Errorf("minimal %s: status %d, stdout %q, stderr %q\nwant status %d, stdout %q, stderr %q",
+				strings.Join(test.args, " "), status, stdout, stderr, test.status, test.stdout, test.stderr)
+		}
+	}
+}
+
+func TestYAMLScalars(t *testing.T) {
+	for _, test := range []struct {
+		value interface{}
+		want  string
+	}{
+		{nil, "null\n"},
+		{"plain", "plain\n"},
+		{"no", "\"no\"\n"},
+		{"a: b", "\"a: b\"\n"},
+		{"", "\"\"\n"},
+		{int64(-3), "-3\n"},
+		{[]interface{}{}, "[]\n"},
+		{[]interface{}{[]interface{}{int64(1)}, "x"}, "-\n  - 1\n- x\n"},
+		{map[string]interface{}{"1": "Off"}, "\"1\": \"Off\"\n"},
+	} {
+		var out bytes.Buffer
+		writeYAML(&out, test.value)
+		if out.String() != test.want {
+			t.Errorf("yaml of %#v: %q, want %q", test.value, out.String(), test.want)
+		}
+	}
+}
+
+func TestCheckSerializable(t *testing.T) {
+	for _, test := range []struct {
+		value interface{}
+		want  string
+	}{
+		{map[string]interface{}{"a": []interface{}{int64(1), 2.5, "x", nil}}, ""},
+		{[]interface{}{int64(1), math.Inf(1)}, "cannot render +Inf value at $[1]"},
+		{map[string]interface{}{"a": math.Inf(-1)}, `cannot render -Inf value at $["a"]`},
+		{math.NaN(), "cannot render NaN value at $"},
+	} {
+		err := checkSerializable(test.value, "$")
+		if got := fmt.Sprint(err); test.want == "" && err != nil || test.want != "" && got != test.want {
+			t.Errorf("checkSerializable(%v) = %v, want %q", test.value, err, test.want)
+		}
+	}
+}
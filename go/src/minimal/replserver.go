@@ -0,0 +1,531 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ReplServer evaluates the forms sent by REPL clients in a live
+// Environment, in the style of nREPL. Clients send JSON messages, one per
+// line, with an op, an id and usually a session, and get one or more
+// messages back with the same id, the last one with the status "done".
+//
+// An Environment is not safe for concurrent use, so the server evaluates
+// one form at a time, in the order the eval messages arrive, and the
+// program embedding it must not evaluate in the Environment while it
+// serves.
+type ReplServer struct {
+	env *Environment
+	// evalMu guards the Environment against the ops reading it while an
+	// evaluation runs
+	evalMu sync.Mutex
+	// mu guards the sessions and lastEval
+	mu       sync.Mutex
+	sessions map[string]*replSession
+	lastID   int
+	// lastEval is closed when the last eval queued ends, nil when no eval
+	// was queued
+	lastEval chan struct{}
+}
+
+// replSession is a client of the server. Its evaluations are interrupted
+// by the interrupt op.
+type replSession struct {
+	id string
+	// running is the id of the eval message of the session being
+	// evaluated, empty when idle
+	running string
+}
+
+// replRequest is a message sent by a client
+type replRequest struct {
+	Op          string `json:"op"`
+	ID          string `json:"id"`
+	Session     string `json:"session"`
+	Code        string `json:"code"`
+	Prefix      string `json:"prefix"`
+	InterruptID string `json:"interrupt-id"`
+}
+
+// errInterrupted is the reason of the evaluations stopped by the
+// interrupt op
+var errInterrupted = errors.New("evaluation interrupted")
+
+// replOps are the ops the server supports, as describe lists them
+var replOps = []string{"clone", "close", "completions", "describe", "eval", "interrupt", "ls-sessions"}
+
+// NewReplServer returns a server evaluating in env
+func NewReplServer(env *Environment) *ReplServer {
+	return &ReplServer{env: env, sessions: map[string]*replSession{}}
+}
+
+// ListenREPL listens on addr for REPL clients: a Unix socket written as
+// unix:path or a TCP address, which must be on the loopback interface as
+// clients can run any code
+func ListenREPL(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		return net.Listen("unix", path)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host != "localhost" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("the REPL server only listens on localhost (was %s)", addr)
+		}
+	}
+	return net.Listen("tcp", addr)
+}
+
+// dialREPL connects to a server listening on addr, written as for
+// ListenREPL
+func dialREPL(addr string) (net.Conn, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		return net.Dial("unix", path)
+	}
+	return net.Dial("tcp", addr)
+}
+
+// Serve handles the clients connecting to l until it is closed
+func (s *ReplServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// replConn writes the messages of a client
+type replConn struct {
+	sync.Mutex
+	enc *json.Encoder
+}
+
+func (c *replConn) send(request *replRequest, message map[string]interface{}) {
+	message["id"] = request.ID
+	if request.Session != "" {
+		message["session"] = request.Session
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.enc.Encode(message)
+}
+
+// done sends the last message of a request with the status given
+func (c *replConn) done(request *replRequest, message map[string]interface{}, status ...string) {
+	message["status"] = append(status, "done")
+	c.send(request, message)
+}
+
+func (s *ReplServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	c := &replConn{enc: json.NewEncoder(conn)}
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		request := &replRequest{}
+		if err := dec.Decode(request); err != nil {
+			if err != io.EOF {
+				c.done(request, map[string]interface{}{"ex": err.Error()}, "error")
+			}
+			return
+		}
+		s.handle(c, request)
+	}
+}
+
+func (s *ReplServer) session(id string) *replSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[id]
+}
+
+func (s *ReplServer) handle(c *replConn, request *replRequest) {
+	session := s.session(request.Session)
+	if request.Session != "" && session == nil {
+		c.done(request, map[string]interface{}{}, "error", "unknown-session")
+		return
+	}
+	switch request.Op {
+	case "clone":
+		s.mu.Lock()
+		s.lastID++
+		id := strconv.Itoa(s.lastID)
+		s.sessions[id] = &replSession{id: id}
+		s.mu.Unlock()
+		c.done(request, map[string]interface{}{"new-session": id})
+	case "close":
+		s.mu.Lock()
+		delete(s.sessions, request.Session)
+		s.mu.Unlock()
+		c.done(request, map[string]interface{}{}, "session-closed")
+	case "ls-sessions":
+		s.mu.Lock()
+		ids := []string{}
+		for id := range s.sessions {
+			ids = append(ids, id)
+		}
+		s.mu.Unlock()
+		sort.Strings(ids)
+		c.done(request, map[string]interface{}{"sessions": ids})
+	case "describe":
+		ops := map[string]interface{}{}
+		for _, op := range replOps {
+			ops[op] = map[string]interface{}{}
+		}
+		c.done(request, map[string]interface{}{
+			"ops":      ops,
+			"versions": map[string]interface{}{"go": runtime.Version()},
+		})
+	case "eval":
+		if session == nil {
+			// an eval without session runs in a session of its own
+			session = &replSession{}
+		}
+		// each eval waits for the one queued before it, off the reading
+		// loop so that an interrupt can reach the one running
+		s.mu.Lock()
+		previous, done := s.lastEval, make(chan struct{})
+		s.lastEval = done
+		s.mu.Unlock()
+		go func() {
+			defer close(done)
+			if previous != nil {
+				<-previous
+			}
+			s.eval(c, request, session)
+		}()
+	case "interrupt":
+		if session == nil {
+			c.done(request, map[string]interface{}{}, "error", "unknown-session")
+			return
+		}
+		s.mu.Lock()
+		running := session.running
+		if running != "" && (request.InterruptID == "" || request.InterruptID == running) {
+			s.env.Interrupt(errInterrupted)
+			s.mu.Unlock()
+			c.done(request, map[string]interface{}{})
+			return
+		}
+		s.mu.Unlock()
+		c.done(request, map[string]interface{}{}, "session-idle")
+	case "completions":
+		c.done(request, map[string]interface{}{"completions": s.completions(request.Prefix)})
+	default:
+		c.done(request, map[string]interface{}{}, "error", "unknown-op")
+	}
+}
+
+// replOutput sends what an evaluation prints to *out* or *err* to its
+// client, in messages with key
+type replOutput struct {
+	c       *replConn
+	request *replRequest
+	key     string
+}
+
+func (o replOutput) Write(p []byte) (int, error) {
+	o.c.send(o.request, map[string]interface{}{o.key: string(p)})
+	return len(p), nil
+}
+
+// eval evaluates the code of request
+func (s *ReplServer) eval(c *replConn, request *replRequest, session *replSession) {
+	s.evalMu.Lock()
+	defer s.evalMu.Unlock()
+	s.mu.Lock()
+	session.running = request.ID
+	s.mu.Unlock()
+	out, errOut, in := s.env.ctx.out, s.env.ctx.err, s.env.ctx.in
+	s.env.SetOutput(replOutput{c: c, request: request, key: "out"})
+	s.env.SetError(replOutput{c: c, request: request, key: "err"})
+	// clients have no input to read
+	s.env.SetInput(strings.NewReader(""))
+	// the value is printed inside the recover, as values like functions
+	// cannot be written as JSON
+	value, err := func() (value string, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = recoveredError(r)
+			}
+		}()
+		return JSON(evaluate(s.env.Read(request.Code), s.env)), nil
+	}()
+	s.env.ctx.out, s.env.ctx.err, s.env.ctx.in = out, errOut, in
+	s.mu.Lock()
+	session.running = ""
+	s.env.ctx.reset()
+	s.mu.Unlock()
+
+	switch {
+	case err == errInterrupted:
+		c.done(request, map[string]interface{}{}, "interrupted")
+	case err != nil:
+		c.done(request, map[string]interface{}{"ex": err.Error()}, "eval-error")
+	default:
+		c.send(request, map[string]interface{}{"value": value})
+		c.done(request, map[string]interface{}{})
+	}
+}
+
+// completions returns the symbols of the Environment and the special
+// forms starting with prefix
+func (s *ReplServer) completions(prefix string) []interface{} {
+	candidates := map[string]string{}
+	for _, name := range []string{"def", "fn", "let", "if", "do", "`"} {
+		candidates[name] = "special-form"
+	}
+	s.evalMu.Lock()
+	for env := s.env; env != nil; env = env.Parent {
+		for symbol, value := range env.Scope {
+			if _, ok := candidates[symbol.name]; ok {
+				continue
+			}
+			candidates[symbol.name] = "var"
+			if isFunction(value) {
+				candidates[symbol.name] = "function"
+			}
+		}
+	}
+	s.evalMu.Unlock()
+	names := []string{}
+	for name := range candidates {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	completions := []interface{}{}
+	for _, name := range names {
+		completions = append(completions, map[string]interface{}{"candidate": name, "type": candidates[name]})
+	}
+	return completions
+}
+
+// cmdServe implements the serve command
+func cmdServe(opts *options, args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	listen := flags.String("listen", "localhost:7888", "address to listen on: host:port on localhost or unix:path")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	symbolTable := newSymbolTable(opts, []string{})
+	for _, file := range flags.Args() {
+		_, err := evalWithOptions(opts, symbolTable, func() interface{} {
+			return evaluate([]interface{}{Intern("load"), file}, symbolTable)
+		})
+		if err != nil {
+			return exitStatus(err)
+		}
+	}
+	l, err := ListenREPL(*listen)
+	if err != nil {
+		return exitStatus(err)
+	}
+	fmt.Fprintf(os.Stderr, "REPL server listening on %s\n", *listen)
+	return exitStatus(NewReplServer(symbolTable).Serve(l))
+}
+
+// replClient talks to a ReplServer in a session of its own
+type replClient struct {
+	conn    net.Conn
+	dec     *json.Decoder
+	mu      sync.Mutex
+	enc     *json.Encoder
+	lastID  int
+	session string
+}
+
+func newReplClient(conn net.Conn) (*replClient, error) {
+	c := &replClient{conn: conn, dec: json.NewDecoder(bufio.NewReader(conn)), enc: json.NewEncoder(conn)}
+	err := c.request(map[string]interface{}{"op": "clone"}, func(message map[string]interface{}) {
+		c.session, _ = message["new-session"].(string)
+	})
+	return c, err
+}
+
+// send sends a message with a new id and returns the id
+func (c *replClient) send(message map[string]interface{}) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastID++
+	id := strconv.Itoa(c.lastID)
+	message["id"] = id
+	if c.session != "" {
+		message["session"] = c.session
+	}
+	c.enc.Encode(message)
+	return id
+}
+
+// request sends a message and passes its responses to each until the
+// one with the status "done"
+func (c *replClient) request(message map[string]interface{}, each func(map[string]interface{})) error {
+	id := c.send(message)
+	for {
+		response := map[string]interface{}{}
+		if err := c.dec.Decode(&response); err != nil {
+			return err
+		}
+		if response["id"] != id {
+			continue
+		}
+		each(response)
+		if status, _ := response["status"].([]interface{}); len(status) > 0 {
+			for _, s := range status {
+				if s == "done" {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// hasStatus reports whether a response has status
+func hasStatus(response map[string]interface{}, status string) bool {
+	list, _ := response["status"].([]interface{})
+	for _, s := range list {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+const connectHelp = `:complete prefix   list the symbols starting with prefix
+:describe          show the ops of the server
+:sessions          list the sessions of the server
+Ctrl-C interrupts the evaluation running
+`
+
+// connectREPL reads forms from in and evaluates them in the server until
+// the end of in. Lines starting with : are commands of the client.
+func connectREPL(c *replClient, in *bufio.Reader, out, errOut io.Writer) int {
+	for {
+		fmt.Fprint(out, "> ")
+		line, err := in.ReadString('\n')
+		if err == io.EOF {
+			fmt.Fprintln(out)
+			return exitOK
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var message map[string]interface{}
+		var each func(map[string]interface{})
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case ":complete":
+			prefix := ""
+			if len(fields) > 1 {
+				prefix = fields[1]
+			}
+			message = map[string]interface{}{"op": "completions", "prefix": prefix}
+			each = func(response map[string]interface{}) {
+				completions, _ := response["completions"].([]interface{})
+				for _, completion := range completions {
+					completion := completion.(map[string]interface{})
+					fmt.Fprintf(out, "%s (%s)\n", completion["candidate"], completion["type"])
+				}
+			}
+		case ":describe":
+			message = map[string]interface{}{"op": "describe"}
+			each = func(response map[string]interface{}) {
+				ops, _ := response["ops"].(map[string]interface{})
+				names := []string{}
+				for name := range ops {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				fmt.Fprintf(out, "ops: %s\n", strings.Join(names, " "))
+			}
+		case ":sessions":
+			message = map[string]interface{}{"op": "ls-sessions"}
+			each = func(response map[string]interface{}) {
+				sessions, _ := response["sessions"].([]interface{})
+				for _, session := range sessions {
+					fmt.Fprintln(out, session)
+				}
+			}
+		case ":help":
+			fmt.Fprint(out, connectHelp)
+			continue
+		default:
+			if strings.HasPrefix(line, ":") {
+				fmt.Fprintf(errOut, "error: unknown command %s\n", fields[0])
+				continue
+			}
+			message = map[string]interface{}{"op": "eval", "code": line}
+			each = func(response map[string]interface{}) {
+				if text, ok := response["out"].(string); ok {
+					fmt.Fprint(out, text)
+				}
+				if value, ok := response["value"].(string); ok {
+					fmt.Fprintln(out, value)
+				}
+				if text, ok := response["err"].(string); ok {
+					fmt.Fprint(errOut, text)
+				}
+				if text, ok := response["ex"].(string); ok {
+					fmt.Fprintf(errOut, "error: %s\n", text)
+				}
+				if hasStatus(response, "interrupted") {
+					fmt.Fprintln(errOut, "error: interrupted")
+				}
+			}
+		}
+		if err := c.request(message, each); err != nil {
+			fmt.Fprintf(errOut, "error: %s\n", err)
+			return exitError
+		}
+	}
+}
+
+// cmdConnect implements the connect command
+func cmdConnect(opts *options, args []string) int {
+	flags := flag.NewFlagSet("connect", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "connect requires the address of a REPL server")
+		return exitUsage
+	}
+	conn, err := dialREPL(flags.Arg(0))
+	if err != nil {
+		return exitStatus(err)
+	}
+	defer conn.Close()
+	c, err := newReplClient(conn)
+	if err != nil {
+		return exitStatus(err)
+	}
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		for range interrupts {
+			c.send(map[string]interface{}{"op": "interrupt"})
+		}
+	}()
+	return connectREPL(c, stdin, os.Stdout, os.Stderr)
+}
@@ -0,0 +1,195 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startReplServer serves a new Environment on a Unix socket and returns a
+// client connected to it
+func startReplServer(t *testing.T) (*replClient, func()) {
+	dir, err := ioutil.TempDir("", "minimal-repl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "unix:" + filepath.Join(dir, "repl.sock")
+	l, err := ListenREPL(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewReplServer(newSymbolTable(&options{backend: "tree"}, []string{})).Serve(l)
+	conn, err := dialREPL(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newReplClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, func() {
+		conn.Close()
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// replEval evaluates code and returns the responses with their ids removed
+func replEval(t *testing.T, c *replClient, message map[string]interface{}) []string {
+	t.Helper()
+	responses := []string{}
+	err := c.request(message, func(response map[string]interface{}) {
+		delete(response, "id")
+		delete(response, "session")
+		responses = append(responses, toJSON(response))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return responses
+}
+
+func TestReplServer(t *testing.T) {
+	c, stop := startReplServer(t)
+	defer stop()
+	if c.session != "1" {
+		t.Errorf("session %q", c.session)
+	}
+
+	for _, test := range []struct {
+		message map[string]interface{}
+		want    string
+	}{
+		{map[string]interface{}{"op": "eval", "code": `["do", ["println", 1, 2], ["def", "x", 40], ["+", "x", 2]]`},
+			`{"out":"12\n"} {"value":"42"} {"status":["done"]}`},
+		{map[string]interface{}{"op": "eval", "code": `["*", "x", 2]`},
+			`{"value":"80"} {"status":["done"]}`},
+		{map[string]interface{}{"op": "eval", "code": `["do", ["eprintln", 3], ["read-line"]]`},
+			`{"err":"3\n"} {"value":"null"} {"status":["done"]}`},
+		{map[string]interface{}{"op": "eval", "code": `["first", 1]`},
+			`{"ex":"first argument must be a list","status":["eval-error","done"]}`},
+		{map[string]interface{}{"op": "eval", "code": `"+"`},
+			`{"ex":"json: unsupported type: func([]interface {}) interface {}","status":["eval-error","done"]}`},
+		{map[string]interface{}{"op": "eval", "code": `["*", 1e308, 10]`},
+			`{"ex":"float overflow","status":["eval-error","done"]}`},
+		{map[string]interface{}{"op": "eval", "code": `["+", 1`},
+			`{"ex":"unexpected EOF","status":["eval-error","done"]}`},
+		{map[string]interface{}{"op": "completions", "prefix": "fir"},
+			`{"completions":[{"candidate":"first","type":"function"}],"status":["done"]}`},
+		{map[string]interface{}{"op": "completions", "prefix": "x"},
+			`{"completions":[{"candidate":"x","type":"var"}],"status":["done"]}`},
+		{map[string]interface{}{"op": "completions", "prefix": "le"},
+			`{"completions":[{"candidate":"let","type":"special-form"}],"status":["done"]}`},
+		{map[string]interface{}{"op": "interrupt"},
+			`{"status":["session-idle","done"]}`},
+		{map[string]interface{}{"op": "ls-sessions"},
+			`{"sessions":["1"],"status":["done"]}`},
+		{map[string]interface{}{"op": "frobnicate"},
+			`{"status":["error","unknown-op","done"]}`},
+	} {
+		if got := strings.Join(replEval(t, c, test.message), " "); got != test.want {
+			t.Errorf("%s: %s\nwant %s", toJSON(test.message), got, test.want)
+		}
+	}
+
+	describe := replEval(t, c, map[string]interface{}{"op": "describe"})
+	if !strings.Contains(describe[0], `"interrupt":{}`) || !strings.Contains(describe[0], `"versions":{"go":"go`) {
+		t.Errorf("describe %s", describe[0])
+	}
+
+	// an infinite loop by tail calls stops when interrupted
+	replEval(t, c, map[string]interface{}{"op": "eval", "code": `["def", "loop", ["fn", [], ["loop"]]]`})
+	done := make(chan []string)
+	go func() {
+		done <- replEval(t, c, map[string]interface{}{"op": "eval", "code": `["loop"]`})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.send(map[string]interface{}{"op": "interrupt"})
+	select {
+	case responses := <-done:
+		if got := strings.Join(responses, " "); got != `{"status":["interrupted","done"]}` {
+			t.Errorf("interrupted loop: %s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the loop was not interrupted")
+	}
+	if got := strings.Join(replEval(t, c, map[string]interface{}{"op": "eval", "code": `"x"`}), " "); got != `{"value":"40"} {"status":["done"]}` {
+		t.Errorf("eval after interrupt: %s", got)
+	}
+
+	// pipelined evals run in the order they were sent
+	first := c.send(map[string]interface{}{"op": "eval", "code": `["def", "y", 1]`})
+	second := c.send(map[string]interface{}{"op": "eval", "code": `"y"`})
+	responses := map[interface{}][]string{}
+	for done := 0; done < 2; {
+		response := map[string]interface{}{}
+		if err := c.dec.Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		id := response["id"]
+		delete(response, "id")
+		delete(response, "session")
+		responses[id] = append(responses[id], toJSON(response))
+		if hasStatus(response, "done") {
+			done++
+		}
+	}
+	for _, id := range []string{first, second} {
+		if got := strings.Join(responses[id], " "); got != `{"value":"1"} {"status":["done"]}` {
+			t.Errorf("pipelined eval %s: %s", id, got)
+		}
+	}
+
+	c.session = "7"
+	if got := strings.Join(replEval(t, c, map[string]interface{}{"op": "eval", "code": `"x"`}), " "); got != `{"status":["error","unknown-session","done"]}` {
+		t.Errorf("unknown session: %s", got)
+	}
+}
+
+func TestConnectREPL(t *testing.T) {
+	c, stop := startReplServer(t)
+	defer stop()
+	var out, errOut bytes.Buffer
+	in := bufio.NewReader(strings.NewReader(`["def", "greet", ["fn", ["n"], ["println", ["` + "`" + `", "hi"], "n"]]]
+["greet", 3]
+["greet"]
+:complete gr
+:bogus
+`))
+	if status := connectREPL(c, in, &out, &errOut); status != exitOK {
+		t.Errorf("status %d", status)
+	}
+	if got, want := out.String(), "> {}\n> hi3\nnull\n> > greet (function)\n> > \n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+	if got := errOut.String(); !strings.HasPrefix(got, "error: ") || !strings.HasSuffix(got, "error: unknown command :bogus\n") {
+		t.Errorf("errors %q", got)
+	}
+}
+
+func TestListenREPLLoopback(t *testing.T) {
+	for _, addr := range []string{"0.0.0.0:0", ":0", "example.com:7888"} {
+		if l, err := ListenREPL(addr); err == nil {
+			l.Close()
+			t.Errorf("listening on %s", addr)
+		}
+	}
+	l, err := ListenREPL("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if ip := l.Addr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Errorf("listening on %s", ip)
+	}
+}
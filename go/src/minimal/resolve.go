@@ -0,0 +1,381 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"fmt"
+)
+
+// Frame holds the values of the local symbols of a fn call or a let. The
+// resolver turns each local symbol into a (depth, slot) pair, so looking
+// it up walks depth parents and indexes a slice instead of hashing its
+// name at every level.
+type Frame struct {
+	slots  []interface{}
+	parent *Frame
+}
+
+// resolveScope tracks the slots of a Frame while resolving. Slots below
+// bound hold the parameters of a fn, bound when the Frame is made; the
+// others are unbound until a let binding or a def sets them.
+type resolveScope struct {
+	names  map[*Symbol]int
+	bound  int
+	parent *resolveScope
+}
+
+// unboundSlot is the value of the slots of a Frame not set yet
+type unboundSlot struct{}
+
+var unbound interface{} = unboundSlot{}
+
+// newFrame returns the Frame of scope, with its slots past bound unbound
+func newFrame(scope *resolveScope, parent *Frame) *Frame {
+	frame := &Frame{slots: make([]interface{}, len(scope.names)), parent: parent}
+	for i := scope.bound; i < len(frame.slots); i++ {
+		frame.slots[i] = unbound
+	}
+	return frame
+}
+
+func newResolveScope(parent *resolveScope) *resolveScope {
+	return &resolveScope{names: map[*Symbol]int{}, parent: parent}
+}
+
+func (s *resolveScope) add(name *Symbol) int {
+	slot, ok := s.names[name]
+	if !ok {
+		slot = len(s.names)
+		s.names[name] = slot
+	}
+	return slot
+}
+
+// Resolved nodes. Atoms other than symbols are kept as they are.
+type (
+	rLocal struct {
+		depth int
+		slot  int
+		// fallback is evaluated instead while the slot is unbound, as
+		// EVAL finds the symbol in an outer Environment before the let
+		// binding or def of the slot runs. It is nil for the parameters.
+		fallback interface{}
+	}
+	rGlobal struct {
+		symbol *Symbol
+	}
+	rQuote struct {
+		value interface{}
+	}
+	rDef struct {
+		symbol    *Symbol
+		docstring string
+		value     interface{}
+		// slot is the slot of the symbol when the def is inside a fn or
+		// a let, or -1 when it defines a symbol in the Environment
+		slot int
+		ast  []interface{}
+	}
+	rFn struct {
+		scope    *resolveScope
+		params   int
+		variadic bool
+		argSpec  interface{}
+		body     interface{}
+	}
+	rLet struct {
+		scope    *resolveScope
+		bindings []rBinding
+		body     interface{}
+	}
+	rBinding struct {
+		slot  int
+		value interface{}
+	}
+	rIf struct {
+		condition interface{}
+		then      interface{}
+		otherwise interface{}
+	}
+	rDo struct {
+		forms []interface{}
+	}
+	rCall struct {
+		elements []interface{}
+	}
+)
+
+// closure is a fn created by the resolved evaluator
+type closure struct {
+	fn    *rFn
+	frame *Frame
+	env   *Environment
+}
+
+// bind returns the frame of a call to c with args
+func (c *closure) bind(args []interface{}) *Frame {
+	if len(args) < c.fn.params || (!c.fn.variadic && len(args) > c.fn.params) {
+		panic(fmt.Errorf("wrong number of arguments (%d instead of %d)", len(args), c.fn.params))
+	}
+	frame := newFrame(c.fn.scope, c.frame)
+	copy(frame.slots, args[:c.fn.params])
+	if c.fn.variadic {
+		frame.slots[c.fn.params] = args[c.fn.params:]
+	}
+	return frame
+}
+
+func (c *closure) call(args []interface{}) interface{} {
+	return evalResolved(c.fn.body, c.bind(args), c.env)
+}
+
+// resolve converts ast to resolved nodes. scope is nil at the top level,
+// where symbols live in the Environment.
+func resolve(ast interface{}, scope *resolveScope) interface{} {
+	switch ast := ast.(type) {
+	case *Symbol:
+		return resolveSymbol(ast, scope, 0)
+	case []interface{}:
+		if len(ast) == 0 {
+			panic(fmt.Errorf("cannot evaluate an empty list"))
+		}
+		if first, ok := ast[0].(*Symbol); ok {
+			switch first {
+			case symDef:
+				return resolveDef(ast, scope)
+			case symQuote:
+				if len(ast) != 2 {
+					panic(fmt.Errorf("quote needs 1 argument (found %d)", len(ast)-1))
+				}
+				return &rQuote{value: ast[1]}
+			case symFn:
+				return resolveFn(ast, scope)
+			case symLet:
+				return resolveLet(ast, scope)
+			case symIf:
+				if len(ast) != 4 {
+					panic(fmt.Errorf("if needs 3 arguments (found %d)", len(ast)-1))
+				}
+				return &rIf{
+					condition: resolve(ast[1], scope),
+					then:      resolve(ast[2], scope),
+					otherwise: resolve(ast[3], scope),
+				}
+			case symDo:
+				if len(ast) < 2 {
+					panic(fmt.Errorf("do needs at least 1 argument"))
+				}
+				forms := make([]interface{}, len(ast)-1)
+				for i, form := range ast[1:] {
+					forms[i] = resolve(form, scope)
+				}
+				return &rDo{forms: forms}
+			}
+		}
+		elements := make([]interface{}, len(ast))
+		for i, element := range ast {
+			elements[i] = resolve(element, scope)
+		}
+		return &rCall{elements: elements}
+	default:
+		return ast
+	}
+}
+
+// resolveSymbol resolves symbol in scope, which is depth frames above the
+// frame the symbol is looked up from
+func resolveSymbol(symbol *Symbol, scope *resolveScope, depth int) interface{} {
+	for s := scope; s != nil; s = s.parent {
+		if slot, ok := s.names[symbol]; ok {
+			local := &rLocal{depth: depth, slot: slot}
+			if slot >= s.bound {
+				local.fallback = resolveSymbol(symbol, s.parent, depth+1)
+			}
+			return local
+		}
+		depth++
+	}
+	return &rGlobal{symbol: symbol}
+}
+
+// declare adds to scope the symbols the defs of ast bind in its frame, so
+// that the fns resolved before a def find its slot, as EVAL looks symbols
+// up when they are evaluated. fn and let forms have frames of their own.
+func declare(ast interface{}, scope *resolveScope) {
+	list, ok := ast.([]interface{})
+	if !ok || len(list) == 0 {
+		return
+	}
+	switch list[0] {
+	case symQuote, symFn, symLet:
+		return
+	case symDef:
+		if name, ok := list[1].(*Symbol); ok && len(list) > 2 {
+			scope.add(name)
+		}
+	}
+	for _, element := range list {
+		declare(element, scope)
+	}
+}
+
+func resolveDef(ast []interface{}, scope *resolveScope) interface{} {
+	if len(ast) < 3 || len(ast) > 4 {
+		panic(fmt.Errorf("def needs 2 or 3 arguments (found %d)", len(ast)-1))
+	}
+	identifier, ok := ast[1].(*Symbol)
+	if !ok {
+		panic(fmt.Errorf("Second argument in def %q must be a symbol", ast[1]))
+	}
+	def := &rDef{symbol: identifier, slot: -1, ast: ast}
+	if len(ast) == 4 {
+		def.docstring = docString(ast[2])
+	}
+	if scope != nil {
+		// declare added the slot before the forms of the frame were
+		// resolved, so fns can recurse
+		def.slot = scope.add(identifier)
+	}
+	def.value = resolve(ast[len(ast)-1], scope)
+	return def
+}
+
+func resolveFn(ast []interface{}, scope *resolveScope) interface{} {
+	if len(ast) != 3 {
+		panic(fmt.Errorf("fn need 2 arguments (found %d)", len(ast)))
+	}
+	params, ok := ast[1].([]interface{})
+	if !ok {
+		panic(fmt.Errorf("Binding must receive an array"))
+	}
+	fn := &rFn{scope: newResolveScope(scope), argSpec: ast[1]}
+	for i, param := range params {
+		name, ok := param.(*Symbol)
+		if !ok {
+			panic(fmt.Errorf("Variable identifier must be a symbol (was %T)", param))
+		}
+		if name == symAmp {
+			if i+1 == len(params) {
+				panic(fmt.Errorf("binding list cannot end with &"))
+			}
+			rest, ok := params[i+1].(*Symbol)
+			if !ok {
+				panic(fmt.Errorf("Variable identifier must be a symbol (was %T)", params[i+1]))
+			}
+			fn.variadic = true
+			fn.scope.add(rest)
+			break
+		}
+		fn.scope.add(name)
+		fn.params++
+	}
+	fn.scope.bound = len(fn.scope.names)
+	declare(ast[2], fn.scope)
+	fn.body = resolve(ast[2], fn.scope)
+	return fn
+}
+
+func resolveLet(ast []interface{}, scope *resolveScope) interface{} {
+	if len(ast) != 3 {
+		panic(fmt.Errorf("let needs 2 arguments (found %d)", len(ast)-1))
+	}
+	variables, ok := ast[1].([]interface{})
+	if !ok {
+		panic(fmt.Errorf("Second argument in let must be a list"))
+	}
+	if len(variables)%2 != 0 {
+		panic(fmt.Errorf("Second argument in let must be a list of pairs of name value"))
+	}
+	let := &rLet{scope: newResolveScope(scope)}
+	for i := 0; i < len(variables); i += 2 {
+		name, ok := variables[i].(*Symbol)
+		if !ok {
+			panic(fmt.Errorf("Variable identifier must be a symbol (was %T)", variables[i]))
+		}
+		let.scope.add(name)
+		declare(variables[i+1], let.scope)
+	}
+	declare(ast[2], let.scope)
+	// as in EVAL, each value is evaluated in the new frame, where the
+	// fns it creates see every binding and the names not bound yet are
+	// looked up outside
+	for i := 0; i < len(variables); i += 2 {
+		value := resolve(variables[i+1], let.scope)
+		let.bindings = append(let.bindings, rBinding{slot: let.scope.names[variables[i].(*Symbol)], value: value})
+	}
+	let.body = resolve(ast[2], let.scope)
+	return let
+}
+
+// evalResolved evaluates a resolved node with the local symbols in frame
+// and the rest in env
+func evalResolved(node interface{}, frame *Frame, env *Environment) interface{} {
+	for {
+		env.ctx.check()
+		switch n := node.(type) {
+		case *rLocal:
+			f := frame
+			for depth := n.depth; depth > 0; depth-- {
+				f = f.parent
+			}
+			if value := f.slots[n.slot]; value != unbound || n.fallback == nil {
+				return value
+			}
+			node = n.fallback
+		case *rGlobal:
+			return env.Lookup(n.symbol)
+		case *rQuote:
+			return n.value
+		case *rDef:
+			value := evalResolved(n.value, frame, env)
+			if n.slot >= 0 {
+				frame.slots[n.slot] = value
+			} else {
+				env.Define(n.symbol, value)
+				env.setDoc(n.symbol.name, n.docstring, value, n.ast)
+			}
+			return value
+		case *rFn:
+			return &closure{fn: n, frame: frame, env: env}
+		case *rLet:
+			frame = newFrame(n.scope, frame)
+			for _, binding := range n.bindings {
+				frame.slots[binding.slot] = evalResolved(binding.value, frame, env)
+			}
+			node = n.body
+		case *rIf:
+			if truthy(evalResolved(n.condition, frame, env)) {
+				node = n.then
+			} else {
+				node = n.otherwise
+			}
+		case *rDo:
+			for _, form := range n.forms[:len(n.forms)-1] {
+				evalResolved(form, frame, env)
+			}
+			node = n.forms[len(n.forms)-1]
+		case *rCall:
+			f := evalResolved(n.elements[0], frame, env)
+			args := make([]interface{}, len(n.elements)-1)
+			for i, element := range n.elements[1:] {
+				args[i] = evalResolved(element, frame, env)
+			}
+			c, ok := f.(*closure)
+			if !ok {
+				return apply(f, args)
+			}
+			node = c.fn.body
+			frame = c.bind(args)
+			env = c.env
+		default:
+			return node
+		}
+	}
+}
+
+// EvalResolved resolves ast and evaluates it in env
+func EvalResolved(ast interface{}, env *Environment) interface{} {
+	return evalResolved(resolve(ast, nil), nil, env)
+}
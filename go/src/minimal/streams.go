@@ -0,0 +1,111 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// SetOutput sets *out*, where prn, println and print write for e and its
+// children, os.Stdout when w is nil
+func (e *Environment) SetOutput(w io.Writer) {
+	e.ctx.out = w
+}
+
+// SetError sets *err*, where eprintln writes for e and its children,
+// os.Stderr when w is nil
+func (e *Environment) SetError(w io.Writer) {
+	e.ctx.err = w
+}
+
+// SetInput sets *in*, where read-line reads for e and its children, the
+// standard input when r is nil
+func (e *Environment) SetInput(r io.Reader) {
+	switch r := r.(type) {
+	case nil:
+		e.ctx.in = nil
+	case *bufio.Reader:
+		e.ctx.in = r
+	default:
+		e.ctx.in = bufio.NewReader(r)
+	}
+}
+
+func (c *evalContext) output() io.Writer {
+	if c.out != nil {
+		return c.out
+	}
+	return os.Stdout
+}
+
+func (c *evalContext) errOutput() io.Writer {
+	if c.err != nil {
+		return c.err
+	}
+	return os.Stderr
+}
+
+func (c *evalContext) input() *bufio.Reader {
+	if c.in != nil {
+		return c.in
+	}
+	// the reader of the REPL, so that both read the same lines
+	return stdin
+}
+
+// readLine returns the next line of *in* without its line terminator, or
+// nil at the end of the input
+func (c *evalContext) readLine() interface{} {
+	if line, ok := nextLine("read-line", c.input()); ok {
+		return line
+	}
+	return nil
+}
+
+// nextLine returns the next line of r without its line terminator, or
+// false at the end of r. Read errors panic with the name of builtin.
+func nextLine(builtin string, r *bufio.Reader) (string, bool) {
+	line, err := r.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return "", false
+	}
+	if err != nil && err != io.EOF {
+		panic(fmt.Errorf("%s: %s", builtin, err))
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), true
+}
+
+// flusher is a buffered writer, like a bufio.Writer
+type flusher interface {
+	Flush() error
+}
+
+// flush writes what *out* and *err* buffer
+func (c *evalContext) flush() interface{} {
+	for _, w := range []io.Writer{c.output(), c.errOutput()} {
+		if f, ok := w.(flusher); ok {
+			if err := f.Flush(); err != nil {
+				panic(fmt.Errorf("flush: %s", err))
+			}
+		}
+	}
+	return nil
+}
+
+// withOutStr calls f with *out* bound to a string buffer and returns what
+// it printed
+func (c *evalContext) withOutStr(f interface{}) interface{} {
+	var buffer bytes.Buffer
+	out := c.out
+	c.out = &buffer
+	defer func() { c.out = out }()
+	apply(f, []interface{}{})
+	return buffer.String()
+}
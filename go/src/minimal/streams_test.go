@@ -0,0 +1,52 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStreams(t *testing.T) {
+	q := func(s string) string { return `["` + "`" + `", "` + s + `"]` }
+	program := `["do",
+	  ["print", ` + q("a") + `],
+	  ["def", "s", ["with-out-str", ["fn", [],
+	    ["do", ["prn", 1], ["print", ["with-out-str", ["fn", [], ["print", 2]]]], ["eprintln", ` + q("e") + `]]]]],
+	  ["println", ` + q("b") + `],
+	  ["flush"],
+	  ["list", "s", ["read-line"], ["read-line"], ["read-line"]]]`
+	for _, backend := range []string{"tree", "resolved", "compiled", "bytecode"} {
+		var out, errOut bytes.Buffer
+		buffered := bufio.NewWriter(&out)
+		env := newSymbolTable(&options{backend: backend}, []string{})
+		env.SetOutput(buffered)
+		env.SetError(&errOut)
+		env.SetInput(strings.NewReader("first\r\nlast"))
+		result := JSON(evaluate(READ(program), env))
+		if want := `["1\n2","first","last",null]`; result != want {
+			t.Errorf("%s: result %s, want %s", backend, result, want)
+		}
+		if out.String() != "ab\n" || errOut.String() != "e\n" {
+			t.Errorf("%s: out %q err %q", backend, out.String(), errOut.String())
+		}
+	}
+}
+
+func TestWithOutStrRestoresOutput(t *testing.T) {
+	var out bytes.Buffer
+	env := newSymbolTable(&options{backend: "tree"}, []string{})
+	env.SetOutput(&out)
+	func() {
+		defer func() { recover() }()
+		evaluate(READ(`["with-out-str", ["fn", [], ["do", ["prn", 1], ["first", 1]]]]`), env)
+	}()
+	evaluate(READ(`["prn", 2]`), env)
+	if out.String() != "2\n" {
+		t.Errorf("output %q", out.String())
+	}
+}
@@ -0,0 +1,216 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Symbol is a name in code. Symbols are interned, so two symbols with the
+// same name are the same pointer and the special forms and Environments
+// compare them by pointer.
+type Symbol struct {
+	name string
+}
+
+func (s *Symbol) String() string {
+	return s.name
+}
+
+// MarshalJSON writes a symbol as its name, as the printer always did
+func (s *Symbol) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.name)
+}
+
+// Keyword is a self evaluating name written with a leading colon, like
+// ":key"
+type Keyword struct {
+	name string
+}
+
+func (k *Keyword) String() string {
+	return ":" + k.name
+}
+
+// MarshalJSON writes a keyword with its leading colon
+func (k *Keyword) MarshalJSON() ([]byte, error) {
+	return json.Marshal(":" + k.name)
+}
+
+var interned = struct {
+	sync.RWMutex
+	symbols  map[string]*Symbol
+	keywords map[string]*Keyword
+}{symbols: map[string]*Symbol{}, keywords: map[string]*Keyword{}}
+
+// Intern returns the symbol named name
+func Intern(name string) *Symbol {
+	interned.RLock()
+	s, ok := interned.symbols[name]
+	interned.RUnlock()
+	if ok {
+		return s
+	}
+	interned.Lock()
+	defer interned.Unlock()
+	if s, ok := interned.symbols[name]; ok {
+		return s
+	}
+	s = &Symbol{name: name}
+	interned.symbols[name] = s
+	return s
+}
+
+// InternKeyword returns the keyword named name, without its colon
+func InternKeyword(name string) *Keyword {
+	interned.RLock()
+	k, ok := interned.keywords[name]
+	interned.RUnlock()
+	if ok {
+		return k
+	}
+	interned.Lock()
+	defer interned.Unlock()
+	if k, ok := interned.keywords[name]; ok {
+		return k
+	}
+	k = &Keyword{name: name}
+	interned.keywords[name] = k
+	return k
+}
+
+// The symbols of the special forms
+var (
+	symDef   = Intern("def")
+	symQuote = Intern("`")
+	symFn    = Intern("fn")
+	symLet   = Intern("let")
+	symIf    = Intern("if")
+	symDo    = Intern("do")
+	symAmp   = Intern("&")
+)
+
+// symbolName returns the name of ast if it is a symbol
+func symbolName(ast interface{}) (string, bool) {
+	if s, ok := ast.(*Symbol); ok {
+		return s.name, true
+	}
+	return "", false
+}
+
+// stringLiteral returns the string ast evaluates to when it is a string
+// literal, either quoted or written with the readSymbols convention
+func stringLiteral(ast interface{}) (string, bool) {
+	if quoted, ok := ast.([]interface{}); ok && len(quoted) == 2 && quoted[0] == symQuote {
+		ast = quoted[1]
+	}
+	s, ok := ast.(string)
+	return s, ok
+}
+
+// readMode is the convention the reader follows to tell symbols from
+// string literals, as both are JSON strings in the source
+type readMode int
+
+const (
+	// readCompat reads the JSON strings of code as symbols and those
+	// inside quoted forms and maps as strings, so the literal "abc" is
+	// written ["`", "abc"] as it always was. It is the default.
+	readCompat readMode = iota
+	// readSymbols reads every JSON string as a symbol, except the ones
+	// that start with a backtick, which are string literals without it:
+	// "`abc" is the string abc. A lone "`" is still the quote symbol and
+	// "" is the empty string.
+	readSymbols
+)
+
+// readModes are the names of the read modes for the -read flag
+var readModes = map[string]readMode{
+	"compat":  readCompat,
+	"symbols": readSymbols,
+}
+
+// atom converts a JSON string read in mode. quoted is true inside quoted
+// forms and maps, where readCompat keeps strings.
+func (mode readMode) atom(s string, quoted bool) interface{} {
+	if mode == readCompat && quoted {
+		return s
+	}
+	if mode == readSymbols {
+		if s == "" {
+			return s
+		}
+		if s != "`" && s[0] == '`' {
+			return s[1:]
+		}
+	}
+	if len(s) > 1 && s[0] == ':' {
+		return InternKeyword(s[1:])
+	}
+	return Intern(s)
+}
+
+// symbolize returns a copy of ast, a decoded JSON value, with the strings
+// read as symbols, keywords or strings following mode
+func symbolize(ast interface{}, mode readMode, quoted bool) interface{} {
+	switch ast := ast.(type) {
+	case string:
+		return mode.atom(ast, quoted)
+	case []interface{}:
+		list := make([]interface{}, len(ast))
+		for i, element := range ast {
+			list[i] = symbolize(element, mode, quoted)
+			if i == 0 && list[0] == symQuote {
+				quoted = true
+			}
+		}
+		return list
+	case map[string]interface{}:
+		hashMap := make(map[string]interface{}, len(ast))
+		for key, value := range ast {
+			hashMap[key] = symbolize(value, mode, true)
+		}
+		return hashMap
+	default:
+		return ast
+	}
+}
+
+func functionSymbol(args []interface{}) interface{} {
+	switch name := args[0].(type) {
+	case string:
+		return Intern(name)
+	case *Symbol:
+		return name
+	default:
+		panic(fmt.Errorf("symbol requires a string"))
+	}
+}
+
+func functionSymbolQ(args []interface{}) interface{} {
+	_, ok := args[0].(*Symbol)
+	return ok
+}
+
+func functionKeyword(args []interface{}) interface{} {
+	switch name := args[0].(type) {
+	case string:
+		return InternKeyword(strings.TrimPrefix(name, ":"))
+	case *Symbol:
+		return InternKeyword(name.name)
+	case *Keyword:
+		return name
+	default:
+		panic(fmt.Errorf("keyword requires a string"))
+	}
+}
+
+func functionKeywordQ(args []interface{}) interface{} {
+	_, ok := args[0].(*Keyword)
+	return ok
+}
@@ -0,0 +1,689 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The test command runs the *_test.json files of a directory. Test files
+// are evaluated like load does, after expanding these forms, which need
+// their arguments unevaluated:
+//
+//	["deftest", "name", forms...]           registers a test
+//	["is", form]                             asserts that form is truthy
+//	["is", form, "message"]
+//	["are", ["x", "y"], template, values...] an is for each group of values
+//	["testing", "context", forms...]         names the assertions in forms
+//
+// An is of a call reports the values of its arguments when it fails, so
+// ["is", ["=", 4, ["+", 2, 1]]] fails with actual ["not",["=",4,3]].
+// The deftests run after the whole file is evaluated, wrapped by the
+// fixtures registered with use-fixtures: a fixture is a fn receiving the
+// test, or all the tests for :once, as a fn of no arguments to call.
+//
+// The forms are expanded in the test files only: a file they load is
+// evaluated as it is.
+
+var (
+	symDeftest = Intern("deftest")
+	symIs      = Intern("is")
+	symAre     = Intern("are")
+	symTesting = Intern("testing")
+	kwEach     = InternKeyword("each")
+	kwOnce     = InternKeyword("once")
+)
+
+// testFailure is a failed assertion, or an error raised inside one
+type testFailure struct {
+	pos      Position
+	contexts []string
+	message  string
+	expected string
+	actual   string
+	err      error
+}
+
+func (f *testFailure) String() string {
+	b := &strings.Builder{}
+	if f.pos.File != "" {
+		fmt.Fprintf(b, "%s: ", f.pos)
+	}
+	if len(f.contexts) > 0 {
+		fmt.Fprintf(b, "%s: ", strings.Join(f.contexts, " "))
+	}
+	if f.message != "" {
+		fmt.Fprintf(b, "%s: ", f.message)
+	}
+	if f.err != nil {
+		fmt.Fprintf(b, "error in %s: %s", f.expected, f.err)
+	} else {
+		fmt.Fprintf(b, "expected %s, actual %s", f.expected, f.actual)
+	}
+	return b.String()
+}
+
+// testCase is a deftest and its results
+type testCase struct {
+	name       string
+	fn         interface{}
+	assertions int
+	failures   []*testFailure
+	// err is an error raised by the test outside of any assertion
+	err      error
+	duration time.Duration
+}
+
+func (tc *testCase) passed() bool {
+	return len(tc.failures) == 0 && tc.err == nil
+}
+
+// testFile is a test file and its tests
+type testFile struct {
+	name  string
+	tests []*testCase
+	// err is an error reading or evaluating the file
+	err      error
+	duration time.Duration
+}
+
+// testRunner evaluates a test file in its own Environment
+type testRunner struct {
+	opts     *options
+	env      *Environment
+	file     *testFile
+	current  *testCase
+	contexts []string
+	each     []interface{}
+	once     []interface{}
+}
+
+func newTestRunner(opts *options, name string) *testRunner {
+	r := &testRunner{
+		opts: opts,
+		env:  newSymbolTable(opts, []string{}),
+		file: &testFile{name: name},
+	}
+	r.env.Set("use-fixtures", argsVariadic(r.useFixtures))
+	return r
+}
+
+// testText returns the text of the name of a deftest or testing form or
+// the message of an is, written as a symbol or a string literal
+func testText(form string, ast interface{}) string {
+	if name, ok := symbolName(ast); ok {
+		return name
+	}
+	if text, ok := stringLiteral(ast); ok {
+		return text
+	}
+	panic(fmt.Errorf("%s requires a name (found %s)", form, JSON(ast)))
+}
+
+// testBody returns a fn of no arguments evaluating forms
+func testBody(forms []interface{}) interface{} {
+	body := []interface{}{symDo}
+	body = append(body, forms...)
+	if len(forms) == 0 {
+		body = append(body, nil)
+	}
+	return []interface{}{symFn, []interface{}{}, body}
+}
+
+// expand replaces the test forms inside ast by calls to Go closures of r.
+// Other lists are expanded in place, so they keep their source positions.
+func (r *testRunner) expand(ast interface{}) interface{} {
+	list, ok := ast.([]interface{})
+	if !ok || len(list) == 0 {
+		return ast
+	}
+	switch list[0] {
+	case symQuote:
+		return ast
+	case symDeftest:
+		if len(list) < 2 {
+			panic(fmt.Errorf("deftest requires a name"))
+		}
+		name := testText("deftest", list[1])
+		return []interface{}{r.deftest(name), testBody(r.expandAll(list[2:]))}
+	case symIs:
+		if len(list) < 2 || len(list) > 3 {
+			panic(fmt.Errorf("is needs 1 or 2 arguments (found %d)", len(list)-1))
+		}
+		message := ""
+		if len(list) == 3 {
+			message = testText("is", list[2])
+		}
+		pos, _ := PositionOf(list)
+		return r.is(list[1], message, pos)
+	case symAre:
+		return r.are(list)
+	case symTesting:
+		if len(list) < 2 {
+			panic(fmt.Errorf("testing requires a context"))
+		}
+		context := testText("testing", list[1])
+		return []interface{}{r.testing(context), testBody(r.expandAll(list[2:]))}
+	}
+	r.expandAll(list)
+	return list
+}
+
+func (r *testRunner) expandAll(forms []interface{}) []interface{} {
+	for i, form := range forms {
+		forms[i] = r.expand(form)
+	}
+	return forms
+}
+
+// isCall reports whether form is a call whose arguments is can report
+func isCall(form interface{}) bool {
+	list, ok := form.([]interface{})
+	if !ok || len(list) == 0 {
+		return false
+	}
+	switch list[0] {
+	case symDef, symQuote, symFn, symLet, symIf, symDo:
+		return false
+	}
+	_, ok = list[0].(*Symbol)
+	return ok
+}
+
+// safeJSON returns the JSON encoding of a value to report, which can be a
+// fn that only prints as its type
+func safeJSON(ast interface{}) (s string) {
+	defer func() {
+		if recover() != nil {
+			s = fmt.Sprintf("<%T>", ast)
+		}
+	}()
+	return JSON(ast)
+}
+
+// is returns the form that evaluates an assertion of form
+func (r *testRunner) is(form interface{}, message string, pos Position) interface{} {
+	// the expected form is printed before expanding it, which can add Go
+	// closures to it
+	expected := safeJSON(form)
+	form = r.expand(form)
+	if !isCall(form) {
+		check := func(args []interface{}) interface{} {
+			return r.assert(pos, message, expected, func() (bool, interface{}, func() string) {
+				value := apply(args[0], nil)
+				return truthy(value), value, func() string { return safeJSON(value) }
+			})
+		}
+		return []interface{}{check, []interface{}{symFn, []interface{}{}, form}}
+	}
+
+	// the thunk returns the fn and the arguments of the call, so the
+	// failure can show them
+	call := form.([]interface{})
+	values := []interface{}{func(args []interface{}) interface{} { return args }}
+	values = append(values, call...)
+	check := func(args []interface{}) interface{} {
+		return r.assert(pos, message, expected, func() (bool, interface{}, func() string) {
+			values := apply(args[0], nil).([]interface{})
+			value := apply(values[0], values[1:])
+			return truthy(value), value, func() string {
+				actual := append([]interface{}{call[0]}, values[1:]...)
+				return safeJSON([]interface{}{Intern("not"), actual})
+			}
+		})
+	}
+	return []interface{}{check, []interface{}{symFn, []interface{}{}, values}}
+}
+
+// assert records the result of check, which returns whether the
+// assertion holds, its value and how to print the actual value
+func (r *testRunner) assert(pos Position, message, expected string, check func() (bool, interface{}, func() string)) (value interface{}) {
+	tc := r.current
+	if tc == nil {
+		// an assertion outside deftest is a test of its own
+		tc = &testCase{name: "top level assertions"}
+		if n := len(r.file.tests); n == 0 || r.file.tests[n-1].name != tc.name {
+			r.file.tests = append(r.file.tests, tc)
+		} else {
+			tc = r.file.tests[n-1]
+		}
+	}
+	tc.assertions++
+	failure := &testFailure{
+		pos:      pos,
+		contexts: append([]string{}, r.contexts...),
+		message:  message,
+		expected: expected,
+	}
+	defer func() {
+		if rec := recover(); rec != nil {
+			if r.env.ctx.isInterrupted() {
+				// a timeout is not a failed assertion
+				panic(rec)
+			}
+			failure.err = recoveredError(rec)
+			tc.failures = append(tc.failures, failure)
+			value = false
+		}
+	}()
+	ok, value, actual := check()
+	if !ok {
+		failure.actual = actual()
+		tc.failures = append(tc.failures, failure)
+	}
+	return value
+}
+
+// are expands ["are", ["x", "y"], template, values...] to an is of
+// template for each group of values
+func (r *testRunner) are(list []interface{}) interface{} {
+	if len(list) < 3 {
+		panic(fmt.Errorf("are needs at least 2 arguments (found %d)", len(list)-1))
+	}
+	params, ok := list[1].([]interface{})
+	if !ok || len(params) == 0 {
+		panic(fmt.Errorf("are requires a list of symbols"))
+	}
+	for _, param := range params {
+		if _, ok := param.(*Symbol); !ok {
+			panic(fmt.Errorf("are requires a list of symbols (found %s)", JSON(param)))
+		}
+	}
+	values := list[3:]
+	if len(values)%len(params) != 0 {
+		panic(fmt.Errorf("are needs a multiple of %d values (found %d)", len(params), len(values)))
+	}
+	pos, _ := PositionOf(list)
+	forms := []interface{}{symDo}
+	for i := 0; i < len(values); i += len(params) {
+		bindings := map[*Symbol]interface{}{}
+		for j, param := range params {
+			bindings[param.(*Symbol)] = values[i+j]
+		}
+		forms = append(forms, r.is(substitute(list[2], bindings), "", pos))
+	}
+	if len(forms) == 1 {
+		forms = append(forms, nil)
+	}
+	return forms
+}
+
+// substitute returns a copy of template with the symbols in bindings
+// replaced by their values, outside of quoted forms
+func substitute(template interface{}, bindings map[*Symbol]interface{}) interface{} {
+	switch template := template.(type) {
+	case *Symbol:
+		if value, ok := bindings[template]; ok {
+			return value
+		}
+		return template
+	case []interface{}:
+		if len(template) > 0 && template[0] == symQuote {
+			return template
+		}
+		list := make([]interface{}, len(template))
+		for i, element := range template {
+			list[i] = substitute(element, bindings)
+		}
+		return list
+	default:
+		return template
+	}
+}
+
+// deftest returns the fn registering the test name
+func (r *testRunner) deftest(name string) interface{} {
+	return func(args []interface{}) interface{} {
+		r.file.tests = append(r.file.tests, &testCase{name: name, fn: args[0]})
+		return nil
+	}
+}
+
+// testing returns the fn calling its argument inside context
+func (r *testRunner) testing(context string) interface{} {
+	return func(args []interface{}) interface{} {
+		r.contexts = append(r.contexts, context)
+		defer func() { r.contexts = r.contexts[:len(r.contexts)-1] }()
+		return apply(args[0], nil)
+	}
+}
+
+func (r *testRunner) useFixtures(args []interface{}) interface{} {
+	if len(args) < 2 {
+		panic(fmt.Errorf("use-fixtures requires :each or :once and at least one fixture"))
+	}
+	switch args[0] {
+	case kwEach:
+		r.each = append(r.each, args[1:]...)
+	case kwOnce:
+		r.once = append(r.once, args[1:]...)
+	default:
+		panic(fmt.Errorf("use-fixtures requires :each or :once (found %s)", JSON(args[0])))
+	}
+	return nil
+}
+
+// wrap returns a fn of no arguments calling f through fixtures, the first
+// one outermost
+func wrap(fixtures []interface{}, f func()) interface{} {
+	var run interface{} = func(args []interface{}) interface{} {
+		f()
+		return nil
+	}
+	for i := len(fixtures) - 1; i >= 0; i-- {
+		fixture, inner := fixtures[i], run
+		run = func(args []interface{}) interface{} {
+			return apply(fixture, []interface{}{inner})
+		}
+	}
+	return run
+}
+
+// run evaluates the test file and then its tests
+func (r *testRunner) run() *testFile {
+	start := time.Now()
+	defer func() { r.file.duration = time.Since(start) }()
+
+	_, r.file.err = evalWithOptions(r.opts, r.env, func() interface{} {
+		// the file is read as load would, confined to -root
+		contents := functionSlurp([]interface{}{r.env.ctx.path("test", r.file.name)}).(string)
+		ast := readSource(contents, r.file.name, r.env.ctx.mode)
+		return evaluate(r.expand(ast), r.env)
+	})
+	if r.file.err != nil {
+		return r.file
+	}
+
+	tests := []*testCase{}
+	for _, tc := range r.file.tests {
+		if tc.fn != nil {
+			tests = append(tests, tc)
+		}
+	}
+	all := wrap(r.once, func() {
+		for _, tc := range tests {
+			r.runTest(tc)
+		}
+	})
+	// -timeout applies to each test, not to all of them
+	untimed := *r.opts
+	untimed.timeout = 0
+	_, r.file.err = evalWithOptions(&untimed, r.env, func() interface{} {
+		return apply(all, nil)
+	})
+	return r.file
+}
+
+func (r *testRunner) runTest(tc *testCase) {
+	start := time.Now()
+	r.current = tc
+	r.contexts = nil
+	_, tc.err = evalWithOptions(r.opts, r.env, func() interface{} {
+		return apply(wrap(r.each, func() { apply(tc.fn, nil) }), nil)
+	})
+	r.current = nil
+	tc.duration = time.Since(start)
+}
+
+// findTestFiles returns the *_test.json files of paths, which are files
+// or directories searched recursively
+func findTestFiles(paths []string) ([]string, error) {
+	files := []string{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		err = filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && strings.HasSuffix(file, "_test.json") {
+				files = append(files, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// testReporter writes the results of the test files as they finish
+type testReporter interface {
+	file(f *testFile)
+	end()
+}
+
+// tapReporter writes the Test Anything Protocol, version 13
+type tapReporter struct {
+	w     io.Writer
+	count int
+}
+
+func newTAPReporter(w io.Writer) *tapReporter {
+	fmt.Fprintln(w, "TAP version 13")
+	return &tapReporter{w: w}
+}
+
+func (t *tapReporter) point(ok bool, description string, diagnostics [][2]string, failures []*testFailure) {
+	t.count++
+	status := "ok"
+	if !ok {
+		status = "not ok"
+	}
+	fmt.Fprintf(t.w, "%s %d - %s\n", status, t.count, description)
+	if len(diagnostics) == 0 && len(failures) == 0 {
+		return
+	}
+	fmt.Fprintln(t.w, "  ---")
+	for _, d := range diagnostics {
+		fmt.Fprintf(t.w, "  %s: %s\n", d[0], yamlScalar(d[1]))
+	}
+	if len(failures) > 0 {
+		fmt.Fprintln(t.w, "  failures:")
+		for _, f := range failures {
+			prefix := "    - "
+			field := func(name, value string) {
+				if value != "" {
+					fmt.Fprintf(t.w, "%s%s: %s\n", prefix, name, yamlScalar(value))
+					prefix = "      "
+				}
+			}
+			if f.pos.File != "" {
+				field("at", f.pos.String())
+			}
+			field("testing", strings.Join(f.contexts, " "))
+			field("message", f.message)
+			field("expected", f.expected)
+			if f.err != nil {
+				field("error", f.err.Error())
+			} else {
+				field("actual", f.actual)
+			}
+		}
+	}
+	fmt.Fprintln(t.w, "  ...")
+}
+
+func (t *tapReporter) file(f *testFile) {
+	if f.err != nil && len(f.tests) == 0 {
+		t.point(false, f.name, [][2]string{{"error", f.err.Error()}}, nil)
+		return
+	}
+	for _, tc := range f.tests {
+		diagnostics := [][2]string{}
+		if tc.err != nil {
+			diagnostics = append(diagnostics, [2]string{"error", tc.err.Error()})
+		}
+		t.point(tc.passed(), f.name+": "+tc.name, diagnostics, tc.failures)
+	}
+	if f.err != nil {
+		t.point(false, f.name, [][2]string{{"error", f.err.Error()}}, nil)
+	}
+}
+
+func (t *tapReporter) end() {
+	fmt.Fprintf(t.w, "1..%d\n", t.count)
+}
+
+// JUnit XML, as read by most CI servers
+type (
+	junitSuites struct {
+		XMLName  xml.Name     `xml:"testsuites"`
+		Tests    int          `xml:"tests,attr"`
+		Failures int          `xml:"failures,attr"`
+		Errors   int          `xml:"errors,attr"`
+		Time     string       `xml:"time,attr"`
+		Suites   []junitSuite `xml:"testsuite"`
+	}
+	junitSuite struct {
+		Name     string      `xml:"name,attr"`
+		Tests    int         `xml:"tests,attr"`
+		Failures int         `xml:"failures,attr"`
+		Errors   int         `xml:"errors,attr"`
+		Time     string      `xml:"time,attr"`
+		Cases    []junitCase `xml:"testcase"`
+	}
+	junitCase struct {
+		Name      string        `xml:"name,attr"`
+		ClassName string        `xml:"classname,attr"`
+		Time      string        `xml:"time,attr"`
+		Failure   *junitProblem `xml:"failure,omitempty"`
+		Error     *junitProblem `xml:"error,omitempty"`
+	}
+	junitProblem struct {
+		Message string `xml:"message,attr"`
+		Text    string `xml:",chardata"`
+	}
+)
+
+// junitReporter collects the results and writes them at the end
+type junitReporter struct {
+	w      io.Writer
+	suites junitSuites
+	time   time.Duration
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+func (j *junitReporter) file(f *testFile) {
+	suite := junitSuite{Name: f.name, Time: seconds(f.duration)}
+	for _, tc := range f.tests {
+		c := junitCase{Name: tc.name, ClassName: f.name, Time: seconds(tc.duration)}
+		if len(tc.failures) > 0 {
+			lines := []string{}
+			for _, failure := range tc.failures {
+				lines = append(lines, failure.String())
+			}
+			c.Failure = &junitProblem{Message: lines[0], Text: strings.Join(lines, "\n")}
+			suite.Failures++
+		}
+		if tc.err != nil {
+			c.Error = &junitProblem{Message: tc.err.Error()}
+			suite.Errors++
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	if f.err != nil {
+		suite.Cases = append(suite.Cases, junitCase{
+			Name:      "(file)",
+			ClassName: f.name,
+			Time:      seconds(0),
+			Error:     &junitProblem{Message: f.err.Error()},
+		})
+		suite.Errors++
+	}
+	suite.Tests = len(suite.Cases)
+	j.suites.Tests += suite.Tests
+	j.suites.Failures += suite.Failures
+	j.suites.Errors += suite.Errors
+	j.time += f.duration
+	j.suites.Suites = append(j.suites.Suites, suite)
+}
+
+func (j *junitReporter) end() {
+	j.suites.Time = seconds(j.time)
+	b, err := xml.MarshalIndent(j.suites, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(j.w, "%s%s\n", xml.Header, b)
+}
+
+// cmdTest implements the test command
+func cmdTest(opts *options, args []string) int {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	format := flags.String("format", "tap", "output format: tap or junit")
+	output := flags.String("o", "", "output file (default stdout)")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return exitStatus(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	var reporter testReporter
+	switch *format {
+	case "tap":
+		reporter = newTAPReporter(w)
+	case "junit":
+		reporter = &junitReporter{w: w}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown test format %q\n", *format)
+		return exitUsage
+	}
+
+	files, err := findTestFiles(paths)
+	if err != nil {
+		return exitStatus(err)
+	}
+	status := exitOK
+	for _, name := range files {
+		f := runTestFile(opts, name)
+		reporter.file(f)
+		if f.err != nil {
+			status = exitError
+		}
+		for _, tc := range f.tests {
+			if !tc.passed() {
+				status = exitError
+			}
+		}
+	}
+	reporter.end()
+	return status
+}
+
+// runTestFile runs a test file in a fresh Environment
+func runTestFile(opts *options, name string) *testFile {
+	return newTestRunner(opts, name).run()
+}
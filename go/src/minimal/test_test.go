@@ -0,0 +1,94 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const sampleTests = `["do",
+  ["use-fixtures", ":each", ["fn", ["t"], ["do", ["t"], null]]],
+  ["deftest", "addition",
+    ["is", ["=", 4, ["+", 2, 2]]],
+    ["testing", "with negatives",
+      ["is", ["=", 0, ["+", 2, -1]], "two and minus one"]]],
+  ["deftest", "table",
+    ["are", ["x", "y"], ["=", "x", ["*", "y", 2]],
+      2, 1,
+      5, 3]],
+  ["deftest", "error", ["is", ["first", 1]]],
+  ["deftest", "passes", ["is", ["list?", ["list"]]]]
+]`
+
+func TestRunTestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minimal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "sample_test.json")
+	if err := ioutil.WriteFile(file, []byte(sampleTests), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, backend := range []string{"tree", "resolved", "compiled", "bytecode"} {
+		f := runTestFile(&options{backend: backend}, file)
+		if f.err != nil {
+			t.Fatalf("%s: %s", backend, f.err)
+		}
+		results := []string{}
+		for _, tc := range f.tests {
+			result := tc.name
+			for _, failure := range tc.failures {
+				result += " | " + strings.TrimPrefix(failure.String(), file+":")
+			}
+			results = append(results, result)
+		}
+		got := strings.Join(results, "\n")
+		want := strings.Join([]string{
+			`addition | 6:7: with negatives: two and minus one: expected ["=",0,["+",2,-1]], actual ["not",["=",0,1]]`,
+			`table | 8:5: expected ["=",5,["*",3,2]], actual ["not",["=",5,6]]`,
+			`error | 11:24: error in ["first",1]: first argument must be a list`,
+			`passes`,
+		}, "\n")
+		if got != want {
+			t.Errorf("%s:\ngot\n%s\nwant\n%s", backend, got, want)
+		}
+	}
+
+	// under -root, test files are read like load reads them
+	root, err := ioutil.TempDir("", "minimal-test-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if root, err = sandboxRoot(root); err != nil {
+		t.Fatal(err)
+	}
+	if f := runTestFile(&options{root: root}, file); f.err == nil || f.err.Error() != "test: "+file+" is outside the root "+root {
+		t.Errorf("test file out of the root: %v", f.err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "sample_test.json"), []byte(sampleTests), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if f := runTestFile(&options{root: root}, "sample_test.json"); f.err != nil || len(f.tests) != 4 {
+		t.Errorf("test file in the root: %v, %d tests", f.err, len(f.tests))
+	}
+
+	var tap bytes.Buffer
+	reporter := newTAPReporter(&tap)
+	reporter.file(runTestFile(&options{}, file))
+	reporter.end()
+	for _, line := range []string{"not ok 1 - " + file + ": addition", "ok 4 - " + file + ": passes", "1..4"} {
+		if !strings.Contains(tap.String(), line+"\n") {
+			t.Errorf("TAP output without %q:\n%s", line, tap.String())
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// tracer writes the calls of the functions traced with trace and, with
+// -trace-eval, every form EVAL evaluates
+type tracer struct {
+	w io.Writer
+	// depth is the number of traced calls running
+	depth int
+	// evalDepth is the number of EVAL calls running
+	evalDepth int
+	// traced are the values the traced symbols had before trace
+	traced map[*Symbol]interface{}
+}
+
+// traceFormWidth is where -trace-eval cuts the forms it writes
+const traceFormWidth = 120
+
+func newTracer() *tracer {
+	return &tracer{w: os.Stderr, traced: map[*Symbol]interface{}{}}
+}
+
+// SetTraceWriter sets where the trace output of e and its children goes,
+// os.Stderr by default
+func (e *Environment) SetTraceWriter(w io.Writer) {
+	e.ctx.tracer.w = w
+}
+
+// SetTraceEval turns on or off writing each form EVAL evaluates with its
+// depth, source position and TCO iteration
+func (e *Environment) SetTraceEval(on bool) {
+	e.ctx.traceEval = on
+}
+
+// hookedEVAL is EVAL keeping the depth of the evaluations for the tracer
+// and the frames of the debugger
+func hookedEVAL(ast interface{}, env *Environment, flags evalFlags) interface{} {
+	t, d := env.ctx.tracer, env.ctx.debugger
+	t.evalDepth++
+	if d != nil {
+		d.push()
+	}
+	defer func() {
+		t.evalDepth--
+		if d != nil {
+			d.pop()
+		}
+	}()
+	return evalTCO(ast, env, flags|hooked)
+}
+
+// eval writes a line for an evaluation of ast, the iteration-th form the
+// EVAL running evaluates after tail calls
+func (t *tracer) eval(ast interface{}, iteration int) {
+	pos := "-"
+	if p, ok := PositionOf(ast); ok {
+		pos = p.String()
+	}
+	form := safeJSON(ast)
+	if len(form) > traceFormWidth {
+		form = form[:traceFormWidth-3] + "..."
+	}
+	fmt.Fprintf(t.w, "%s%d %s tco %d: %s\n", strings.Repeat("  ", t.evalDepth-1), t.evalDepth, pos, iteration, form)
+}
+
+// traceNames returns the symbols named by the arguments of trace and
+// untrace, strings or symbols
+func traceNames(name string, args []interface{}) []*Symbol {
+	symbols := make([]*Symbol, len(args))
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case string:
+			symbols[i] = Intern(arg)
+		case *Symbol:
+			symbols[i] = arg
+		default:
+			panic(fmt.Errorf("%s requires names of functions (found %s)", name, safeJSON(arg)))
+		}
+	}
+	return symbols
+}
+
+func isFunction(value interface{}) bool {
+	switch value.(type) {
+	case func([]interface{}) interface{}, tcoFN, *closure, *compiledFn, *vmClosure:
+		return true
+	}
+	return false
+}
+
+// trace replaces the functions defined in env named by args by functions
+// that write their calls and results, indented by the traced calls
+// running. It returns the list of names traced.
+func (t *tracer) trace(env *Environment, args []interface{}) interface{} {
+	names := []interface{}{}
+	for _, symbol := range traceNames("trace", args) {
+		f, ok := env.Scope[symbol]
+		if !ok || !isFunction(f) {
+			panic(fmt.Errorf("trace requires defined functions (%s is not)", symbol.name))
+		}
+		if _, ok := t.traced[symbol]; !ok {
+			t.traced[symbol] = f
+			env.Scope[symbol] = t.wrap(symbol, f)
+		}
+		names = append(names, symbol.name)
+	}
+	return names
+}
+
+func (t *tracer) wrap(symbol *Symbol, f interface{}) func([]interface{}) interface{} {
+	return func(args []interface{}) interface{} {
+		indent := strings.Repeat("| ", t.depth)
+		fmt.Fprintf(t.w, "%s%s\n", indent, safeJSON(append([]interface{}{symbol}, args...)))
+		t.depth++
+		returned := false
+		defer func() {
+			t.depth--
+			if !returned {
+				r := recover()
+				fmt.Fprintf(t.w, "%s!! %s\n", indent, recoveredError(r))
+				panic(r)
+			}
+		}()
+		result := apply(f, args)
+		returned = true
+		fmt.Fprintf(t.w, "%s=> %s\n", indent, safeJSON(result))
+		return result
+	}
+}
+
+// untrace restores the functions named by args, or every traced function
+// without args. It returns the list of names untraced.
+func (t *tracer) untrace(env *Environment, args []interface{}) interface{} {
+	symbols := traceNames("untrace", args)
+	if len(args) == 0 {
+		for symbol := range t.traced {
+			symbols = append(symbols, symbol)
+		}
+		sort.Slice(symbols, func(i, j int) bool { return symbols[i].name < symbols[j].name })
+	}
+	names := []interface{}{}
+	for _, symbol := range symbols {
+		if f, ok := t.traced[symbol]; ok {
+			env.Scope[symbol] = f
+			delete(t.traced, symbol)
+			names = append(names, symbol.name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,67 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	program := `["do",
+	  ["def", "fib", ["fn", ["n"],
+	    ["if", ["<", "n", 2], "n", ["+", ["fib", ["-", "n", 1]], ["fib", ["-", "n", 2]]]]]],
+	  ["def", "head", ["fn", ["l"], ["first", "l"]]],
+	  ["trace", ["` + "`" + `", "fib"], ["` + "`" + `", "head"]],
+	  ["fib", 2],
+	  ["untrace", ["` + "`" + `", "fib"]],
+	  ["fib", 2],
+	  ["head", 1]]`
+	want := strings.Join([]string{
+		`["fib",2]`,
+		`| ["fib",1]`,
+		`| => 1`,
+		`| ["fib",0]`,
+		`| => 0`,
+		`=> 1`,
+		`["head",1]`,
+		`!! first argument must be a list`,
+		``,
+	}, "\n")
+	for _, backend := range []string{"tree", "resolved", "compiled", "bytecode"} {
+		var out bytes.Buffer
+		env := newSymbolTable(&options{backend: backend}, []string{})
+		env.SetTraceWriter(&out)
+		func() {
+			defer func() { recover() }()
+			evaluate(READ(program), env)
+		}()
+		if out.String() != want {
+			t.Errorf("%s: trace output\n%s\nwant\n%s", backend, out.String(), want)
+		}
+	}
+}
+
+func TestTraceEval(t *testing.T) {
+	var out bytes.Buffer
+	env := newSymbolTable(&options{backend: "tree"}, []string{})
+	env.SetTraceWriter(&out)
+	env.SetTraceEval(true)
+	evaluate(readSource(`["let", ["f", ["fn", ["x"], "x"]],
+  ["f", 1]]`, "f.json", readCompat), env)
+	want := strings.Join([]string{
+		`1 f.json:1:1 tco 0: ["let",["f",["fn",["x"],"x"]],["f",1]]`,
+		`  2 f.json:1:15 tco 0: ["fn",["x"],"x"]`,
+		`1 f.json:2:3 tco 1: ["f",1]`,
+		`  2 - tco 0: "f"`,
+		`  2 - tco 0: 1`,
+		`1 - tco 2: "x"`,
+		``,
+	}, "\n")
+	if out.String() != want {
+		t.Errorf("trace output\n%s\nwant\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,184 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// upvalue is a local of a call captured by a fn created in that call.
+// Every call has its own locals slice, so upvalues can point to it after
+// the call returns.
+type upvalue struct {
+	locals []interface{}
+	index  int
+}
+
+// vmClosure is a fn created by the bytecode VM
+type vmClosure struct {
+	proto    *proto
+	upvalues []*upvalue
+	env      *Environment
+}
+
+// bind returns the locals of a call to c with args
+func (c *vmClosure) bind(args []interface{}) []interface{} {
+	p := c.proto
+	if len(args) < p.params || (!p.variadic && len(args) > p.params) {
+		panic(fmt.Errorf("wrong number of arguments (%d instead of %d)", len(args), p.params))
+	}
+	locals := newLocals(p)
+	copy(locals, args[:p.params])
+	if p.variadic {
+		locals[p.params] = args[p.params:]
+	}
+	return locals
+}
+
+// newLocals returns the locals of a call to p, unbound but for the
+// parameters
+func newLocals(p *proto) []interface{} {
+	locals := make([]interface{}, p.locals)
+	params := p.params
+	if p.variadic {
+		params++
+	}
+	for i := params; i < len(locals); i++ {
+		locals[i] = unbound
+	}
+	return locals
+}
+
+func (c *vmClosure) call(args []interface{}) interface{} {
+	return runVM(c, c.bind(args))
+}
+
+// vmFrame is a call running in the VM
+type vmFrame struct {
+	fn     *vmClosure
+	pc     int
+	locals []interface{}
+}
+
+// runVM runs c with locals. Calls between VM fns push frames instead of
+// recursing in Go, and tail calls replace the current frame.
+func runVM(c *vmClosure, locals []interface{}) interface{} {
+	stack := []interface{}{}
+	callers := []vmFrame{}
+	fr := vmFrame{fn: c, locals: locals}
+	for {
+		p := fr.fn.proto
+		ins := p.code[fr.pc]
+		fr.pc++
+		op, a := opcode(ins&0xff), int(ins>>8)
+
+		var result interface{}
+		switch op {
+		case opConst:
+			stack = append(stack, p.constants[a])
+			continue
+		case opLocal:
+			stack = append(stack, fr.locals[a])
+			continue
+		case opUpvalue:
+			uv := fr.fn.upvalues[a]
+			stack = append(stack, uv.locals[uv.index])
+			continue
+		case opGlobal:
+			stack = append(stack, fr.fn.env.Lookup(p.constants[a].(*Symbol)))
+			continue
+		case opSetLocal:
+			fr.locals[a] = stack[len(stack)-1]
+			continue
+		case opDef:
+			def := p.constants[a].(*rDef)
+			value := stack[len(stack)-1]
+			fr.fn.env.Define(def.symbol, value)
+			fr.fn.env.setDoc(def.symbol.name, def.docstring, value, def.ast)
+			continue
+		case opPop:
+			stack = stack[:len(stack)-1]
+			continue
+		case opJump:
+			fr.pc = a
+			continue
+		case opJumpIfBound:
+			if stack[len(stack)-1] != unbound {
+				fr.pc = a
+			} else {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		case opJumpIfFalse:
+			value := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if !truthy(value) {
+				fr.pc = a
+			}
+			continue
+		case opClosure:
+			child := p.constants[a].(*proto)
+			fn := &vmClosure{proto: child, upvalues: make([]*upvalue, len(child.upvalues)), env: fr.fn.env}
+			for i, uv := range child.upvalues {
+				if uv.local {
+					fn.upvalues[i] = &upvalue{locals: fr.locals, index: uv.index}
+				} else {
+					fn.upvalues[i] = fr.fn.upvalues[uv.index]
+				}
+			}
+			stack = append(stack, fn)
+			continue
+		case opCall, opTailCall:
+			fr.fn.env.ctx.check()
+			start := len(stack) - a
+			f := stack[start-1]
+			args := make([]interface{}, a)
+			copy(args, stack[start:])
+			stack = stack[:start-1]
+			if callee, ok := f.(*vmClosure); ok {
+				locals := callee.bind(args)
+				if op == opCall {
+					callers = append(callers, fr)
+				}
+				fr = vmFrame{fn: callee, locals: locals}
+				continue
+			}
+			result = apply(f, args)
+			if op == opCall {
+				stack = append(stack, result)
+				continue
+			}
+		case opReturn:
+			result = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		default:
+			panic(fmt.Errorf("invalid opcode %d", op))
+		}
+
+		// the current call returns result
+		if len(callers) == 0 {
+			return result
+		}
+		fr = callers[len(callers)-1]
+		callers = callers[:len(callers)-1]
+		stack = append(stack, result)
+	}
+}
+
+// EvalBytecode compiles ast to bytecode and runs it in env
+func EvalBytecode(ast interface{}, env *Environment) interface{} {
+	return evalBytecode(ast, env, nil)
+}
+
+// evalBytecode is EvalBytecode writing the disassembled code to disasm
+// when it is not nil
+func evalBytecode(ast interface{}, env *Environment, disasm io.Writer) interface{} {
+	p := compileBytecode(ast)
+	if disasm != nil {
+		disassemble(disasm, p, "top level")
+	}
+	return runVM(&vmClosure{proto: p, env: env}, newLocals(p))
+}
@@ -0,0 +1,22 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"conformance"
+)
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, "../../../tests/step1_read_print.json", "../..", func(form string) string {
+		b, err := REPL([]byte(strings.Trim(form, " \t\n")))
+		if err != nil {
+			return err.Error()
+		}
+		return string(b)
+	})
+}
@@ -0,0 +1,26 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"conformance"
+)
+
+func TestConformance(t *testing.T) {
+	symbolTable := Environment{}
+	for symbol, atom := range SymbolTable {
+		symbolTable[symbol] = atom
+	}
+	conformance.Run(t, "../../../tests/step2_eval.json", "../..", func(form string) string {
+		b, err := REPL([]byte(strings.Trim(form, " \t\n")), symbolTable)
+		if err != nil {
+			return err.Error()
+		}
+		return string(b)
+	})
+}
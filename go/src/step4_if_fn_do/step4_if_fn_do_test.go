@@ -0,0 +1,23 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"conformance"
+)
+
+func TestConformance(t *testing.T) {
+	symbolTable := BaseSymbolTable()
+	conformance.Run(t, "../../../tests/step4_if_fn_do.json", "../..", func(form string) string {
+		b, err := REPL([]byte(strings.Trim(form, " \t\n")), symbolTable)
+		if err != nil {
+			return err.Error()
+		}
+		return string(b)
+	})
+}
@@ -0,0 +1,24 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"conformance"
+)
+
+func TestConformance(t *testing.T) {
+	symbolTable := BaseSymbolTable()
+	symbolTable.Set("ARGS", []string{})
+	conformance.Run(t, "../../../tests/step6_file.json", "../..", func(form string) string {
+		b, err := REPL([]byte(strings.Trim(form, " \t\n")), symbolTable)
+		if err != nil {
+			return err.Error()
+		}
+		return string(b)
+	})
+}
@@ -0,0 +1,27 @@
+// miniMAL
+// Copyright (C) 2018 Jordi Íñigo i Griera
+// Licensed under MPL 2.0
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"conformance"
+)
+
+func TestConformance(t *testing.T) {
+	symbolTable := BaseSymbolTable()
+	symbolTable.Set("ARGS", []string{})
+	conformance.Run(t, "../../../tests/step7_interop.json", "../..", func(form string) (ret string) {
+		// step7 reports errors panicking
+		defer func() {
+			if r := recover(); r != nil {
+				ret = fmt.Sprint(r)
+			}
+		}()
+		return JSON(EVAL(READ(strings.Trim(form, " \t\n")), symbolTable))
+	})
+}